@@ -0,0 +1,8 @@
+package main
+
+import "embed"
+
+//go:generate go run ./internal/assets/fetchvendor -dir static
+
+//go:embed templates static
+var embedded embed.FS
@@ -1,5 +1,19 @@
 module headcontrol
 
-go 1.23
+go 1.23.0
 
-require github.com/mattn/go-sqlite3 v1.14.24
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/crypto v0.36.0
+	google.golang.org/grpc v1.73.0
+	google.golang.org/protobuf v1.36.6
+	rsc.io/qr v0.2.0
+)
+
+require (
+	golang.org/x/net v0.38.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250324211829-b45e905df463 // indirect
+)
@@ -0,0 +1,148 @@
+package assets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const hashLen = 12
+
+// Static serves files from an fs.FS under a URL prefix. Outside dev mode
+// every file is hashed once at startup so asset URLs carry a version
+// parameter and can be cached by browsers indefinitely.
+type Static struct {
+	fsys   fs.FS
+	prefix string
+	dev    bool
+	hashes map[string]string
+	vendor map[string]VendorRef
+}
+
+// VendorRef points a template at a vendored file and its pinned integrity.
+type VendorRef struct {
+	Src       string
+	Integrity string
+}
+
+func New(fsys fs.FS, prefix string, dev bool) (*Static, error) {
+	s := &Static{
+		fsys:   fsys,
+		prefix: strings.TrimRight(prefix, "/") + "/",
+		dev:    dev,
+		hashes: map[string]string{},
+		vendor: map[string]VendorRef{},
+	}
+	if !dev {
+		if err := s.hashFiles(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.loadVendor(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Static) hashFiles() error {
+	return fs.WalkDir(s.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(s.fsys, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		s.hashes[p] = hex.EncodeToString(sum[:])[:hashLen]
+		return nil
+	})
+}
+
+// loadVendor verifies every file pinned in the vendor manifest. A missing
+// file or pin is a startup error: the UI has no remote fallback.
+func (s *Static) loadVendor() error {
+	m, err := LoadManifest(s.fsys)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := m.Verify(s.fsys); err != nil {
+		return fmt.Errorf("static: %w (run 'go generate' to fetch vendored files)", err)
+	}
+	for _, p := range m.Packages {
+		for _, f := range p.Files {
+			s.vendor[f.Path] = VendorRef{Src: s.Path("vendor/" + f.Path), Integrity: f.Integrity}
+		}
+	}
+	return nil
+}
+
+// Vendor returns the reference for a file listed in the vendor manifest.
+func (s *Static) Vendor(name string) (VendorRef, error) {
+	ref, ok := s.vendor[name]
+	if !ok {
+		return VendorRef{}, fmt.Errorf("vendor/%s is not listed in %s", name, ManifestPath)
+	}
+	return ref, nil
+}
+
+// Path returns the URL for the named asset, including its content hash.
+func (s *Static) Path(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	hash, ok := s.hashes[name]
+	if !ok {
+		return s.prefix + name
+	}
+	return s.prefix + name + "?v=" + hash
+}
+
+func (s *Static) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, s.prefix)), "/")
+	data, err := fs.ReadFile(s.fsys, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	hash, ok := s.hashes[name]
+
+	switch {
+	case s.dev || !ok:
+		w.Header().Set("Cache-Control", "no-cache")
+	case r.URL.Query().Get("v") == hash:
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
+	}
+	if ok {
+		w.Header().Set("ETag", `"`+hash+`"`)
+		if match := r.Header.Get("If-None-Match"); match == `"`+hash+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,59 @@
+package assets
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const testManifest = `{"packages": [{"name": "lib", "version": "1.0.0", "files": [
+	{"path": "lib/lib.js", "url": "https://example.com/lib@1.0.0/lib.js", "integrity": %q}
+]}]}`
+
+func manifestFS(integrity string, files map[string]string) fstest.MapFS {
+	fsys := fstest.MapFS{ManifestPath: {Data: []byte(strings.Replace(testManifest, "%q", `"`+integrity+`"`, 1))}}
+	for name, data := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(data)}
+	}
+	return fsys
+}
+
+func TestVendorVerifiedAtStartup(t *testing.T) {
+	const body = "console.log('lib')"
+	pin := Integrity([]byte(body))
+
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr string
+	}{
+		{"pinned", manifestFS(pin, map[string]string{"vendor/lib/lib.js": body}), ""},
+		{"missing file", manifestFS(pin, nil), "is missing"},
+		{"empty integrity", manifestFS("", map[string]string{"vendor/lib/lib.js": body}), "no integrity"},
+		{"tampered", manifestFS(pin, map[string]string{"vendor/lib/lib.js": body + ";"}), "integrity mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.fsys, "/static", true)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("New() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := s.Vendor("lib/lib.js")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.Src != "/static/vendor/lib/lib.js" || ref.Integrity != pin {
+				t.Errorf("Vendor() = %+v", ref)
+			}
+			if _, err := s.Vendor("other.js"); err == nil {
+				t.Error("Vendor() of an unlisted file should fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Command fetchvendor downloads the frontend files pinned in
+// static/vendor/vendor.json and checks them against the recorded integrity.
+//
+//	go run ./internal/assets/fetchvendor          fetch missing files
+//	go run ./internal/assets/fetchvendor -pin     also pin new files after checking them against jsDelivr
+//
+// A file without a pin is never trusted as downloaded: -pin only records its
+// integrity when the bytes match the hash jsDelivr publishes for that package
+// version, which is a second source independent of the download URL.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"headcontrol/internal/assets"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	dir := flag.String("dir", "static", "Static directory containing vendor/vendor.json")
+	pin := flag.Bool("pin", false, "Pin files that have no integrity yet, after checking them against jsDelivr")
+	force := flag.Bool("force", false, "Download files even if they already exist")
+	flag.Parse()
+
+	m, err := assets.LoadManifest(os.DirFS(*dir))
+	if err != nil {
+		log.Fatalf("manifest: %v", err)
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	changed := false
+	for pi, p := range m.Packages {
+		for fi, f := range p.Files {
+			dest := filepath.Join(*dir, "vendor", filepath.FromSlash(f.Path))
+			if _, err := os.Stat(dest); err == nil && !*force && f.Integrity != "" {
+				continue
+			}
+
+			data, err := download(client, f.URL)
+			if err != nil {
+				log.Fatalf("%s %s: %v", p.Name, p.Version, err)
+			}
+
+			got := assets.Integrity(data)
+			switch {
+			case f.Integrity == "" && *pin:
+				if err := checkPublished(client, p, f, data); err != nil {
+					log.Fatalf("%s %s: %s: %v", p.Name, p.Version, f.Path, err)
+				}
+				m.Packages[pi].Files[fi].Integrity = got
+				changed = true
+			case f.Integrity == "":
+				log.Fatalf("%s %s: %s has no integrity recorded, rerun with -pin to check and pin it", p.Name, p.Version, f.Path)
+			case f.Integrity != got:
+				log.Fatalf("%s %s: %s integrity mismatch: manifest %s, downloaded %s", p.Name, p.Version, f.Path, f.Integrity, got)
+			}
+
+			if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+				log.Fatal(err)
+			}
+			if err := os.WriteFile(dest, data, 0o644); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("vendored %s %s -> %s\n", p.Name, p.Version, dest)
+		}
+	}
+
+	if changed {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(m); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(*dir, filepath.FromSlash(assets.ManifestPath)), buf.Bytes(), 0o644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("updated", assets.ManifestPath)
+	}
+
+	if err := m.Verify(os.DirFS(*dir)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkPublished compares data with the sha256 jsDelivr lists for the file
+// in the npm package p. The file's path inside the package is taken from
+// the part of its URL after "@<version>".
+func checkPublished(client *http.Client, p assets.VendorPackage, f assets.VendorFile, data []byte) error {
+	marker := "@" + p.Version + "/"
+	i := strings.Index(f.URL, marker)
+	if i < 0 {
+		return fmt.Errorf("cannot find %q in %s to look up its published hash", marker, f.URL)
+	}
+	name := "/" + f.URL[i+len(marker):]
+
+	body, err := download(client, "https://data.jsdelivr.com/v1/packages/npm/"+p.Name+"@"+p.Version+"?structure=flat")
+	if err != nil {
+		return err
+	}
+	var listing struct {
+		Files []struct {
+			Name string `json:"name"`
+			Hash string `json:"hash"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(body, &listing); err != nil {
+		return fmt.Errorf("decode jsDelivr listing: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	got := base64.StdEncoding.EncodeToString(sum[:])
+	for _, lf := range listing.Files {
+		if lf.Name != name {
+			continue
+		}
+		if lf.Hash != got {
+			return fmt.Errorf("downloaded sha256 %s does not match published %s", got, lf.Hash)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not in the published file list of %s@%s", name, p.Name, p.Version)
+}
+
+func download(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,71 @@
+package assets
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+const ManifestPath = "vendor/vendor.json"
+
+// Manifest pins the third-party frontend files shipped under static/vendor.
+type Manifest struct {
+	Packages []VendorPackage `json:"packages"`
+}
+
+type VendorPackage struct {
+	Name    string       `json:"name"`
+	Version string       `json:"version"`
+	License string       `json:"license"`
+	Files   []VendorFile `json:"files"`
+}
+
+type VendorFile struct {
+	Path      string `json:"path"`
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+}
+
+func LoadManifest(fsys fs.FS) (*Manifest, error) {
+	data, err := fs.ReadFile(fsys, ManifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", ManifestPath, err)
+	}
+	return &m, nil
+}
+
+// Integrity returns the subresource integrity string (sha384) of data.
+func Integrity(data []byte) string {
+	sum := sha512.Sum384(data)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Verify checks every vendored file in fsys against the integrity recorded
+// in the manifest. Missing files and missing pins are errors.
+func (m *Manifest) Verify(fsys fs.FS) error {
+	for _, p := range m.Packages {
+		for _, f := range p.Files {
+			if f.Integrity == "" {
+				return fmt.Errorf("vendor/%s (%s %s) has no integrity recorded in %s", f.Path, p.Name, p.Version, ManifestPath)
+			}
+			data, err := fs.ReadFile(fsys, "vendor/"+f.Path)
+			if errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("vendor/%s (%s %s) is missing", f.Path, p.Name, p.Version)
+			}
+			if err != nil {
+				return err
+			}
+			if got := Integrity(data); got != f.Integrity {
+				return fmt.Errorf("vendor/%s (%s %s) integrity mismatch: manifest %s, file %s", f.Path, p.Name, p.Version, f.Integrity, got)
+			}
+		}
+	}
+	return nil
+}
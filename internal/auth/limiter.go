@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"headcontrol/internal/model"
+	"headcontrol/internal/store"
+	"strings"
+	"time"
+)
+
+// LockoutPolicy decides when failed logins lock a client IP or an account.
+// Once failures reach the threshold each further failure doubles the
+// lockout, from Base up to Max.
+type LockoutPolicy struct {
+	AccountThreshold int
+	// IPThreshold is higher than AccountThreshold: one address may serve
+	// many people, but password spraying shows up as failures across
+	// accounts from the same place.
+	IPThreshold int
+	Base        time.Duration
+	Max         time.Duration
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	AccountThreshold: 5,
+	IPThreshold:      20,
+	Base:             time.Minute,
+	Max:              time.Hour,
+	Window:           24 * time.Hour,
+}
+
+// Limiter tracks failed logins in the database so lockouts survive
+// restarts.
+type Limiter struct {
+	store  *store.Store
+	Policy LockoutPolicy
+	now    func() time.Time
+}
+
+func NewLimiter(s *store.Store) *Limiter {
+	return &Limiter{store: s, Policy: DefaultLockoutPolicy, now: time.Now}
+}
+
+func IPKey(ip string) string { return "ip:" + ip }
+
+func AccountKey(username string) string { return "account:" + strings.ToLower(username) }
+
+// Attempt charges a login attempt to the IP and the account before the
+// password or code is checked, and returns how long they are still locked
+// out instead when the attempt may not be made. Charging first means
+// concurrent guesses cannot all pass a check made before any of them
+// failed. Call Refund when the attempt turns out right.
+func (l *Limiter) Attempt(ip, username string) (time.Duration, error) {
+	now := l.now()
+	ok, until, err := l.store.ChargeLoginFailure(IPKey(ip), now, l.rule(l.Policy.IPThreshold))
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return lockedFor(now, until), nil
+	}
+	ok, until, err = l.store.ChargeLoginFailure(AccountKey(username), now, l.rule(l.Policy.AccountThreshold))
+	if err == nil && ok {
+		return 0, nil
+	}
+	// The attempt is not made, so the IP gets its charge back.
+	if rerr := l.store.RefundLoginFailure(IPKey(ip)); rerr != nil && err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return lockedFor(now, until), nil
+}
+
+// lockedFor is the rest of a lockout, never zero for an attempt that was
+// refused even if the lockout ended in the meantime.
+func lockedFor(now, until time.Time) time.Duration {
+	return max(until.Sub(now), time.Second)
+}
+
+func (l *Limiter) rule(threshold int) store.LockoutRule {
+	return store.LockoutRule{Threshold: threshold, Base: l.Policy.Base, Max: l.Policy.Max, Window: l.Policy.Window}
+}
+
+// Refund takes back the charge of an attempt that turned out right.
+func (l *Limiter) Refund(ip, username string) error {
+	if err := l.store.RefundLoginFailure(IPKey(ip)); err != nil {
+		return err
+	}
+	return l.store.RefundLoginFailure(AccountKey(username))
+}
+
+// Succeed forgets the account's failures. The IP's are kept, so that one
+// known password does not reset a spraying attempt.
+func (l *Limiter) Succeed(username string) error {
+	return l.store.DeleteLoginFailure(AccountKey(username))
+}
+
+// List returns the failures still remembered, including active lockouts.
+func (l *Limiter) List() ([]model.LoginFailure, error) {
+	return l.store.ListLoginFailures(l.now().Add(-l.Policy.Window))
+}
+
+func (l *Limiter) Clear(key string) error {
+	return l.store.DeleteLoginFailure(key)
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"headcontrol/internal/model"
+	"headcontrol/internal/oidctest"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOIDCVerify(t *testing.T) {
+	iss := oidctest.New(t)
+	o := NewOIDC(OIDCOptions{Issuer: iss.URL, ClientID: oidctest.ClientID, ClientSecret: oidctest.ClientSecret})
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": iss.URL, "aud": oidctest.ClientID, "sub": "u1", "nonce": "n1",
+			"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix(),
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		edit func(c map[string]interface{})
+		want string
+	}{
+		{"valid", func(map[string]interface{}) {}, ""},
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }, "issued by"},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }, "audience"},
+		{"several audiences without azp", func(c map[string]interface{}) { c["aud"] = []string{oidctest.ClientID, "other"} }, "authorized party"},
+		{"several audiences with azp", func(c map[string]interface{}) {
+			c["aud"] = []string{oidctest.ClientID, "other"}
+			c["azp"] = oidctest.ClientID
+		}, ""},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, "expired"},
+		{"no expiry", func(c map[string]interface{}) { delete(c, "exp") }, "expired"},
+		{"replayed nonce", func(c map[string]interface{}) { c["nonce"] = "n0" }, "nonce"},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }, "subject"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := valid()
+			tc.edit(claims)
+			_, err := o.verify(context.Background(), iss.Sign(claims), "n1")
+			if tc.want == "" && err != nil {
+				t.Errorf("verify = %v, want nil", err)
+			}
+			if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+				t.Errorf("verify = %v, want an error about %s", err, tc.want)
+			}
+		})
+	}
+
+	t.Run("forged signature", func(t *testing.T) {
+		token := iss.Sign(valid())
+		parts := strings.Split(token, ".")
+		forged := iss.Sign(map[string]interface{}{"sub": "admin"})
+		parts[1] = strings.Split(forged, ".")[1]
+		if _, err := o.verify(context.Background(), strings.Join(parts, "."), "n1"); err == nil || !strings.Contains(err.Error(), "signature") {
+			t.Errorf("verify = %v, want a signature error", err)
+		}
+	})
+}
+
+func TestOIDCRoles(t *testing.T) {
+	o := NewOIDC(OIDCOptions{Groups: map[string]string{
+		"staff": model.RoleViewer, "ops": model.RoleOperator, "infra-admins": model.RoleAdmin,
+	}})
+	for _, tc := range []struct {
+		groups interface{}
+		def    string
+		want   string
+	}{
+		{[]interface{}{"staff", "ops"}, "", model.RoleOperator},
+		{[]interface{}{"infra-admins", "staff"}, "", model.RoleAdmin},
+		{"ops", "", model.RoleOperator},
+		{[]interface{}{"guests"}, "", ""},
+		{nil, model.RoleViewer, model.RoleViewer},
+		{[]interface{}{"ops"}, model.RoleViewer, model.RoleOperator},
+	} {
+		o.opts.DefaultRole = tc.def
+		id := o.identity(map[string]interface{}{"sub": "u1", "email": "a@example.com", "groups": tc.groups})
+		if id.Role != tc.want || id.Username != "a@example.com" {
+			t.Errorf("groups %v, default %q: role %q username %q, want %q", tc.groups, tc.def, id.Role, id.Username, tc.want)
+		}
+	}
+}
+
+func TestOIDCFlowExpires(t *testing.T) {
+	iss := oidctest.New(t)
+	o := NewOIDC(OIDCOptions{Issuer: iss.URL, ClientID: oidctest.ClientID, Secret: "0123456789abcdef0123456789abcdef"})
+	start := time.Now()
+	o.now = func() time.Time { return start }
+
+	rec := httptest.NewRecorder()
+	if _, err := o.Start(context.Background(), rec, httptest.NewRequest("GET", "/login/oidc", nil), "http://localhost/cb", "/"); err != nil {
+		t.Fatal(err)
+	}
+	callback := httptest.NewRequest("GET", "/login/oidc/callback", nil)
+	for _, c := range rec.Result().Cookies() {
+		callback.AddCookie(c)
+	}
+	if _, err := o.readFlow(callback); err != nil {
+		t.Fatalf("readFlow = %v, want the fresh flow", err)
+	}
+	// A copied cookie outlives its Max-Age; the signed expiry decides.
+	o.now = func() time.Time { return start.Add(oidcFlowTTL + time.Second) }
+	if _, err := o.readFlow(callback); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("readFlow = %v, want expired", err)
+	}
+}
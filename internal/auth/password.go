@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the shortest password accepted for new accounts.
+const MinPasswordLength = 12
+
+func ValidatePassword(pw string) error {
+	if len(pw) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	if len(pw) > 72 {
+		return errors.New("password must be at most 72 bytes")
+	}
+	return nil
+}
+
+func HashPassword(pw string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// dummyHash is compared against when the username does not exist, so that
+// unknown and known usernames take the same time to reject.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("headcontrol-dummy-password"), bcrypt.DefaultCost)
+
+// CheckPassword reports whether pw matches hash. An empty hash is checked
+// against a dummy and always fails.
+func CheckPassword(hash, pw string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pw))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) == nil
+}
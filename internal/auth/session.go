@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"headcontrol/internal/server"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "headcontrol_session"
+	// SessionTTL is how long a login lasts.
+	SessionTTL = 12 * time.Hour
+
+	pendingCookie = "headcontrol_2fa"
+	// PendingTTL is how long a user has to enter their second factor
+	// after the password.
+	PendingTTL = 5 * time.Minute
+)
+
+// Sessions keeps the signed-in account in a cookie signed with HMAC-SHA256.
+// The account is looked up on every request, so deleting it or changing
+// its role takes effect immediately. The cookie also carries the account's
+// session generation; raising it in the store revokes every cookie issued
+// before, which is how signing out ends a session for good.
+type Sessions struct {
+	key  []byte
+	path string
+	now  func() time.Time
+}
+
+func NewSessions(secret, cookiePath string) *Sessions {
+	if cookiePath == "" {
+		cookiePath = "/"
+	}
+	return &Sessions{key: []byte(secret), path: cookiePath, now: time.Now}
+}
+
+func (s *Sessions) Issue(w http.ResponseWriter, r *http.Request, accountID, gen int64) {
+	s.set(w, r, sessionCookie, "session", accountID, gen, SessionTTL)
+}
+
+// Account returns the ID and session generation of the signed-in account,
+// if the cookie is valid and has not expired. The caller checks the
+// generation against the account's.
+func (s *Sessions) Account(r *http.Request) (id, gen int64, ok bool) {
+	return s.get(r, sessionCookie, "session")
+}
+
+func (s *Sessions) Clear(w http.ResponseWriter, r *http.Request) {
+	s.clear(w, r, sessionCookie)
+}
+
+// IssuePending remembers an account whose password was right but which
+// still has to pass two-factor authentication.
+func (s *Sessions) IssuePending(w http.ResponseWriter, r *http.Request, accountID int64) {
+	s.set(w, r, pendingCookie, "2fa", accountID, 0, PendingTTL)
+}
+
+func (s *Sessions) Pending(r *http.Request) (int64, bool) {
+	id, _, ok := s.get(r, pendingCookie, "2fa")
+	return id, ok
+}
+
+func (s *Sessions) ClearPending(w http.ResponseWriter, r *http.Request) {
+	s.clear(w, r, pendingCookie)
+}
+
+// set writes "id.gen.expiry.mac" to the cookie name. label keeps the MACs
+// of different cookies apart so one cannot stand in for another.
+func (s *Sessions) set(w http.ResponseWriter, r *http.Request, name, label string, accountID, gen int64, ttl time.Duration) {
+	expires := s.now().Add(ttl)
+	payload := fmt.Sprintf("%d.%d.%d", accountID, gen, expires.Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + s.sign(label, payload),
+		Path:     s.path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   server.Scheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Sessions) get(r *http.Request, name, label string) (id, gen int64, ok bool) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return 0, 0, false
+	}
+	i := strings.LastIndexByte(c.Value, '.')
+	if i < 0 {
+		return 0, 0, false
+	}
+	payload, mac := c.Value[:i], c.Value[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(s.sign(label, payload))) {
+		return 0, 0, false
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	var nums [3]int64
+	for i, p := range parts {
+		if nums[i], err = strconv.ParseInt(p, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	if s.now().Unix() >= nums[2] {
+		return 0, 0, false
+	}
+	return nums[0], nums[1], true
+}
+
+func (s *Sessions) clear(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     s.path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   server.Scheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Sessions) sign(label, payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(label + ":" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"rsc.io/qr"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew accepts codes one step either side of now, for clock drift
+	// and codes typed as they roll over.
+	totpSkew = 1
+
+	// RecoveryCodeCount is how many recovery codes an enrolment creates.
+	RecoveryCodeCount = 10
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random 160-bit secret in base32, as RFC 4226
+// recommends and authenticator apps expect.
+func NewTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return b32.EncodeToString(b)
+}
+
+// TOTPURI is the otpauth:// URI authenticator apps read from the QR code.
+func TOTPURI(issuer, account, secret string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// CheckTOTP returns the time step code is valid for. Steps up to lastStep
+// are refused, so each code works only once.
+func CheckTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPCode returns the code for secret at t. Tests use it to act as the
+// authenticator app.
+func TOTPCode(secret string, t time.Time) string {
+	key, _ := b32.DecodeString(strings.ToUpper(secret))
+	return totpCode(key, t.Unix()/totpPeriod)
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// NewRecoveryCodes returns RecoveryCodeCount single-use codes to show the
+// user once, and their bcrypt hashes to store.
+func NewRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		rand.Read(b)
+		c := strings.ToLower(b32.EncodeToString(b))[:10]
+		h, err := bcrypt.GenerateFromPassword([]byte(c), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, c[:5]+"-"+c[5:])
+		hashes = append(hashes, string(h))
+	}
+	return codes, hashes, nil
+}
+
+// IsRecoveryCode tells recovery codes apart from TOTP codes typed into the
+// same field.
+func IsRecoveryCode(code string) bool {
+	return len(NormalizeRecoveryCode(code)) == 10
+}
+
+func NormalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
+
+// CheckRecoveryCode reports whether code matches hash.
+func CheckRecoveryCode(hash, code string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(NormalizeRecoveryCode(code))) == nil
+}
+
+// QRCodeSVG draws text as a QR code in SVG, one path for the dark modules.
+// The caller styles it; the quiet zone is part of the viewBox.
+func QRCodeSVG(text string) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	const quiet = 4
+	var d strings.Builder
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&d, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	size := code.Size + 2*quiet
+	return fmt.Sprintf(`<svg class="qr-code" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges" role="img" aria-label="QR code"><rect class="qr-code-bg" width="%d" height="%d"/><path class="qr-code-fg" d="%s"/></svg>`,
+		size, size, size, size, d.String()), nil
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from RFC 6238 appendix B, in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC lists eight digits; authenticator apps show the last six.
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if got := TOTPCode(rfcSecret, time.Unix(unix, 0)); got != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step := now.Unix() / totpPeriod
+
+	for name, tc := range map[string]struct {
+		code     string
+		lastStep int64
+		want     int64
+	}{
+		"current":         {TOTPCode(rfcSecret, now), 0, step},
+		"previous step":   {TOTPCode(rfcSecret, now.Add(-totpPeriod*time.Second)), 0, step - 1},
+		"next step":       {TOTPCode(rfcSecret, now.Add(totpPeriod*time.Second)), 0, step + 1},
+		"too old":         {TOTPCode(rfcSecret, now.Add(-2*totpPeriod*time.Second)), 0, 0},
+		"already used":    {TOTPCode(rfcSecret, now), step, 0},
+		"later step used": {TOTPCode(rfcSecret, now), step + 1, 0},
+		"wrong":           {"000000", 0, 0},
+		"too short":       {"12345", 0, 0},
+	} {
+		got, ok := CheckTOTP(rfcSecret, tc.code, now, tc.lastStep)
+		if ok != (tc.want != 0) || got != tc.want {
+			t.Errorf("%s: CheckTOTP = %d, %v, want step %d", name, got, ok, tc.want)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount || len(hashes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), RecoveryCodeCount)
+	}
+	if !IsRecoveryCode(codes[0]) || IsRecoveryCode("123456") {
+		t.Error("IsRecoveryCode cannot tell recovery codes from TOTP codes")
+	}
+	if !CheckRecoveryCode(hashes[0], " "+strings.ToUpper(codes[0])+" ") {
+		t.Error("recovery code typed in capitals with spaces was refused")
+	}
+	if CheckRecoveryCode(hashes[0], codes[1]) {
+		t.Error("recovery code matched another code's hash")
+	}
+}
@@ -0,0 +1,95 @@
+// Package avatar picks the profile pictures HeadControl gives Headscale
+// users and checks the ones operators upload.
+package avatar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Strategies.
+const (
+	None     = "none"
+	Gravatar = "gravatar"
+	Robohash = "robohash"
+	// Upload has operators upload pictures, which HeadControl stores and
+	// serves itself.
+	Upload = "upload"
+)
+
+// MaxUpload is the largest picture that can be uploaded, in bytes.
+const MaxUpload = 512 << 10
+
+const (
+	gravatarOrigin = "https://www.gravatar.com"
+	robohashOrigin = "https://robohash.org"
+)
+
+func Valid(strategy string) bool {
+	switch strategy {
+	case None, Gravatar, Robohash, Upload:
+		return true
+	}
+	return false
+}
+
+// URL returns the picture a user gets under strategy, or "" when it has
+// none to offer: always for None and Upload, and for Gravatar without an
+// email address.
+func URL(strategy, name, email string) string {
+	switch strategy {
+	case Robohash:
+		return robohashOrigin + "/" + url.PathEscape(name)
+	case Gravatar:
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(email))
+		return gravatarOrigin + "/avatar/" + hex.EncodeToString(sum[:]) + "?d=identicon"
+	}
+	return ""
+}
+
+// Sources returns the origins pictures are loaded from under strategy,
+// for the img-src of the Content-Security-Policy.
+func Sources(strategy string) []string {
+	switch strategy {
+	case Robohash:
+		return []string{robohashOrigin}
+	case Gravatar:
+		return []string{gravatarOrigin}
+	}
+	return nil
+}
+
+// Allowed reports whether the page may load the picture at rawURL under
+// strategy. Pictures from other hosts would be refused by the browser.
+func Allowed(strategy, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	origin := u.Scheme + "://" + u.Host
+	for _, s := range Sources(strategy) {
+		if origin == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentType sniffs an uploaded picture and reports whether it is one of
+// the raster formats browsers show in an img tag. SVG is refused because
+// it can carry scripts.
+func ContentType(data []byte) (string, bool) {
+	ct := http.DetectContentType(data)
+	switch ct {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return ct, true
+	}
+	return ct, false
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"headcontrol/internal/auth"
+	"headcontrol/internal/model"
+	"headcontrol/internal/store"
+	"os"
+	"strings"
+	"time"
+)
+
+func accountsList(e *env, _ *flag.FlagSet, _ []string) error {
+	accounts, err := e.store.ListAccounts()
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(accounts))
+	for _, a := range accounts {
+		login := "password"
+		if a.Subject != "" {
+			login = "sso"
+		}
+		twoFactor := "off"
+		if a.TOTPEnabled {
+			twoFactor = "on"
+		}
+		rows = append(rows, []string{fmt.Sprint(a.ID), a.Username, a.Role, login, twoFactor, a.CreatedAt})
+	}
+	return e.out.table(accounts, []string{"ID", "USERNAME", "ROLE", "LOGIN", "2FA", "CREATED"}, rows)
+}
+
+func accountsAddFlags(fs *flag.FlagSet) {
+	fs.String("role", model.RoleViewer, "Role: viewer, operator or admin")
+}
+
+// accountsAdd reads the password from the first line of stdin so it stays
+// out of the shell history.
+func accountsAdd(e *env, fs *flag.FlagSet, args []string) error {
+	role := fs.Lookup("role").Value.String()
+	if !model.ValidRole(role) {
+		return fmt.Errorf("unknown role %q, use viewer, operator or admin", role)
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return errors.New("no password on stdin")
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if err := auth.ValidatePassword(password); err != nil {
+		return err
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	account, err := e.store.CreateAccount(args[0], hash, role)
+	if store.IsDuplicate(err) {
+		return fmt.Errorf("account %q already exists", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	return e.out.message(account, fmt.Sprintf("Account '%s' created with role %s.", account.Username, account.Role))
+}
+
+// accountsReset2FA turns off two-factor authentication for someone who
+// lost both their device and their recovery codes.
+func accountsReset2FA(e *env, _ *flag.FlagSet, args []string) error {
+	account, err := e.store.GetAccount(args[0])
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return fmt.Errorf("no account %q", args[0])
+	}
+	if err := e.store.DisableTOTP(account.ID); err != nil {
+		return err
+	}
+	return e.out.message(map[string]string{"username": account.Username, "status": "reset"},
+		fmt.Sprintf("Two-factor authentication for '%s' turned off. They can set it up again from their account page.", account.Username))
+}
+
+func lockoutsList(e *env, _ *flag.FlagSet, _ []string) error {
+	failures, err := auth.NewLimiter(e.store).List()
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(failures))
+	for _, f := range failures {
+		locked := "-"
+		if f.LockedUntil.After(time.Now()) {
+			locked = f.LockedUntil.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{f.Key, fmt.Sprint(f.Failures), f.LastFailure.Format(time.RFC3339), locked})
+	}
+	return e.out.table(failures, []string{"KEY", "FAILURES", "LAST FAILURE", "LOCKED UNTIL"}, rows)
+}
+
+func lockoutsClear(e *env, _ *flag.FlagSet, args []string) error {
+	if err := auth.NewLimiter(e.store).Clear(args[0]); err != nil {
+		return err
+	}
+	return e.out.message(map[string]string{"key": args[0], "status": "cleared"}, "Failed logins for "+args[0]+" cleared.")
+}
@@ -0,0 +1,251 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"headcontrol/internal/config"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/model"
+	"headcontrol/internal/store"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+type command struct {
+	desc  string
+	args  string
+	nargs int
+	flags func(fs *flag.FlagSet)
+	run   func(e *env, fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]map[string]command{
+	"accounts": {
+		"list":      {desc: "list dashboard accounts", run: accountsList},
+		"add":       {desc: "add a dashboard account, password on stdin", args: "<username>", nargs: 1, flags: accountsAddFlags, run: accountsAdd},
+		"reset-2fa": {desc: "turn off two-factor authentication for an account", args: "<username>", nargs: 1, run: accountsReset2FA},
+	},
+	"lockouts": {
+		"list":  {desc: "list failed logins and lockouts", run: lockoutsList},
+		"clear": {desc: "clear the failed logins for an ip: or account: key", args: "<key>", nargs: 1, run: lockoutsClear},
+	},
+	"users": {
+		"list":   {desc: "list users", run: usersList},
+		"create": {desc: "create a user", args: "<name>", nargs: 1, flags: usersCreateFlags, run: usersCreate},
+		"delete": {desc: "delete a user", args: "<id>", nargs: 1, run: usersDelete},
+	},
+	"nodes": {
+		"list":   {desc: "list nodes", flags: nodesListFlags, run: nodesList},
+		"expire": {desc: "expire a node", args: "<id>", nargs: 1, run: nodesExpire},
+		"move":   {desc: "give a node to another user", args: "<id> <user>", nargs: 2, run: nodesMove},
+		"tag":    {desc: "replace the tags of a node", args: "<id> <tag,tag,...>", nargs: 2, run: nodesTag},
+	},
+	"deletions": {
+		"list": {desc: "list recent deletions from the dashboard", flags: deletionsListFlags, run: deletionsList},
+		"show": {desc: "print what a deleted user or node looked like", args: "<id>", nargs: 1, run: deletionsShow},
+	},
+	"settings": {
+		"show": {desc: "show the configured connection", run: settingsShow},
+		"set":  {desc: "update the configured connection", flags: settingsSetFlags, run: settingsSet},
+	},
+}
+
+type env struct {
+	ctx   context.Context
+	store *store.Store
+	out   *printer
+	// avatar is the strategy that picks the pictures of new users.
+	avatar string
+
+	closers []func()
+}
+
+func (e *env) client() (headscale.API, error) {
+	cfg, err := e.store.GetSettings()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, errors.New("no Headscale connection configured, run the setup page or 'headcontrol settings set' first")
+	}
+	return e.open(cfg)
+}
+
+func (e *env) open(cfg *model.Settings) (headscale.API, error) {
+	client, closeFn, err := headscale.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	e.closers = append(e.closers, closeFn)
+	return client, nil
+}
+
+func (e *env) close() {
+	for _, fn := range e.closers {
+		fn()
+	}
+}
+
+// IsCommand reports whether name is a CLI command group handled by Run.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok || name == "help"
+}
+
+func Run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" {
+		printUsage(stdout)
+		return 0
+	}
+
+	group, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return 2
+	}
+	if len(args) < 2 {
+		fmt.Fprintf(stderr, "%s: missing subcommand\n\n", args[0])
+		printUsage(stderr)
+		return 2
+	}
+	cmd, ok := group[args[1]]
+	if !ok {
+		fmt.Fprintf(stderr, "%s: unknown subcommand %q\n\n", args[0], args[1])
+		printUsage(stderr)
+		return 2
+	}
+
+	name := args[0] + " " + args[1]
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "", "Path to a TOML config file (default $HEADCONTROL_CONFIG)")
+	dbPath := fs.String("db", "", "SQLite database path (default from config, or headcontrol.db)")
+	format := fs.String("o", "table", "Output format: table or json")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: headcontrol %s [flags] %s\n\nFlags:\n", name, cmd.args)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(reorder(fs, args[2:])); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != cmd.nargs {
+		fmt.Fprintf(stderr, "%s: expected %s\n\n", name, plural(cmd.nargs, "argument"))
+		fs.Usage()
+		return 2
+	}
+
+	out, err := newPrinter(stdout, *format)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return 2
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "config: %v\n", err)
+		return 1
+	}
+	if *dbPath != "" {
+		cfg.DB = *dbPath
+	}
+
+	s, err := store.New(cfg.DB)
+	if err != nil {
+		fmt.Fprintf(stderr, "database: %v\n", err)
+		return 1
+	}
+	defer s.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	e := &env{ctx: ctx, store: s, out: out, avatar: cfg.Avatar.Strategy}
+	defer e.close()
+
+	if err := cmd.run(e, fs, fs.Args()); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: headcontrol <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintf(w, "  %-34s %s\n", "serve", "start the web dashboard (default)")
+
+	groups := make([]string, 0, len(commands))
+	for g := range commands {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		subs := make([]string, 0, len(commands[g]))
+		for s := range commands[g] {
+			subs = append(subs, s)
+		}
+		sort.Strings(subs)
+		for _, s := range subs {
+			fmt.Fprintf(w, "  %-34s %s\n", strings.TrimSpace(g+" "+s+" "+commands[g][s].args), commands[g][s].desc)
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command accepts -config or -db to select the SQLite database")
+	fmt.Fprintln(w, "and -o table|json to select the output format. Run")
+	fmt.Fprintln(w, "'headcontrol <command> <subcommand> -h' for command flags.")
+}
+
+// reorder moves flags ahead of positional arguments so that
+// "nodes expire 3 -o json" parses the same as "nodes expire -o json 3".
+func reorder(fs *flag.FlagSet, args []string) []string {
+	var flags, rest []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			rest = append(rest, args[i+1:]...)
+			break
+		}
+		if len(a) < 2 || a[0] != '-' {
+			rest = append(rest, a)
+			continue
+		}
+		flags = append(flags, a)
+		name := strings.TrimLeft(a, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := fs.Lookup(name); f != nil {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				continue
+			}
+		}
+		if i+1 < len(args) {
+			flags = append(flags, args[i+1])
+			i++
+		}
+	}
+	return append(flags, rest...)
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
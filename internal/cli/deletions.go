@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+func deletionsListFlags(fs *flag.FlagSet) {
+	fs.Int("limit", 50, "Show at most this many deletions, newest first")
+}
+
+func deletionsList(e *env, fs *flag.FlagSet, _ []string) error {
+	limit, _ := strconv.Atoi(fs.Lookup("limit").Value.String())
+	actions, err := e.store.RecentActions(limit)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(actions))
+	for _, a := range actions {
+		when := a.ExecuteAt.Format(time.RFC3339)
+		if !a.FinishedAt.IsZero() {
+			when = a.FinishedAt.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{fmt.Sprint(a.ID), a.Kind, a.TargetName, a.Status, a.RequestedBy, when, orDash(a.Error)})
+	}
+	return e.out.table(actions, []string{"ID", "KIND", "TARGET", "STATUS", "BY", "WHEN", "ERROR"}, rows)
+}
+
+// deletionsShow prints the snapshot taken when a deletion was requested,
+// which has what is needed to recreate the user or node by hand.
+func deletionsShow(e *env, _ *flag.FlagSet, args []string) error {
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid deletion id %q", args[0])
+	}
+	a, err := e.store.GetPendingAction(id)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return fmt.Errorf("no deletion %d", id)
+	}
+	if e.out.json {
+		return e.out.encode(a)
+	}
+	return e.out.encode(a.Snapshot)
+}
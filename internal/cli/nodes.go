@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"headcontrol/internal/model"
+	"slices"
+	"strings"
+)
+
+func nodesListFlags(fs *flag.FlagSet) {
+	fs.String("user", "", "Only list nodes owned by this user name")
+}
+
+func nodesList(e *env, fs *flag.FlagSet, _ []string) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	nodes, err := client.ListNodes(e.ctx)
+	if err != nil {
+		return err
+	}
+
+	if user := fs.Lookup("user").Value.String(); user != "" {
+		filtered := make([]model.Node, 0, len(nodes))
+		for _, n := range nodes {
+			if n.User != nil && n.User.Name == user {
+				filtered = append(filtered, n)
+			}
+		}
+		nodes = filtered
+	}
+
+	rows := make([][]string, 0, len(nodes))
+	for _, n := range nodes {
+		owner := "-"
+		if n.User != nil {
+			owner = n.User.Name
+		}
+		status := "offline"
+		if n.Online {
+			status = "online"
+		}
+		rows = append(rows, []string{
+			n.ID, n.GivenName, owner,
+			orDash(strings.Join(n.IPAddresses, ",")),
+			status, orDash(n.LastSeen), orDash(n.Expiry),
+			orDash(strings.Join(n.Tags, ",")),
+		})
+	}
+	return e.out.table(nodes, []string{"ID", "NAME", "USER", "IP ADDRESSES", "STATUS", "LAST SEEN", "EXPIRY", "TAGS"}, rows)
+}
+
+func nodesExpire(e *env, _ *flag.FlagSet, args []string) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	node, err := client.ExpireNode(e.ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return e.out.message(node, fmt.Sprintf("Node '%s' expired.", node.GivenName))
+}
+
+func nodesMove(e *env, _ *flag.FlagSet, args []string) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	users, err := client.ListUsers(e.ctx)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(users, func(u model.User) bool { return u.Name == args[1] })
+	if i < 0 {
+		return fmt.Errorf("no user named %q", args[1])
+	}
+	node, err := client.MoveNode(e.ctx, args[0], users[i].ID)
+	if err != nil {
+		return err
+	}
+	return e.out.message(node, fmt.Sprintf("Node '%s' moved to '%s'.", node.GivenName, users[i].Name))
+}
+
+func nodesTag(e *env, _ *flag.FlagSet, args []string) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+
+	var tags []string
+	for _, t := range strings.Split(args[1], ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+
+	node, err := client.SetNodeTags(e.ctx, args[0], tags)
+	if err != nil {
+		return err
+	}
+	return e.out.message(node, fmt.Sprintf("Node '%s' tags set to [%s].", node.GivenName, strings.Join(node.Tags, ", ")))
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case "table", "":
+		return &printer{w: w}, nil
+	case "json":
+		return &printer{w: w, json: true}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q, use table or json", format)
+}
+
+// table prints rows under header, or v as indented JSON when -o json is set.
+func (p *printer) table(v interface{}, header []string, rows [][]string) error {
+	if p.json {
+		return p.encode(v)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// message prints msg, or v as indented JSON when -o json is set.
+func (p *printer) message(v interface{}, msg string) error {
+	if p.json {
+		return p.encode(v)
+	}
+	_, err := fmt.Fprintln(p.w, msg)
+	return err
+}
+
+func (p *printer) encode(v interface{}) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
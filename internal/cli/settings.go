@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/model"
+)
+
+func settingsShow(e *env, _ *flag.FlagSet, _ []string) error {
+	cfg, err := e.store.GetSettings()
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return errors.New("no Headscale connection configured")
+	}
+
+	masked := model.Settings{
+		ID:          cfg.ID,
+		BaseURL:     cfg.BaseURL,
+		CreatedAt:   cfg.CreatedAt,
+		UpdatedAt:   cfg.UpdatedAt,
+		Transport:   cfg.Transport,
+		GRPCAddress: cfg.GRPCAddress,
+		GRPCTLS:     cfg.GRPCTLS,
+	}
+	transport := masked.Transport
+	if transport == headscale.TransportGRPC {
+		transport += " " + headscale.GRPCAddress(cfg) + " (tls: " + masked.GRPCTLS + ")"
+	}
+	return e.out.table(masked, []string{"BASE URL", "TRANSPORT", "UPDATED"},
+		[][]string{{masked.BaseURL, transport, masked.UpdatedAt}})
+}
+
+func settingsSetFlags(fs *flag.FlagSet) {
+	fs.String("url", "", "Headscale base URL")
+	fs.String("key", "", "Headscale API key (keeps the current key when empty)")
+	fs.String("transport", "", "rest or grpc (keeps the current transport when empty)")
+	fs.String("grpc-addr", "", "gRPC host:port, defaults to the base URL host on port "+headscale.DefaultGRPCPort)
+	fs.String("grpc-tls", "", "gRPC TLS mode: verify, skip-verify or insecure")
+	fs.Bool("skip-test", false, "Save without testing the connection first")
+}
+
+func settingsSet(e *env, fs *flag.FlagSet, _ []string) error {
+	baseURL := fs.Lookup("url").Value.String()
+	apiKey := fs.Lookup("key").Value.String()
+
+	if baseURL == "" {
+		return errors.New("-url is required")
+	}
+
+	cfg := model.Settings{
+		BaseURL:      baseURL,
+		APIKey:       apiKey,
+		ReadTimeout:  int(headscale.DefaultTimeouts.Read.Seconds()),
+		WriteTimeout: int(headscale.DefaultTimeouts.Write.Seconds()),
+		Transport:    headscale.TransportREST,
+		GRPCTLS:      headscale.GRPCTLSVerify,
+	}
+	if existing, _ := e.store.GetSettings(); existing != nil {
+		if cfg.APIKey == "" {
+			cfg.APIKey = existing.APIKey
+		}
+		cfg.ReadTimeout, cfg.WriteTimeout = existing.ReadTimeout, existing.WriteTimeout
+		cfg.Transport, cfg.GRPCAddress, cfg.GRPCTLS = existing.Transport, existing.GRPCAddress, existing.GRPCTLS
+	}
+	if cfg.APIKey == "" {
+		return errors.New("-key is required")
+	}
+	if v := fs.Lookup("transport").Value.String(); v != "" {
+		cfg.Transport = v
+	}
+	if v := fs.Lookup("grpc-addr").Value.String(); v != "" {
+		cfg.GRPCAddress = v
+	}
+	if v := fs.Lookup("grpc-tls").Value.String(); v != "" {
+		cfg.GRPCTLS = v
+	}
+	if err := headscale.ValidateTransport(&cfg); err != nil {
+		return err
+	}
+
+	if fs.Lookup("skip-test").Value.String() != "true" {
+		client, err := e.open(&cfg)
+		if err != nil {
+			return err
+		}
+		if err := client.TestConnection(e.ctx); err != nil {
+			return errors.New("connection test failed: " + err.Error())
+		}
+	}
+
+	if err := e.store.SaveConnection(&cfg); err != nil {
+		return err
+	}
+	return e.out.message(map[string]string{"base_url": baseURL, "status": "saved"}, "Settings saved.")
+}
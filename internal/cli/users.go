@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"headcontrol/internal/avatar"
+	"headcontrol/internal/model"
+)
+
+func usersList(e *env, _ *flag.FlagSet, _ []string) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	users, err := client.ListUsers(e.ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(users))
+	for _, u := range users {
+		rows = append(rows, []string{u.ID, u.Name, orDash(u.DisplayName), orDash(u.Email), u.CreatedAt})
+	}
+	return e.out.table(users, []string{"ID", "NAME", "DISPLAY NAME", "EMAIL", "CREATED"}, rows)
+}
+
+func usersCreateFlags(fs *flag.FlagSet) {
+	fs.String("display-name", "", "Display name")
+	fs.String("email", "", "Email address")
+}
+
+func usersCreate(e *env, fs *flag.FlagSet, args []string) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+
+	name := args[0]
+	email := fs.Lookup("email").Value.String()
+	if email != "" && !model.ValidEmail(email) {
+		return fmt.Errorf("%q is not an email address", email)
+	}
+	user, err := client.CreateUser(e.ctx, name, fs.Lookup("display-name").Value.String(), email, avatar.URL(e.avatar, name, email))
+	if err != nil {
+		return err
+	}
+	return e.out.message(user, fmt.Sprintf("User '%s' created with ID %s.", user.Name, user.ID))
+}
+
+func usersDelete(e *env, _ *flag.FlagSet, args []string) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	if err := client.DeleteUser(e.ctx, args[0]); err != nil {
+		return err
+	}
+	return e.out.message(map[string]string{"id": args[0], "status": "deleted"}, "User "+args[0]+" deleted.")
+}
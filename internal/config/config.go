@@ -0,0 +1,350 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"headcontrol/internal/avatar"
+	"headcontrol/internal/model"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is resolved in this order, later sources overriding earlier ones:
+// built-in defaults, the TOML config file, HEADCONTROL_* environment
+// variables, then command-line flags.
+type Config struct {
+	Listen        string `toml:"listen"`
+	DB            string `toml:"db"`
+	BasePath      string `toml:"base_path"`
+	SessionSecret string `toml:"session_secret"`
+	// TrustedProxies lists addresses or CIDR ranges whose X-Forwarded-*
+	// headers are honoured.
+	TrustedProxies []string  `toml:"trusted_proxies"`
+	TLS            TLS       `toml:"tls"`
+	Poll           Poll      `toml:"poll"`
+	Cache          Cache     `toml:"cache"`
+	Headscale      Bootstrap `toml:"headscale"`
+	OIDC           OIDC      `toml:"oidc"`
+	Avatar         Avatar    `toml:"avatar"`
+
+	// UndoWindow is how long user and node deletions wait, and can be
+	// undone, before they are sent to Headscale.
+	UndoWindow Duration `toml:"undo_window"`
+}
+
+type TLS struct {
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+	// Redirect is an optional plain HTTP listen address that redirects
+	// every request to HTTPS.
+	Redirect   string   `toml:"redirect"`
+	HSTSMaxAge Duration `toml:"hsts_max_age"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.Cert != "" && t.Key != ""
+}
+
+// Poll controls how often pages refresh themselves. Zero disables polling.
+type Poll struct {
+	Dashboard Duration `toml:"dashboard"`
+	Nodes     Duration `toml:"nodes"`
+}
+
+// Cache controls how long Headscale list responses are reused between
+// requests. Zero disables caching.
+type Cache struct {
+	TTL Duration `toml:"ttl"`
+}
+
+// Bootstrap seeds the settings table on first start so the setup page can
+// be skipped. It is ignored once a connection has been saved.
+type Bootstrap struct {
+	URL    string `toml:"url"`
+	APIKey string `toml:"api_key"`
+}
+
+// Avatar picks the profile pictures of Headscale users: none, gravatar
+// (from the email address), robohash (from the username) or upload
+// (pictures operators upload, served by HeadControl).
+type Avatar struct {
+	Strategy string `toml:"strategy"`
+}
+
+// OIDC signs dashboard users in through an OpenID Connect provider. It is
+// enabled when Issuer is set.
+type OIDC struct {
+	Issuer       string `toml:"issuer"`
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	// RedirectURL defaults to the callback under the URL the browser used.
+	RedirectURL string   `toml:"redirect_url"`
+	Scopes      []string `toml:"scopes"`
+	// Name labels the sign-in button.
+	Name          string `toml:"name"`
+	UsernameClaim string `toml:"username_claim"`
+	GroupsClaim   string `toml:"groups_claim"`
+	// Members of these groups get the matching role; the highest wins.
+	AdminGroups    []string `toml:"admin_groups"`
+	OperatorGroups []string `toml:"operator_groups"`
+	ViewerGroups   []string `toml:"viewer_groups"`
+	// DefaultRole is given to users in none of the groups. Empty refuses
+	// them.
+	DefaultRole          string `toml:"default_role"`
+	DisablePasswordLogin bool   `toml:"disable_password_login"`
+}
+
+func (o OIDC) Enabled() bool {
+	return o.Issuer != ""
+}
+
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+func Default() Config {
+	return Config{
+		Listen: ":8080",
+		DB:     "headcontrol.db",
+		TLS: TLS{
+			HSTSMaxAge: Duration{365 * 24 * time.Hour},
+		},
+		Cache: Cache{
+			TTL: Duration{5 * time.Second},
+		},
+		UndoWindow: Duration{10 * time.Second},
+		Avatar:     Avatar{Strategy: avatar.Robohash},
+		OIDC: OIDC{
+			Scopes:        []string{"openid", "profile", "email", "groups"},
+			Name:          "SSO",
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+		},
+	}
+}
+
+// Load returns the defaults overlaid with the config file at path (if any)
+// and the environment. Flags are applied by the caller before Validate.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		path = os.Getenv("HEADCONTROL_CONFIG")
+	}
+	if path != "" {
+		md, err := toml.DecodeFile(path, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("config %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, k := range undecoded {
+				keys[i] = k.String()
+			}
+			return cfg, fmt.Errorf("config %s: unknown keys: %s", path, strings.Join(keys, ", "))
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"HEADCONTROL_LISTEN":             &c.Listen,
+		"HEADCONTROL_DB":                 &c.DB,
+		"HEADCONTROL_BASE_PATH":          &c.BasePath,
+		"HEADCONTROL_SESSION_SECRET":     &c.SessionSecret,
+		"HEADCONTROL_TLS_CERT":           &c.TLS.Cert,
+		"HEADCONTROL_TLS_KEY":            &c.TLS.Key,
+		"HEADCONTROL_TLS_REDIRECT":       &c.TLS.Redirect,
+		"HEADCONTROL_HEADSCALE_URL":      &c.Headscale.URL,
+		"HEADCONTROL_HEADSCALE_API_KEY":  &c.Headscale.APIKey,
+		"HEADCONTROL_OIDC_ISSUER":        &c.OIDC.Issuer,
+		"HEADCONTROL_OIDC_CLIENT_ID":     &c.OIDC.ClientID,
+		"HEADCONTROL_OIDC_CLIENT_SECRET": &c.OIDC.ClientSecret,
+		"HEADCONTROL_OIDC_REDIRECT_URL":  &c.OIDC.RedirectURL,
+		"HEADCONTROL_OIDC_DEFAULT_ROLE":  &c.OIDC.DefaultRole,
+		"HEADCONTROL_AVATAR_STRATEGY":    &c.Avatar.Strategy,
+	}
+	for name, dst := range strs {
+		if v, ok := lookup(name); ok {
+			*dst = v
+		}
+	}
+
+	lists := map[string]*[]string{
+		"HEADCONTROL_TRUSTED_PROXIES":      &c.TrustedProxies,
+		"HEADCONTROL_OIDC_ADMIN_GROUPS":    &c.OIDC.AdminGroups,
+		"HEADCONTROL_OIDC_OPERATOR_GROUPS": &c.OIDC.OperatorGroups,
+		"HEADCONTROL_OIDC_VIEWER_GROUPS":   &c.OIDC.ViewerGroups,
+	}
+	for name, dst := range lists {
+		if v, ok := lookup(name); ok {
+			*dst = nil
+			for _, p := range strings.Split(v, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					*dst = append(*dst, p)
+				}
+			}
+		}
+	}
+
+	durations := map[string]*Duration{
+		"HEADCONTROL_POLL_DASHBOARD":   &c.Poll.Dashboard,
+		"HEADCONTROL_POLL_NODES":       &c.Poll.Nodes,
+		"HEADCONTROL_TLS_HSTS_MAX_AGE": &c.TLS.HSTSMaxAge,
+		"HEADCONTROL_CACHE_TTL":        &c.Cache.TTL,
+		"HEADCONTROL_UNDO_WINDOW":      &c.UndoWindow,
+	}
+	for name, dst := range durations {
+		if v, ok := lookup(name); ok {
+			if err := dst.UnmarshalText([]byte(v)); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate reports every problem with the configuration at once.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %q is not a host:port address", c.Listen))
+	}
+	if c.DB == "" {
+		errs = append(errs, errors.New("db: must not be empty"))
+	}
+
+	if c.BasePath != "" {
+		if !strings.HasPrefix(c.BasePath, "/") {
+			errs = append(errs, fmt.Errorf("base_path: %q must start with /", c.BasePath))
+		}
+		if strings.ContainsFunc(c.BasePath, func(r rune) bool {
+			return !(r == '/' || r == '-' || r == '_' || r == '.' || r == '~' ||
+				(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+		}) {
+			errs = append(errs, fmt.Errorf("base_path: %q may only contain letters, digits and - _ . ~ /", c.BasePath))
+		}
+		c.BasePath = strings.TrimRight(c.BasePath, "/")
+	}
+
+	for _, p := range c.TrustedProxies {
+		if _, err := netip.ParsePrefix(p); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(p); err != nil {
+			errs = append(errs, fmt.Errorf("trusted_proxies: %q is not an IP address or CIDR range", p))
+		}
+	}
+
+	if c.SessionSecret != "" && len(c.SessionSecret) < 32 {
+		errs = append(errs, errors.New("session_secret: must be at least 32 characters"))
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, errors.New("tls: cert and key must be set together"))
+	}
+	for _, f := range []struct{ name, path string }{{"tls.cert", c.TLS.Cert}, {"tls.key", c.TLS.Key}} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+		}
+	}
+
+	if c.TLS.Redirect != "" {
+		if !c.TLS.Enabled() {
+			errs = append(errs, errors.New("tls.redirect: requires tls.cert and tls.key"))
+		}
+		if _, _, err := net.SplitHostPort(c.TLS.Redirect); err != nil {
+			errs = append(errs, fmt.Errorf("tls.redirect: %q is not a host:port address", c.TLS.Redirect))
+		}
+	}
+	if c.TLS.HSTSMaxAge.Duration < 0 {
+		errs = append(errs, errors.New("tls.hsts_max_age: must not be negative"))
+	}
+	if c.Cache.TTL.Duration < 0 {
+		errs = append(errs, errors.New("cache.ttl: must not be negative"))
+	}
+	if c.UndoWindow.Duration < 0 {
+		errs = append(errs, errors.New("undo_window: must not be negative"))
+	}
+	if !avatar.Valid(c.Avatar.Strategy) {
+		errs = append(errs, fmt.Errorf("avatar.strategy: %q is not none, gravatar, robohash or upload", c.Avatar.Strategy))
+	}
+
+	for _, p := range []struct {
+		name string
+		d    Duration
+	}{{"poll.dashboard", c.Poll.Dashboard}, {"poll.nodes", c.Poll.Nodes}} {
+		if p.d.Duration < 0 || (p.d.Duration != 0 && p.d.Duration < time.Second) {
+			errs = append(errs, fmt.Errorf("%s: %s is shorter than 1s, use 0 to disable", p.name, p.d))
+		}
+	}
+
+	if (c.Headscale.URL == "") != (c.Headscale.APIKey == "") {
+		errs = append(errs, errors.New("headscale: url and api_key must be set together"))
+	}
+	if c.Headscale.URL != "" {
+		if u, err := url.Parse(c.Headscale.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("headscale.url: %q is not an http(s) URL", c.Headscale.URL))
+		}
+	}
+
+	if c.OIDC.Enabled() {
+		if u, err := url.Parse(c.OIDC.Issuer); err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname()))) {
+			errs = append(errs, fmt.Errorf("oidc.issuer: %q must be an https URL", c.OIDC.Issuer))
+		}
+		if c.OIDC.ClientID == "" {
+			errs = append(errs, errors.New("oidc.client_id: required with oidc.issuer"))
+		}
+		if c.OIDC.RedirectURL != "" {
+			if u, err := url.Parse(c.OIDC.RedirectURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("oidc.redirect_url: %q is not an http(s) URL", c.OIDC.RedirectURL))
+			}
+		}
+		if c.OIDC.DefaultRole != "" && !model.ValidRole(c.OIDC.DefaultRole) {
+			errs = append(errs, fmt.Errorf("oidc.default_role: %q is not viewer, operator or admin", c.OIDC.DefaultRole))
+		}
+		if len(c.OIDC.AdminGroups)+len(c.OIDC.OperatorGroups)+len(c.OIDC.ViewerGroups) == 0 && c.OIDC.DefaultRole == "" {
+			errs = append(errs, errors.New("oidc: set admin_groups, operator_groups, viewer_groups or default_role, or nobody can sign in"))
+		}
+	} else if c.OIDC.DisablePasswordLogin {
+		errs = append(errs, errors.New("oidc.disable_password_login: requires oidc.issuer"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
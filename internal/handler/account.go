@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"headcontrol/internal/auth"
+	"headcontrol/internal/model"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AccountPage shows the signed-in account and its two-factor settings.
+func (h *Handler) AccountPage(w http.ResponseWriter, r *http.Request) {
+	data := h.totpData(currentAccount(r))
+	data["Title"] = "Account"
+	data["ActivePage"] = "account"
+	h.renderPage(w, r, "account", data)
+}
+
+// totpData is what totp-section.html needs besides enrolment details.
+func (h *Handler) totpData(a *model.Account) map[string]interface{} {
+	data := map[string]interface{}{
+		"Account":  a,
+		"Required": h.totpRequired(a),
+	}
+	if a.TOTPEnabled {
+		codes, err := h.store.UnusedRecoveryCodes(a.ID)
+		if err != nil {
+			log.Printf("account: recovery codes for %q: %v", a.Username, err)
+		}
+		data["Remaining"] = len(codes)
+	}
+	return data
+}
+
+// totpRequired reports whether the policy applies to a, enrolled or not.
+func (h *Handler) totpRequired(a *model.Account) bool {
+	settings, _ := h.store.GetSettings()
+	return (&model.Account{Role: a.Role, Subject: a.Subject}).NeedsTOTP(settings)
+}
+
+func (h *Handler) renderTOTP(w http.ResponseWriter, status int, a *model.Account, extra map[string]interface{}) {
+	data := h.totpData(a)
+	for k, v := range extra {
+		data[k] = v
+	}
+	h.renderStatus(w, status, "totp-section.html", data)
+}
+
+// TOTPStart begins enrolment with a fresh secret and shows it as a QR code.
+func (h *Handler) TOTPStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	a := currentAccount(r)
+	if a.Subject != "" || a.TOTPEnabled {
+		h.renderTOTP(w, http.StatusConflict, a, map[string]interface{}{"Error": "Two-factor authentication cannot be set up again from here."})
+		return
+	}
+	secret := auth.NewTOTPSecret()
+	if err := h.store.StartTOTP(a.ID, secret); err != nil {
+		log.Printf("account: start TOTP for %q: %v", a.Username, err)
+		h.renderTOTP(w, 500, a, map[string]interface{}{"Error": "Could not start the enrolment."})
+		return
+	}
+	h.renderEnrolment(w, http.StatusOK, a, secret, "")
+}
+
+func (h *Handler) renderEnrolment(w http.ResponseWriter, status int, a *model.Account, secret, errMsg string) {
+	svg, err := auth.QRCodeSVG(auth.TOTPURI("HeadControl", a.Username, secret))
+	if err != nil {
+		log.Printf("account: QR code: %v", err)
+	}
+	h.renderTOTP(w, status, a, map[string]interface{}{
+		"Enrolling": true,
+		"QRCode":    template.HTML(svg),
+		"Secret":    secret,
+		"Error":     errMsg,
+	})
+}
+
+// TOTPConfirm finishes enrolment with the first code from the app and
+// shows the recovery codes, once.
+func (h *Handler) TOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	a := currentAccount(r)
+	if a.TOTPSecret == "" || a.TOTPEnabled {
+		h.renderTOTP(w, http.StatusConflict, a, map[string]interface{}{"Error": "Start the enrolment first."})
+		return
+	}
+	step, ok := auth.CheckTOTP(a.TOTPSecret, r.FormValue("code"), time.Now(), 0)
+	if !ok {
+		h.renderEnrolment(w, http.StatusBadRequest, a, a.TOTPSecret, "That code is not right. Check the time on your device and try the next one.")
+		return
+	}
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err == nil {
+		err = h.store.EnableTOTP(a.ID, step, hashes)
+	}
+	if err != nil {
+		log.Printf("account: enable TOTP for %q: %v", a.Username, err)
+		h.renderTOTP(w, 500, a, map[string]interface{}{"Error": "Could not enable two-factor authentication."})
+		return
+	}
+	log.Printf("account: %q enabled two-factor authentication", a.Username)
+	a.TOTPEnabled = true
+	h.renderTOTP(w, http.StatusOK, a, map[string]interface{}{"RecoveryCodes": codes})
+}
+
+// TOTPDisable turns two-factor authentication off after checking a code,
+// unless the policy requires it for the account.
+func (h *Handler) TOTPDisable(w http.ResponseWriter, r *http.Request) {
+	if a := currentAccount(r); r.Method == http.MethodPost && h.totpRequired(a) {
+		h.renderTOTP(w, http.StatusForbidden, a, map[string]interface{}{"Error": "Two-factor authentication is required for your role."})
+		return
+	}
+	a, ok := h.confirmSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	if err := h.store.DisableTOTP(a.ID); err != nil {
+		log.Printf("account: disable TOTP for %q: %v", a.Username, err)
+		h.renderTOTP(w, 500, a, map[string]interface{}{"Error": "Could not disable two-factor authentication."})
+		return
+	}
+	log.Printf("account: %q disabled two-factor authentication", a.Username)
+	a.TOTPEnabled, a.TOTPSecret = false, ""
+	h.renderTOTP(w, http.StatusOK, a, nil)
+}
+
+// TOTPRecovery replaces the recovery codes after checking a code.
+func (h *Handler) TOTPRecovery(w http.ResponseWriter, r *http.Request) {
+	a, ok := h.confirmSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err == nil {
+		err = h.store.ReplaceRecoveryCodes(a.ID, hashes)
+	}
+	if err != nil {
+		log.Printf("account: recovery codes for %q: %v", a.Username, err)
+		h.renderTOTP(w, 500, a, map[string]interface{}{"Error": "Could not create new recovery codes."})
+		return
+	}
+	log.Printf("account: %q created new recovery codes", a.Username)
+	h.renderTOTP(w, http.StatusOK, a, map[string]interface{}{"RecoveryCodes": codes})
+}
+
+// confirmSecondFactor checks the code posted to change two-factor
+// settings. Wrong codes count towards the account lockout like at login.
+func (h *Handler) confirmSecondFactor(w http.ResponseWriter, r *http.Request) (*model.Account, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return nil, false
+	}
+	a := currentAccount(r)
+	if !a.TOTPEnabled {
+		h.renderTOTP(w, http.StatusConflict, a, map[string]interface{}{"Error": "Two-factor authentication is not enabled."})
+		return nil, false
+	}
+
+	ip := clientIP(r)
+	wait, err := h.limiter.Attempt(ip, a.Username)
+	if err != nil {
+		log.Printf("account: check lockout: %v", err)
+		h.renderTOTP(w, 500, a, map[string]interface{}{"Error": "Could not check login attempts."})
+		return nil, false
+	}
+	if wait > 0 {
+		h.renderTOTP(w, http.StatusTooManyRequests, a, map[string]interface{}{"Error": "Too many wrong codes. Try again in " + roundWait(wait) + "."})
+		return nil, false
+	}
+	ok, _, err := h.checkSecondFactor(a, r.FormValue("code"))
+	if err != nil {
+		log.Printf("account: check second factor for %q: %v", a.Username, err)
+		h.renderTOTP(w, 500, a, map[string]interface{}{"Error": "Could not check the code."})
+		return nil, false
+	}
+	if !ok {
+		h.renderTOTP(w, http.StatusBadRequest, a, map[string]interface{}{"Error": "That code is not right."})
+		return nil, false
+	}
+	if err := h.limiter.Refund(ip, a.Username); err != nil {
+		log.Printf("account: refund attempt: %v", err)
+	}
+	return a, true
+}
+
+// UpdatePolicy saves the two-factor policy from the settings page.
+func (h *Handler) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	require := r.FormValue("require_totp") == "1"
+	if err := h.store.SaveTOTPPolicy(require); err != nil {
+		h.render(w, "settings-result.html", map[string]interface{}{
+			"Success": false,
+			"Message": "Failed to save the policy: " + err.Error(),
+		})
+		return
+	}
+	log.Printf("policy: two-factor authentication required=%v, set by %s", require, currentAccount(r).Username)
+	msg := "Policy saved."
+	if require && currentAccount(r).NeedsTOTP(&model.Settings{RequireTOTP: true}) {
+		msg = "Policy saved. Set up two-factor authentication on your account page to keep working."
+	}
+	h.render(w, "settings-result.html", map[string]interface{}{
+		"Success": true,
+		"Message": msg,
+	})
+}
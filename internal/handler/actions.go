@@ -0,0 +1,377 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/model"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleDelete stores a deletion to run once the undo window ends and
+// answers with a toast offering to undo it. refresh names the table the
+// toast reloads after an undo.
+func (h *Handler) scheduleDelete(w http.ResponseWriter, r *http.Request, a *model.PendingAction, refresh string) {
+	if !h.schedule(w, r, a) {
+		return
+	}
+	if h.opts.UndoWindow <= 0 {
+		h.renderToast(w, "'"+a.TargetName+"' is being deleted.", "success")
+		return
+	}
+	h.render(w, "pending-toast.html", map[string]interface{}{
+		"Action":  a,
+		"Message": fmt.Sprintf("'%s' will be deleted in %d seconds.", a.TargetName, int(h.opts.UndoWindow.Round(time.Second).Seconds())),
+		"Timeout": h.opts.UndoWindow.Milliseconds(),
+		"Refresh": refresh,
+	})
+}
+
+// schedule stores a as pending until the undo window ends. It answers with
+// an error toast and reports false when it cannot.
+func (h *Handler) schedule(w http.ResponseWriter, r *http.Request, a *model.PendingAction) bool {
+	pending, err := h.pendingTargets(a.Kind)
+	if err != nil {
+		log.Printf("actions: list pending: %v", err)
+		h.renderToastStatus(w, 500, "Could not schedule the deletion.", "error")
+		return false
+	}
+	if _, ok := pending[a.TargetID]; ok {
+		h.renderToastStatus(w, http.StatusConflict, "'"+a.TargetName+"' is already being deleted.", "error")
+		return false
+	}
+
+	now := time.Now()
+	a.RequestedBy = currentAccount(r).Username
+	a.CreatedAt, a.ExecuteAt = now, now.Add(h.opts.UndoWindow)
+	if err := h.store.CreatePendingAction(a); err != nil {
+		log.Printf("actions: schedule %s %s: %v", a.Kind, a.TargetID, err)
+		h.renderToastStatus(w, 500, "Could not schedule the deletion.", "error")
+		return false
+	}
+	log.Printf("actions: %s scheduled %s of %q (%s), runs at %s", a.RequestedBy, a.Kind, a.TargetName, a.TargetID, a.ExecuteAt.Format(time.RFC3339))
+	event := model.EventUserDeleteRequest
+	if a.Kind == model.ActionDeleteNode {
+		event = model.EventNodeDeleteRequest
+	}
+	var plan []string
+	for i := range a.Steps {
+		plan = append(plan, describeStep(&a.Steps[i]))
+	}
+	h.audit(r, actionEvent(a, event, strings.Join(plan, ", ")))
+	return true
+}
+
+// actionEvent is an audit event about the target of a.
+func actionEvent(a *model.PendingAction, action, detail string) model.AuditEvent {
+	e := model.AuditEvent{Actor: a.RequestedBy, Action: action, Target: a.TargetName, Detail: detail}
+	if a.Kind == model.ActionDeleteNode {
+		e.NodeID = a.TargetID
+		if a.Snapshot.User != nil {
+			e.UserID = a.Snapshot.User.ID
+		}
+	} else {
+		e.UserID = a.TargetID
+	}
+	return e
+}
+
+// DeleteProgress renders the progress of a user deletion plan. The panel
+// polls itself until the plan has finished.
+func (h *Handler) DeleteProgress(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	a, err := h.store.GetPendingAction(id)
+	if err != nil {
+		log.Printf("actions: load %d: %v", id, err)
+		h.renderPartialErrorStatus(w, 500, "Could not load the deletion.")
+		return
+	}
+	if a == nil {
+		h.renderPartialErrorStatus(w, http.StatusNotFound, "Deletion not found.")
+		return
+	}
+	h.render(w, "delete-progress.html", h.progressData(a))
+}
+
+func (h *Handler) progressData(a *model.PendingAction) map[string]interface{} {
+	removesUser := a.Kind != model.ActionDeleteUser || deletesUser(a)
+	var msg string
+	switch a.Status {
+	case model.ActionPending:
+		secs := int(math.Ceil(time.Until(a.ExecuteAt).Seconds()))
+		switch {
+		case secs <= 0 && removesUser:
+			msg = fmt.Sprintf("'%s' is being deleted.", a.TargetName)
+		case secs <= 0:
+			msg = fmt.Sprintf("The plan for '%s' is starting.", a.TargetName)
+		case removesUser:
+			msg = fmt.Sprintf("'%s' will be deleted in %d seconds.", a.TargetName, secs)
+		default:
+			msg = fmt.Sprintf("The plan for '%s' starts in %d seconds.", a.TargetName, secs)
+		}
+	case model.ActionRunning:
+		msg = fmt.Sprintf("Working through the plan for '%s'…", a.TargetName)
+	case model.ActionDone:
+		msg = fmt.Sprintf("'%s' has been deleted.", a.TargetName)
+	case model.ActionKept:
+		msg = fmt.Sprintf("The plan for '%s' has finished. The user was kept because they still own expired nodes.", a.TargetName)
+	case model.ActionFailed:
+		msg = fmt.Sprintf("The plan stopped at a failed step and '%s' was not deleted. Steps after it did not run.", a.TargetName)
+	case model.ActionUndone:
+		msg = fmt.Sprintf("Deletion of '%s' undone. Nothing was changed.", a.TargetName)
+	}
+	poll := ""
+	if a.Status == model.ActionPending || a.Status == model.ActionRunning {
+		poll = pollEvery(PendingActionInterval)
+	}
+	return map[string]interface{}{
+		"Action":  a,
+		"Message": msg,
+		"Poll":    poll,
+	}
+}
+
+// pendingTargets maps the targets of pending actions of kind to the
+// action IDs, for marking rows and refusing to schedule twice.
+func (h *Handler) pendingTargets(kind string) (map[string]int64, error) {
+	actions, err := h.store.PendingActions()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]int64)
+	for _, a := range actions {
+		if a.Kind == kind {
+			out[a.TargetID] = a.ID
+		}
+	}
+	return out, nil
+}
+
+// UndoAction cancels a pending deletion while its undo window is open.
+func (h *Handler) UndoAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	a, err := h.store.GetPendingAction(id)
+	if err != nil {
+		log.Printf("actions: load %d: %v", id, err)
+		h.renderToastStatus(w, 500, "Could not undo the deletion.", "error")
+		return
+	}
+	if a == nil {
+		h.renderToastStatus(w, http.StatusNotFound, "Nothing to undo.", "error")
+		return
+	}
+	ok, err := h.store.UndoPendingAction(id)
+	if err != nil {
+		log.Printf("actions: undo %d: %v", id, err)
+		h.renderToastStatus(w, 500, "Could not undo the deletion.", "error")
+		return
+	}
+	if !ok {
+		msg := "Too late to undo: '" + a.TargetName + "' has been deleted."
+		if !deletesUser(a) && a.Kind == model.ActionDeleteUser {
+			msg = "Too late to undo: the plan for '" + a.TargetName + "' has already run."
+		}
+		h.renderToastStatus(w, http.StatusConflict, msg, "error")
+		return
+	}
+	log.Printf("actions: %s undid %s of %q (%s)", currentAccount(r).Username, a.Kind, a.TargetName, a.TargetID)
+	h.audit(r, actionEvent(a, model.EventUndo, ""))
+	h.renderToast(w, "Deletion of '"+a.TargetName+"' undone.", "success")
+}
+
+// RunPendingActions sends every deletion whose undo window has ended to
+// Headscale. main runs it in the background every PendingActionInterval.
+func (h *Handler) RunPendingActions(ctx context.Context) error {
+	due, err := h.store.DuePendingActions(time.Now())
+	if err != nil || len(due) == 0 {
+		return err
+	}
+	client, err := h.getClient()
+	if err != nil || client == nil {
+		return fmt.Errorf("%d deletions waiting: %w", len(due), errNoSettings)
+	}
+	for _, a := range due {
+		ok, err := h.store.ClaimPendingAction(a.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		before := make([]string, len(a.Steps))
+		for i, st := range a.Steps {
+			before[i] = st.Status
+		}
+		runErr := runAction(ctx, client, &a, func() {
+			if err := h.store.UpdateActionSteps(a.ID, a.Steps); err != nil {
+				log.Printf("actions: save progress of %d: %v", a.ID, err)
+			}
+		})
+		if runErr != nil && ctx.Err() != nil {
+			// Shutting down: leave the action to resume at the next start.
+			log.Printf("actions: %s of %q (%s) interrupted, will resume", a.Kind, a.TargetName, a.TargetID)
+			if err := h.store.RequeuePendingAction(a.ID); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+		if runErr != nil {
+			log.Printf("actions: %s of %q (%s) failed: %v", a.Kind, a.TargetName, a.TargetID, runErr)
+		} else {
+			log.Printf("actions: %s of %q (%s) done", a.Kind, a.TargetName, a.TargetID)
+		}
+		h.auditRun(&a, before, runErr)
+		status := model.ActionDone
+		switch {
+		case runErr == nil && deletesUser(&a):
+			if err := h.store.DeleteUserProfile(a.TargetID); err != nil {
+				log.Printf("actions: forget profile of %s: %v", a.TargetID, err)
+			}
+		case runErr == nil && a.Kind == model.ActionDeleteUser:
+			status = model.ActionKept
+			log.Printf("actions: kept user %q (%s): they still own expired nodes", a.TargetName, a.TargetID)
+		}
+		if err := h.store.FinishPendingAction(a.ID, status, runErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditRun records what running a changed: each plan step that finished
+// in this run, or the node deletion for actions without a plan.
+func (h *Handler) auditRun(a *model.PendingAction, before []string, runErr error) {
+	if len(a.Steps) == 0 {
+		h.recordEvent(actionEvent(a, model.EventNodeDelete, failure(runErr)))
+		return
+	}
+	for i, st := range a.Steps {
+		if st.Status == before[i] || (st.Status != model.StepDone && st.Status != model.StepFailed) {
+			continue
+		}
+		e := model.AuditEvent{Actor: a.RequestedBy, UserID: a.TargetID, NodeID: st.NodeID, Target: st.NodeName}
+		switch st.Op {
+		case model.StepMove:
+			e.Action, e.Detail = model.EventNodeMove, "to "+st.UserName
+		case model.StepExpire:
+			e.Action = model.EventNodeExpire
+		case model.StepDelete:
+			e.Action = model.EventNodeDelete
+		case model.StepDeleteUser:
+			e.Action, e.Target = model.EventUserDelete, st.UserName
+		}
+		if st.Status == model.StepFailed {
+			e.Detail = strings.TrimSpace(e.Detail + " failed: " + st.Error)
+		}
+		h.recordEvent(e)
+	}
+}
+
+// deletesUser reports whether a removes the user itself, not just their
+// nodes.
+func deletesUser(a *model.PendingAction) bool {
+	return a.Kind == model.ActionDeleteUser && slices.ContainsFunc(a.Steps, func(st model.PlanStep) bool {
+		return st.Op == model.StepDeleteUser
+	})
+}
+
+func failure(err error) string {
+	if err == nil {
+		return ""
+	}
+	return "failed: " + err.Error()
+}
+
+// PendingActionInterval is how often RunPendingActions should run.
+const PendingActionInterval = time.Second
+
+// runAction performs a, calling save whenever a step of its plan changes
+// state. Targets that are already gone count as deleted.
+func runAction(ctx context.Context, client headscale.API, a *model.PendingAction, save func()) error {
+	if len(a.Steps) > 0 {
+		return runPlan(ctx, client, a.Steps, save)
+	}
+	switch a.Kind {
+	case model.ActionDeleteNode:
+		return ignoreNotFound(client.DeleteNode(ctx, a.TargetID))
+	case model.ActionDeleteUser:
+		// Every user deletion is scheduled with a plan; without one there
+		// is no confirmed list of nodes to act on.
+		return errors.New("user deletion has no plan, schedule it again")
+	}
+	return fmt.Errorf("unknown action %q", a.Kind)
+}
+
+// runPlan runs the steps not done yet in order. The first failure marks
+// the steps after it skipped and stops the plan. A step cut short by ctx
+// goes back to waiting, so the plan resumes at the step it was on.
+func runPlan(ctx context.Context, client headscale.API, steps []model.PlanStep, save func()) error {
+	for i := range steps {
+		st := &steps[i]
+		if st.Status == model.StepDone {
+			continue
+		}
+		st.Status, st.Error = model.StepRunning, ""
+		save()
+		if err := runStep(ctx, client, st); err != nil {
+			if ctx.Err() != nil {
+				st.Status = ""
+				save()
+				return err
+			}
+			st.Status, st.Error = model.StepFailed, err.Error()
+			for j := i + 1; j < len(steps); j++ {
+				steps[j].Status = model.StepSkipped
+			}
+			save()
+			return fmt.Errorf("%s: %w", describeStep(st), err)
+		}
+		st.Status = model.StepDone
+		save()
+	}
+	return nil
+}
+
+func runStep(ctx context.Context, client headscale.API, st *model.PlanStep) error {
+	switch st.Op {
+	case model.StepMove:
+		_, err := client.MoveNode(ctx, st.NodeID, st.UserID)
+		return err
+	case model.StepExpire:
+		_, err := client.ExpireNode(ctx, st.NodeID)
+		return err
+	case model.StepDelete:
+		return ignoreNotFound(client.DeleteNode(ctx, st.NodeID))
+	case model.StepDeleteUser:
+		return ignoreNotFound(client.DeleteUser(ctx, st.UserID))
+	}
+	return fmt.Errorf("unknown step %q", st.Op)
+}
+
+func describeStep(st *model.PlanStep) string {
+	switch st.Op {
+	case model.StepMove:
+		return fmt.Sprintf("move node %s to %s", st.NodeName, st.UserName)
+	case model.StepDeleteUser:
+		return fmt.Sprintf("delete user %s", st.UserName)
+	}
+	return fmt.Sprintf("%s node %s", st.Op, st.NodeName)
+}
+
+func ignoreNotFound(err error) error {
+	if headscale.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"headcontrol/internal/model"
+	"log"
+	"net/http"
+	"time"
+)
+
+// audit records a change the signed-in account made. The change has
+// happened by then, so failing to record it is only logged.
+func (h *Handler) audit(r *http.Request, e model.AuditEvent) {
+	e.Actor = currentAccount(r).Username
+	h.recordEvent(e)
+}
+
+// auditNode records a change to node, filed under its owner.
+func (h *Handler) auditNode(r *http.Request, action string, node *model.Node, detail string) {
+	e := model.AuditEvent{Action: action, NodeID: node.ID, Target: node.GivenName, Detail: detail}
+	if node.User != nil {
+		e.UserID = node.User.ID
+	}
+	h.audit(r, e)
+}
+
+func (h *Handler) recordEvent(e model.AuditEvent) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	if err := h.store.RecordAuditEvent(&e); err != nil {
+		log.Printf("audit: record %s of %q: %v", e.Action, e.Target, err)
+	}
+}
@@ -0,0 +1,386 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"headcontrol/internal/auth"
+	"headcontrol/internal/model"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ctxKey int
+
+const accountKey ctxKey = iota
+
+// currentAccount returns the signed-in account, or nil outside RequireRole.
+func currentAccount(r *http.Request) *model.Account {
+	a, _ := r.Context().Value(accountKey).(*model.Account)
+	return a
+}
+
+// redirect sends the browser to p, through HX-Redirect for HTMX requests so
+// the whole page is replaced.
+func (h *Handler) redirect(w http.ResponseWriter, r *http.Request, p string) {
+	if h.isHTMX(r) {
+		w.Header().Set("HX-Redirect", p)
+		w.WriteHeader(200)
+		return
+	}
+	http.Redirect(w, r, p, http.StatusFound)
+}
+
+// RequireRole lets the request through only for a signed-in account whose
+// role includes role. Anyone else is sent to the login page, and accounts
+// the two-factor policy applies to are sent to enrol first.
+func (h *Handler) RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return h.requireAccount(role, true, next)
+}
+
+// RequireSignIn lets any signed-in account through, including one that
+// still has to set up two-factor authentication.
+func (h *Handler) RequireSignIn(next http.HandlerFunc) http.HandlerFunc {
+	return h.requireAccount(model.RoleViewer, false, next)
+}
+
+// sessionAccount returns the account the session cookie signs in, or nil
+// when there is none or the session was revoked by signing out.
+func (h *Handler) sessionAccount(r *http.Request) *model.Account {
+	id, gen, ok := h.sessions.Account(r)
+	if !ok {
+		return nil
+	}
+	a, err := h.store.GetAccountByID(id)
+	if err != nil {
+		log.Printf("session: load account %d: %v", id, err)
+	}
+	if a == nil || a.SessionGen != gen {
+		return nil
+	}
+	return a
+}
+
+func (h *Handler) requireAccount(role string, enforceTOTP bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account := h.sessionAccount(r)
+		if account == nil {
+			target := h.url("/login")
+			if r.Method == http.MethodGet && !h.isHTMX(r) {
+				target += "?next=" + url.QueryEscape(r.URL.RequestURI())
+			}
+			h.redirect(w, r, target)
+			return
+		}
+		if !account.Can(role) {
+			h.forbidden(w, r, fmt.Sprintf("This needs the %s role; you are signed in as %s.", role, account.Role))
+			return
+		}
+		if enforceTOTP {
+			settings, _ := h.store.GetSettings()
+			if account.NeedsTOTP(settings) {
+				if r.Method == http.MethodGet {
+					h.redirect(w, r, h.url("/account"))
+				} else {
+					h.forbidden(w, r, "Set up two-factor authentication on your account page first.")
+				}
+				return
+			}
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), accountKey, account)))
+	}
+}
+
+func (h *Handler) forbidden(w http.ResponseWriter, r *http.Request, msg string) {
+	if !h.isHTMX(r) {
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	h.renderToast(w, msg, "error")
+}
+
+func (h *Handler) LoginPage(w http.ResponseWriter, r *http.Request) {
+	if h.sessionAccount(r) != nil {
+		http.Redirect(w, r, h.safeNext(r.URL.Query().Get("next")), http.StatusFound)
+		return
+	}
+	h.renderLogin(w, r, http.StatusOK, r.URL.Query().Get("next"), "")
+}
+
+// renderLogin shows the login page with an optional error, e.g. when
+// single sign-on failed.
+func (h *Handler) renderLogin(w http.ResponseWriter, r *http.Request, status int, next, errMsg string) {
+	n, err := h.store.CountAccounts()
+	if err != nil {
+		log.Printf("login: count accounts: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	// With single sign-on the first account can come from the
+	// identity provider, so the password form stays.
+	data := map[string]interface{}{
+		"NoAccounts":    n == 0 && !h.opts.DisablePasswordLogin && h.opts.OIDC == nil,
+		"PasswordLogin": !h.opts.DisablePasswordLogin,
+		"Next":          next,
+		"MinPassword":   auth.MinPasswordLength,
+		"Error":         errMsg,
+	}
+	if h.opts.OIDC != nil {
+		data["OIDCName"] = h.opts.OIDC.Name()
+	}
+	h.renderStatus(w, status, "login.html", pageData(r, data))
+}
+
+// noAccountsMessage is shown until the first account is created. That is
+// only possible on the server itself, so nobody who merely reaches the
+// login page first can make themselves admin.
+const noAccountsMessage = "No accounts exist yet. Create the first admin on the server with: headcontrol accounts add --role admin <username>"
+
+// Login signs an account in.
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.LoginPage(w, r)
+		return
+	}
+	if h.opts.DisablePasswordLogin {
+		h.loginError(w, http.StatusForbidden, "Password sign-in is disabled. Use single sign-on.")
+		return
+	}
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	if username == "" || password == "" {
+		h.loginError(w, http.StatusBadRequest, "Username and password are required.")
+		return
+	}
+
+	n, err := h.store.CountAccounts()
+	if err != nil {
+		log.Printf("login: count accounts: %v", err)
+		h.loginError(w, 500, "Could not check accounts.")
+		return
+	}
+	if n == 0 {
+		h.loginError(w, http.StatusForbidden, noAccountsMessage)
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := h.limiter.Attempt(ip, username)
+	if err != nil {
+		log.Printf("login: check lockout: %v", err)
+		h.loginError(w, 500, "Could not check login attempts.")
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+		h.loginError(w, http.StatusTooManyRequests,
+			"Too many failed attempts. Try again in "+roundWait(wait)+".")
+		return
+	}
+
+	account, err := h.store.GetAccount(username)
+	if err != nil {
+		log.Printf("login: load account: %v", err)
+		h.loginError(w, 500, "Could not load the account.")
+		return
+	}
+	hash := ""
+	if account != nil {
+		hash = account.PasswordHash
+	}
+	if !auth.CheckPassword(hash, password) {
+		log.Printf("login: failed for %q from %s", username, ip)
+		h.loginError(w, http.StatusUnauthorized, "Invalid username or password.")
+		return
+	}
+	if err := h.limiter.Refund(ip, username); err != nil {
+		log.Printf("login: refund attempt: %v", err)
+	}
+
+	if account.TOTPEnabled {
+		// Earlier failures stay counted until the second factor is right too.
+		h.sessions.IssuePending(w, r, account.ID)
+		target := h.url("/login/2fa")
+		if next := r.FormValue("next"); next != "" {
+			target += "?next=" + url.QueryEscape(next)
+		}
+		h.redirect(w, r, target)
+		return
+	}
+	h.completeLogin(w, r, account)
+}
+
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, account *model.Account) {
+	if err := h.limiter.Succeed(account.Username); err != nil {
+		log.Printf("login: clear failures: %v", err)
+	}
+	h.sessions.ClearPending(w, r)
+	h.sessions.Issue(w, r, account.ID, account.SessionGen)
+	h.redirect(w, r, h.safeNext(r.FormValue("next")))
+}
+
+// LoginTOTP is the second step of signing in for accounts with two-factor
+// authentication. It accepts a code from the authenticator app or a
+// recovery code, and counts failures like wrong passwords.
+func (h *Handler) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.sessions.Pending(r)
+	var account *model.Account
+	if ok {
+		a, err := h.store.GetAccountByID(id)
+		if err != nil {
+			log.Printf("login: load account %d: %v", id, err)
+		}
+		account = a
+	}
+	if r.Method != http.MethodPost {
+		if account == nil || !account.TOTPEnabled {
+			http.Redirect(w, r, h.url("/login"), http.StatusFound)
+			return
+		}
+		h.render(w, "login.html", pageData(r, map[string]interface{}{
+			"TOTP": true,
+			"Next": r.URL.Query().Get("next"),
+		}))
+		return
+	}
+	if account == nil || !account.TOTPEnabled {
+		h.loginError(w, http.StatusUnauthorized, "Sign-in expired. Start again with your password.")
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := h.limiter.Attempt(ip, account.Username)
+	if err != nil {
+		log.Printf("login: check lockout: %v", err)
+		h.loginError(w, 500, "Could not check login attempts.")
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+		h.loginError(w, http.StatusTooManyRequests,
+			"Too many failed attempts. Try again in "+roundWait(wait)+".")
+		return
+	}
+
+	ok, recovery, err := h.checkSecondFactor(account, r.FormValue("code"))
+	if err != nil {
+		log.Printf("login: check second factor: %v", err)
+		h.loginError(w, 500, "Could not check the code.")
+		return
+	}
+	if !ok {
+		log.Printf("login: wrong second factor for %q from %s", account.Username, ip)
+		h.loginError(w, http.StatusUnauthorized, "Invalid code.")
+		return
+	}
+	if err := h.limiter.Refund(ip, account.Username); err != nil {
+		log.Printf("login: refund attempt: %v", err)
+	}
+	if recovery {
+		log.Printf("login: %q used a recovery code", account.Username)
+	}
+	h.completeLogin(w, r, account)
+}
+
+// checkSecondFactor reports whether code is the account's current TOTP
+// code or one of its unused recovery codes, and uses it up.
+func (h *Handler) checkSecondFactor(account *model.Account, code string) (ok, recovery bool, err error) {
+	if auth.IsRecoveryCode(code) {
+		codes, err := h.store.UnusedRecoveryCodes(account.ID)
+		if err != nil {
+			return false, true, err
+		}
+		for id, hash := range codes {
+			if auth.CheckRecoveryCode(hash, code) {
+				ok, err := h.store.UseRecoveryCode(id)
+				return ok, true, err
+			}
+		}
+		return false, true, nil
+	}
+	step, ok := auth.CheckTOTP(account.TOTPSecret, strings.ReplaceAll(strings.TrimSpace(code), " ", ""), time.Now(), account.TOTPLastStep)
+	if !ok {
+		return false, false, nil
+	}
+	ok, err = h.store.UseTOTPStep(account.ID, step)
+	return ok, false, err
+}
+
+func (h *Handler) loginError(w http.ResponseWriter, status int, msg string) {
+	h.renderStatus(w, status, "connection-result.html", map[string]interface{}{
+		"Success": false,
+		"Message": msg,
+	})
+}
+
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	// Clearing the cookie is not enough: a copy of it would stay valid
+	// until it expires. Raising the generation revokes it everywhere.
+	if a := h.sessionAccount(r); a != nil {
+		if err := h.store.RevokeSessions(a.ID); err != nil {
+			log.Printf("logout: revoke sessions of %q: %v", a.Username, err)
+			http.Error(w, "Could not sign out", http.StatusInternalServerError)
+			return
+		}
+	}
+	h.sessions.Clear(w, r)
+	h.redirect(w, r, h.url("/login"))
+}
+
+// ClearLockout forgets the failed logins for one IP or account.
+func (h *Handler) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	key := r.FormValue("key")
+	if err := h.limiter.Clear(key); err != nil {
+		log.Printf("lockouts: clear %s: %v", key, err)
+		h.renderPartialError(w, "Failed to clear the lockout.")
+		return
+	}
+	log.Printf("lockouts: %s cleared by %s", key, currentAccount(r).Username)
+	h.render(w, "lockouts.html", h.lockoutsData())
+}
+
+func (h *Handler) lockoutsData() map[string]interface{} {
+	failures, err := h.limiter.List()
+	data := map[string]interface{}{"Lockouts": failures, "Now": time.Now()}
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+	return data
+}
+
+// safeNext keeps post-login redirects on this site.
+func (h *Handler) safeNext(next string) string {
+	if !strings.HasPrefix(next, h.url("/")) || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n") {
+		return h.url("/")
+	}
+	return next
+}
+
+// clientIP is the peer address, already resolved through trusted proxies.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func roundWait(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d seconds", int(d.Seconds())+1)
+	}
+	return fmt.Sprintf("%d minutes", int(d.Minutes())+1)
+}
@@ -1,21 +1,23 @@
 package handler
 
 import (
+	"context"
 	"headcontrol/internal/model"
 	"net/http"
 	"sort"
+	"sync"
 	"time"
 )
 
 func (h *Handler) DashboardPage(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
+	if r.URL.Path != h.url("/") {
 		http.NotFound(w, r)
 		return
 	}
 
-	stats, recent, err := h.fetchDashboardData()
-	if err != "" {
-		h.renderPageWithError(w, r, "Dashboard", "dashboard", err)
+	stats, recent, asOf, err := h.fetchDashboardData(r.Context())
+	if err != nil {
+		h.pageError(w, r, "Dashboard", "dashboard", err)
 		return
 	}
 
@@ -24,13 +26,15 @@ func (h *Handler) DashboardPage(w http.ResponseWriter, r *http.Request) {
 		"ActivePage":  "dashboard",
 		"Stats":       stats,
 		"RecentNodes": recent,
+		"Refresh":     pollEvery(h.opts.DashboardRefresh),
+		"AsOf":        asOf,
 	})
 }
 
 func (h *Handler) DashboardSummary(w http.ResponseWriter, r *http.Request) {
-	stats, recent, err := h.fetchDashboardData()
-	if err != "" {
-		h.renderPartialError(w, err)
+	stats, recent, asOf, err := h.fetchDashboardData(r.Context())
+	if err != nil {
+		h.partialError(w, r, err)
 		return
 	}
 
@@ -39,23 +43,35 @@ func (h *Handler) DashboardSummary(w http.ResponseWriter, r *http.Request) {
 		"ActivePage":  "dashboard",
 		"Stats":       stats,
 		"RecentNodes": recent,
+		"Refresh":     pollEvery(h.opts.DashboardRefresh),
+		"AsOf":        asOf,
 	})
 }
 
-func (h *Handler) fetchDashboardData() (model.DashboardStats, []model.Node, string) {
+func (h *Handler) fetchDashboardData(ctx context.Context) (model.DashboardStats, []model.Node, time.Time, error) {
 	client, clientErr := h.getClient()
 	if clientErr != nil || client == nil {
-		return model.DashboardStats{}, nil, "Failed to load settings."
+		return model.DashboardStats{}, nil, time.Time{}, errNoSettings
 	}
 
-	users, usersErr := client.ListUsers()
+	var (
+		wg       sync.WaitGroup
+		users    []model.User
+		usersErr error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		users, usersErr = client.ListUsers(ctx)
+	}()
+	nodes, nodesErr := client.ListNodes(ctx)
+	wg.Wait()
+
 	if usersErr != nil {
-		return model.DashboardStats{}, nil, usersErr.Error()
+		return model.DashboardStats{}, nil, time.Time{}, usersErr
 	}
-
-	nodes, nodesErr := client.ListNodes()
 	if nodesErr != nil {
-		return model.DashboardStats{}, nil, nodesErr.Error()
+		return model.DashboardStats{}, nil, time.Time{}, nodesErr
 	}
 
 	online, expiring := 0, 0
@@ -89,5 +105,5 @@ func (h *Handler) fetchDashboardData() (model.DashboardStats, []model.Node, stri
 		sorted = sorted[:5]
 	}
 
-	return stats, sorted, ""
+	return stats, sorted, client.AsOf(), nil
 }
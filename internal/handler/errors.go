@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"errors"
+	"headcontrol/internal/headscale"
+	"log"
+	"net/http"
+)
+
+var errNoSettings = errors.New("failed to load settings")
+
+// errorStatus maps a failed Headscale call to the status we answer with.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoSettings):
+		return http.StatusInternalServerError
+	case headscale.IsNotFound(err):
+		return http.StatusNotFound
+	case headscale.IsConflict(err):
+		return http.StatusConflict
+	case headscale.IsInvalid(err):
+		return http.StatusBadRequest
+	case headscale.IsUnauthorized(err):
+		return http.StatusUnauthorized
+	case headscale.IsUnavailable(err):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// errorMessage turns a failed Headscale call into text fit for the UI.
+func errorMessage(err error) string {
+	switch {
+	case errors.Is(err, errNoSettings):
+		return "Failed to load settings."
+	case headscale.IsNotFound(err):
+		return "Not found. It may have been deleted already — refresh to see the current state."
+	case headscale.IsConflict(err):
+		return "Conflict: " + apiMessage(err)
+	case headscale.IsInvalid(err):
+		return "Invalid request: " + apiMessage(err)
+	case headscale.IsUnauthorized(err):
+		return "Headscale rejected the API key. Update it in Settings."
+	}
+	return err.Error()
+}
+
+func apiMessage(err error) string {
+	var apiErr *headscale.APIError
+	if errors.As(err, &apiErr) && apiErr.Message != "" {
+		return apiErr.Message
+	}
+	return err.Error()
+}
+
+// redirectIfRevoked sends the browser to the settings page when Headscale
+// no longer accepts the stored API key.
+func (h *Handler) redirectIfRevoked(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !headscale.IsUnauthorized(err) {
+		return false
+	}
+	log.Printf("headscale rejected API key: %v", err)
+	target := h.url("/settings?error=unauthorized")
+	if h.isHTMX(r) {
+		w.Header().Set("HX-Redirect", target)
+		w.WriteHeader(200)
+	} else {
+		http.Redirect(w, r, target, http.StatusFound)
+	}
+	return true
+}
+
+func (h *Handler) pageError(w http.ResponseWriter, r *http.Request, title, page string, err error) {
+	if h.redirectIfRevoked(w, r, err) {
+		return
+	}
+	h.renderPageStatus(w, r, errorStatus(err), page, map[string]interface{}{
+		"Title":      title,
+		"ActivePage": page,
+		"Error":      errorMessage(err),
+	})
+}
+
+func (h *Handler) partialError(w http.ResponseWriter, r *http.Request, err error) {
+	if h.redirectIfRevoked(w, r, err) {
+		return
+	}
+	h.renderPartialErrorStatus(w, errorStatus(err), errorMessage(err))
+}
+
+func (h *Handler) toastError(w http.ResponseWriter, r *http.Request, err error) {
+	if h.redirectIfRevoked(w, r, err) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(errorStatus(err))
+	h.renderToast(w, errorMessage(err), "error")
+}
+
+// CSRFRejected answers requests that failed the CSRF checks.
+func (h *Handler) CSRFRejected(w http.ResponseWriter, r *http.Request) {
+	msg := "The request could not be verified. Reload the page and try again."
+	if !h.isHTMX(r) {
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	h.renderToast(w, msg, "error")
+}
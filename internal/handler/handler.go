@@ -2,25 +2,164 @@ package handler
 
 import (
 	"encoding/json"
+	"fmt"
+	"headcontrol/internal/assets"
+	"headcontrol/internal/auth"
 	"headcontrol/internal/headscale"
 	"headcontrol/internal/model"
+	"headcontrol/internal/server"
 	"headcontrol/internal/store"
 	"html/template"
+	"io/fs"
 	"log"
 	"net/http"
-	"path/filepath"
+	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
+type Options struct {
+	Templates fs.FS
+	Static    *assets.Static
+	Dev       bool
+	// BasePath is the sub-path the app is mounted under, e.g. "/headcontrol",
+	// without a trailing slash. Empty when served from the root.
+	BasePath string
+
+	DashboardRefresh time.Duration
+	NodesRefresh     time.Duration
+	// CacheTTL is how long Headscale GET responses are shared between
+	// requests. Zero disables the cache.
+	CacheTTL time.Duration
+	// SessionSecret signs login cookies. A random one is used when empty,
+	// which signs everyone out on restart.
+	SessionSecret string
+	// OIDC enables single sign-on when set. OIDCRedirectURL overrides the
+	// callback URL derived from the request.
+	OIDC                 *auth.OIDC
+	OIDCRedirectURL      string
+	DisablePasswordLogin bool
+	// UndoWindow is how long user and node deletions can be undone before
+	// RunPendingActions sends them to Headscale. Zero sends them on its
+	// next run.
+	UndoWindow time.Duration
+	// AvatarStrategy picks the pictures of users without one of their own:
+	// avatar.None, Gravatar, Robohash or Upload.
+	AvatarStrategy string
+}
+
 type Handler struct {
 	store     *store.Store
+	opts      Options
 	templates *template.Template
+	sessions  *auth.Sessions
+	limiter   *auth.Limiter
+
+	endpointMu sync.Mutex
+	endpoint   *headscale.Endpoint
+}
+
+func New(s *store.Store, opts Options) (*Handler, error) {
+	secret := opts.SessionSecret
+	if secret == "" {
+		secret = server.RandomSecret()
+	}
+	h := &Handler{
+		store:    s,
+		opts:     opts,
+		sessions: auth.NewSessions(secret, opts.BasePath+"/"),
+		limiter:  auth.NewLimiter(s),
+	}
+	tmpl, err := h.parseTemplates()
+	if err != nil {
+		return nil, err
+	}
+	h.templates = tmpl
+	return h, nil
+}
+
+// Routes returns the mux serving every page, partial and API endpoint
+// under the configured base path.
+func (h *Handler) Routes() *http.ServeMux {
+	route := func(p string) string { return h.opts.BasePath + p }
+	mux := http.NewServeMux()
+	mux.Handle(route("/static/"), h.opts.Static)
+
+	mux.HandleFunc(route("/login"), h.Login)
+	mux.HandleFunc(route("/logout"), h.Logout)
+	mux.HandleFunc(route("/login/2fa"), h.LoginTOTP)
+	if h.opts.OIDC != nil {
+		mux.HandleFunc(route("/login/oidc"), h.OIDCLogin)
+		mux.HandleFunc(route("/login/oidc/callback"), h.OIDCCallback)
+	}
+
+	// Viewers can look, operators can change users and nodes, and only
+	// admins can touch the connection settings or lockouts.
+	view := func(next http.HandlerFunc) http.HandlerFunc {
+		return h.RequireRole(model.RoleViewer, h.RequireSetup(bypassCache(next)))
+	}
+	operate := func(next http.HandlerFunc) http.HandlerFunc {
+		return h.RequireRole(model.RoleOperator, h.RequireSetup(next))
+	}
+	admin := func(next http.HandlerFunc) http.HandlerFunc {
+		return h.RequireRole(model.RoleAdmin, next)
+	}
+
+	mux.HandleFunc(route("/setup"), admin(h.SetupPage))
+	mux.HandleFunc(route("/api/test-connection"), admin(h.TestConnection))
+	mux.HandleFunc(route("/api/save-settings"), admin(h.SaveSettings))
+
+	mux.HandleFunc(route("/"), view(h.DashboardPage))
+	mux.HandleFunc(route("/users"), view(h.UsersPage))
+	mux.HandleFunc(route("/users/{id}"), view(h.UserPage))
+	mux.HandleFunc(route("/nodes"), view(h.NodesPage))
+	mux.HandleFunc(route("/nodes/{id}"), view(h.NodePage))
+	mux.HandleFunc(route("/settings"), admin(h.RequireSetup(h.SettingsPage)))
+
+	mux.HandleFunc(route("/dashboard/summary"), view(h.DashboardSummary))
+	mux.HandleFunc(route("/users/table"), view(h.UsersTable))
+	mux.HandleFunc(route("/nodes/table"), view(h.NodesTable))
+	mux.HandleFunc(route("/nodes/detail"), view(h.NodeDetail))
+	mux.HandleFunc(route("/users/delete-plan"), operate(h.DeletePlan))
+	mux.HandleFunc(route("/users/delete-progress"), operate(h.DeleteProgress))
+
+	mux.HandleFunc(route("/api/users/create"), operate(h.CreateUser))
+	mux.HandleFunc(route("/api/users/rename"), operate(h.RenameUser))
+	mux.HandleFunc(route("/api/users/delete"), operate(h.DeleteUser))
+	mux.HandleFunc(route("/api/users/expire-nodes"), operate(h.ExpireUserNodes))
+	mux.HandleFunc(route("/api/users/profile"), operate(h.UpdateProfile))
+	mux.HandleFunc(route("/avatars/{id}"), view(h.Avatar))
+
+	mux.HandleFunc(route("/api/nodes/rename"), operate(h.RenameNode))
+	mux.HandleFunc(route("/api/nodes/expire"), operate(h.ExpireNode))
+	mux.HandleFunc(route("/api/nodes/delete"), operate(h.DeleteNode))
+	mux.HandleFunc(route("/api/nodes/tags"), operate(h.SetNodeTags))
+	mux.HandleFunc(route("/api/nodes/routes"), operate(h.SetNodeRoutes))
+
+	mux.HandleFunc(route("/api/actions/undo"), operate(h.UndoAction))
+
+	// Every signed-in account manages its own second factor, even when the
+	// policy is holding it back from everything else.
+	mux.HandleFunc(route("/account"), h.RequireSignIn(h.AccountPage))
+	mux.HandleFunc(route("/api/account/totp/start"), h.RequireSignIn(h.TOTPStart))
+	mux.HandleFunc(route("/api/account/totp/confirm"), h.RequireSignIn(h.TOTPConfirm))
+	mux.HandleFunc(route("/api/account/totp/disable"), h.RequireSignIn(h.TOTPDisable))
+	mux.HandleFunc(route("/api/account/totp/recovery"), h.RequireSignIn(h.TOTPRecovery))
+
+	mux.HandleFunc(route("/api/update-settings"), admin(h.RequireSetup(h.UpdateSettings)))
+	mux.HandleFunc(route("/api/update-policy"), admin(h.RequireSetup(h.UpdatePolicy)))
+	mux.HandleFunc(route("/api/lockouts/clear"), admin(h.ClearLockout))
+	return mux
 }
 
-func New(s *store.Store, templateDir string) (*Handler, error) {
+func (h *Handler) parseTemplates() (*template.Template, error) {
 	funcMap := template.FuncMap{
-		"join": strings.Join,
+		"url":    h.url,
+		"asset":  h.opts.Static.Path,
+		"vendor": h.opts.Static.Vendor,
+		"icon":   assets.Icon,
+		"join":   strings.Join,
 		"json": func(v interface{}) template.JS {
 			b, _ := json.Marshal(v)
 			return template.JS(b)
@@ -47,6 +186,10 @@ func New(s *store.Store, templateDir string) (*Handler, error) {
 			}
 			return n.IPAddresses[0]
 		},
+		"keyPrefix": keyPrefix,
+		"dict":      dict,
+		"avatar":    h.avatarSrc,
+		"initials":  initials,
 		"safeLen": func(s []string) int {
 			if s == nil {
 				return 0
@@ -57,40 +200,86 @@ func New(s *store.Store, templateDir string) (*Handler, error) {
 
 	tmpl := template.New("").Funcs(funcMap)
 	for _, p := range []string{"layout", "pages", "partials"} {
-		if _, err := tmpl.ParseGlob(filepath.Join(templateDir, p, "*.html")); err != nil {
-			log.Printf("parse %s: %v", p, err)
+		if _, err := tmpl.ParseFS(h.opts.Templates, path.Join(p, "*.html")); err != nil {
+			return nil, fmt.Errorf("parse %s templates: %w", p, err)
 		}
 	}
+	return tmpl, nil
+}
 
-	return &Handler{store: s, templates: tmpl}, nil
+// url prefixes an absolute app path with the configured base path.
+func (h *Handler) url(p string) string {
+	return h.opts.BasePath + p
 }
 
-func (h *Handler) getClient() (*headscale.Client, error) {
+// lookupTemplates returns the parsed templates, re-reading them from disk on
+// every call in dev mode so template edits show up without a restart.
+func (h *Handler) lookupTemplates() (*template.Template, error) {
+	if h.opts.Dev {
+		return h.parseTemplates()
+	}
+	return h.templates, nil
+}
+
+func (h *Handler) getClient() (headscale.API, error) {
 	cfg, err := h.store.GetSettings()
 	if err != nil || cfg == nil {
 		return nil, err
 	}
-	return headscale.NewClient(cfg.BaseURL, cfg.APIKey), nil
+	ep, err := h.endpointFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ep.Client(), nil
 }
 
-func (h *Handler) render(w http.ResponseWriter, name string, data interface{}) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := h.templates.ExecuteTemplate(w, name, data); err != nil {
-		log.Printf("template %s: %v", name, err)
-		http.Error(w, "Internal Server Error", 500)
+// endpointFor returns the endpoint shared by every request to the saved
+// connection, replacing it when the settings change.
+func (h *Handler) endpointFor(cfg *model.Settings) (*headscale.Endpoint, error) {
+	h.endpointMu.Lock()
+	defer h.endpointMu.Unlock()
+	if h.endpoint != nil && h.endpoint.Matches(cfg) {
+		return h.endpoint, nil
+	}
+	ep, err := headscale.NewEndpoint(cfg, h.opts.CacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	if h.endpoint != nil {
+		// Requests still running may hold the old connection.
+		h.endpoint.Retire()
 	}
+	h.endpoint = ep
+	return ep, nil
 }
 
-func (h *Handler) renderFile(w http.ResponseWriter, path string, data interface{}) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	t, err := template.ParseFiles(path)
+// Close releases the open Headscale connection, if any.
+func (h *Handler) Close() error {
+	h.endpointMu.Lock()
+	defer h.endpointMu.Unlock()
+	if h.endpoint == nil {
+		return nil
+	}
+	return h.endpoint.Close()
+}
+
+func (h *Handler) render(w http.ResponseWriter, name string, data interface{}) {
+	h.renderStatus(w, http.StatusOK, name, data)
+}
+
+func (h *Handler) renderStatus(w http.ResponseWriter, status int, name string, data interface{}) {
+	tmpl, err := h.lookupTemplates()
 	if err != nil {
-		log.Printf("parse %s: %v", path, err)
+		log.Printf("templates: %v", err)
 		http.Error(w, "Internal Server Error", 500)
 		return
 	}
-	if err := t.Execute(w, data); err != nil {
-		log.Printf("exec %s: %v", path, err)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("template %s: %v", name, err)
 		http.Error(w, "Internal Server Error", 500)
 	}
 }
@@ -100,13 +289,26 @@ func (h *Handler) isHTMX(r *http.Request) bool {
 }
 
 func (h *Handler) renderPage(w http.ResponseWriter, r *http.Request, page string, data map[string]interface{}) {
+	h.renderPageStatus(w, r, http.StatusOK, page, data)
+}
+
+func (h *Handler) renderPageStatus(w http.ResponseWriter, r *http.Request, status int, page string, data map[string]interface{}) {
+	pageData(r, data)
 	if h.isHTMX(r) {
-		h.render(w, page+"-content.html", data)
+		h.renderStatus(w, status, page+"-content.html", data)
 	} else {
-		h.render(w, "layout.html", data)
+		h.renderStatus(w, status, "layout.html", data)
 	}
 }
 
+// pageData adds the per-request values the layout needs.
+func pageData(r *http.Request, data map[string]interface{}) map[string]interface{} {
+	data["CSRFToken"] = server.CSRFToken(r)
+	data["CSPNonce"] = server.CSPNonce(r)
+	data["Account"] = currentAccount(r)
+	return data
+}
+
 func (h *Handler) renderPageWithError(w http.ResponseWriter, r *http.Request, title, page, msg string) {
 	h.renderPage(w, r, page, map[string]interface{}{
 		"Title":      title,
@@ -115,15 +317,21 @@ func (h *Handler) renderPageWithError(w http.ResponseWriter, r *http.Request, ti
 	})
 }
 
+// bypassCache reads from Headscale rather than the cache when the request
+// says Cache-Control: no-cache, as the Refresh buttons and a hard reload do.
+func bypassCache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			r = r.WithContext(headscale.Fresh(r.Context()))
+		}
+		next(w, r)
+	}
+}
+
 func (h *Handler) RequireSetup(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !h.store.HasSettings() {
-			if h.isHTMX(r) {
-				w.Header().Set("HX-Redirect", "/setup")
-				w.WriteHeader(200)
-			} else {
-				http.Redirect(w, r, "/setup", http.StatusFound)
-			}
+			h.redirect(w, r, h.url("/setup"))
 			return
 		}
 		next(w, r)
@@ -0,0 +1,898 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"headcontrol/internal/assets"
+	"headcontrol/internal/auth"
+	"headcontrol/internal/avatar"
+	"headcontrol/internal/handler"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/headscaletest"
+	"headcontrol/internal/model"
+	"headcontrol/internal/oidctest"
+	"headcontrol/internal/server"
+	"headcontrol/internal/store"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type app struct {
+	t     *testing.T
+	hs    *headscaletest.Server
+	store *store.Store
+	h     *handler.Handler
+	mux   http.Handler
+	// cookies holds the session of the signed-in account.
+	cookies []*http.Cookie
+}
+
+const testPassword = "correct horse battery"
+
+// newApp wires a handler to a fresh database and a fake Headscale and signs
+// in as an admin. The connection is saved unless setup is false.
+func newApp(t *testing.T, setup bool) *app {
+	t.Helper()
+	a := newSignedOutApp(t, setup)
+	a.login("admin", model.RoleAdmin)
+	return a
+}
+
+// newSignedOutApp is newApp without any account. opts can adjust the
+// handler options.
+func newSignedOutApp(t *testing.T, setup bool, opts ...func(*handler.Options)) *app {
+	t.Helper()
+	hs := headscaletest.New(t)
+
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	if setup {
+		if err := st.SaveSettings(hs.URL, headscaletest.DefaultAPIKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	static, err := assets.New(os.DirFS("../../static"), "/static", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := handler.Options{Templates: os.DirFS("../../templates"), Static: static, UndoWindow: time.Minute}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	h, err := handler.New(st, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return &app{t: t, hs: hs, store: st, h: h, mux: h.Routes()}
+}
+
+// login creates an account with role and signs in as it.
+func (a *app) login(username, role string) {
+	a.t.Helper()
+	hash, err := auth.HashPassword(testPassword)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	if _, err := a.store.CreateAccount(username, hash, role); err != nil {
+		a.t.Fatal(err)
+	}
+	a.cookies = nil
+	rec := a.post("/login", url.Values{"username": {username}, "password": {testPassword}})
+	if rec.Header().Get("HX-Redirect") == "" {
+		a.t.Fatalf("login as %s = %d %s", username, rec.Code, rec.Body)
+	}
+}
+
+func (a *app) do(method, target string, form url.Values, htmx bool) *httptest.ResponseRecorder {
+	a.t.Helper()
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	if htmx {
+		req.Header.Set("HX-Request", "true")
+	}
+	for _, c := range a.cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		a.cookies = slices.DeleteFunc(a.cookies, func(o *http.Cookie) bool { return o.Name == c.Name })
+		if c.MaxAge >= 0 {
+			a.cookies = append(a.cookies, c)
+		}
+	}
+	return rec
+}
+
+// upload posts form as multipart with file as the avatar field.
+func (a *app) upload(target string, form url.Values, file []byte) *httptest.ResponseRecorder {
+	a.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, vs := range form {
+		for _, v := range vs {
+			mw.WriteField(k, v)
+		}
+	}
+	fw, _ := mw.CreateFormFile("avatar", "avatar.png")
+	fw.Write(file)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("HX-Request", "true")
+	for _, c := range a.cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func (a *app) get(target string, htmx bool) *httptest.ResponseRecorder {
+	return a.do(http.MethodGet, target, nil, htmx)
+}
+
+func (a *app) post(target string, form url.Values) *httptest.ResponseRecorder {
+	return a.do(http.MethodPost, target, form, true)
+}
+
+func expect(t *testing.T, rec *httptest.ResponseRecorder, status int, contains ...string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("status = %d, want %d; body:\n%s", rec.Code, status, rec.Body)
+	}
+	for _, s := range contains {
+		if !strings.Contains(rec.Body.String(), s) {
+			t.Errorf("body does not contain %q:\n%s", s, rec.Body)
+		}
+	}
+}
+
+func TestRequireSetup(t *testing.T) {
+	a := newApp(t, false)
+
+	rec := a.get("/users", false)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/setup" {
+		t.Errorf("GET /users = %d %q, want redirect to /setup", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = a.get("/users", true)
+	if rec.Header().Get("HX-Redirect") != "/setup" {
+		t.Errorf("HTMX GET /users HX-Redirect = %q, want /setup", rec.Header().Get("HX-Redirect"))
+	}
+	expect(t, a.get("/setup", false), http.StatusOK, "<html")
+}
+
+func TestSetup(t *testing.T) {
+	a := newApp(t, false)
+	form := url.Values{"base_url": {a.hs.URL}, "api_key": {headscaletest.DefaultAPIKey}}
+
+	expect(t, a.post("/api/test-connection", form), http.StatusOK, "Connection successful")
+
+	bad := url.Values{"base_url": {a.hs.URL}, "api_key": {"wrong"}}
+	expect(t, a.post("/api/test-connection", bad), http.StatusOK, "authentication failed")
+
+	// The chosen transport is the one tested: no gRPC server listens here.
+	grpc := url.Values{"base_url": {a.hs.URL}, "api_key": {headscaletest.DefaultAPIKey},
+		"transport": {"grpc"}, "grpc_address": {"127.0.0.1:1"}, "grpc_tls": {"insecure"}}
+	expect(t, a.post("/api/save-settings", grpc), http.StatusOK, "Connection test failed")
+	grpc.Set("grpc_tls", "bogus")
+	expect(t, a.post("/api/test-connection", grpc), http.StatusOK, "unknown gRPC TLS mode")
+	if a.store.HasSettings() {
+		t.Fatal("settings were saved although the gRPC connection failed")
+	}
+
+	rec := a.post("/api/save-settings", form)
+	if rec.Header().Get("HX-Redirect") != "/" {
+		t.Errorf("save-settings HX-Redirect = %q, want /", rec.Header().Get("HX-Redirect"))
+	}
+	if !a.store.HasSettings() {
+		t.Error("settings were not saved")
+	}
+}
+
+func TestUpdateSettings(t *testing.T) {
+	a := newApp(t, true)
+	form := url.Values{"base_url": {a.hs.URL}, "read_timeout": {"12"}, "write_timeout": {"8"},
+		"transport": {"grpc"}, "grpc_address": {"127.0.0.1:1"}, "grpc_tls": {"insecure"}}
+
+	expect(t, a.post("/api/update-settings", form), http.StatusOK, "nothing was saved")
+	cfg, _ := a.store.GetSettings()
+	if cfg.Transport != "rest" || cfg.ReadTimeout == 12 {
+		t.Fatalf("settings changed after a failed test: %+v", cfg)
+	}
+
+	form.Set("transport", "rest")
+	expect(t, a.post("/api/update-settings", form), http.StatusOK, "Settings saved")
+	cfg, _ = a.store.GetSettings()
+	if cfg.ReadTimeout != 12 || cfg.WriteTimeout != 8 || cfg.GRPCAddress != "127.0.0.1:1" || cfg.APIKey != headscaletest.DefaultAPIKey {
+		t.Errorf("saved settings = %+v", cfg)
+	}
+
+	form.Set("write_timeout", "16")
+	expect(t, a.post("/api/update-settings", form), http.StatusOK, "between 1 and 15")
+	form.Set("write_timeout", "")
+	expect(t, a.post("/api/update-settings", form), http.StatusOK, "Settings saved")
+	if cfg, _ = a.store.GetSettings(); cfg.WriteTimeout != int(headscale.DefaultTimeouts.Write.Seconds()) {
+		t.Errorf("empty write timeout saved as %d, want the write default", cfg.WriteTimeout)
+	}
+}
+
+func TestTimeoutsFitServerWriteTimeout(t *testing.T) {
+	if d := headscale.LongestCall(headscale.MaxTimeout); d >= server.WriteTimeout {
+		t.Errorf("a call may take %s, longer than the %s server write timeout", d, server.WriteTimeout)
+	}
+}
+
+func TestPages(t *testing.T) {
+	a := newApp(t, true)
+	a.hs.AddUser("alice")
+	n := a.hs.AddNode("alice", model.Node{Name: "laptop", Online: true})
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/", "Recent Nodes"},
+		{"/users", "alice"},
+		{"/nodes", "laptop"},
+		{"/settings", "v0.26.1"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			full := a.get(tc.path, false)
+			expect(t, full, http.StatusOK, "<html", tc.want)
+
+			partial := a.get(tc.path, true)
+			expect(t, partial, http.StatusOK, tc.want)
+			if strings.Contains(partial.Body.String(), "<html") {
+				t.Error("HTMX response contains the layout")
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/dashboard/summary", "Recent Nodes"},
+		{"/users/table", "alice"},
+		{"/nodes/table", "laptop"},
+		{"/nodes/detail?id=" + n.ID, "100.64.0." + n.ID},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			rec := a.get(tc.path, true)
+			expect(t, rec, http.StatusOK, tc.want)
+			if strings.Contains(rec.Body.String(), "<html") {
+				t.Error("partial contains the layout")
+			}
+		})
+	}
+}
+
+func TestUserActions(t *testing.T) {
+	a := newApp(t, true)
+
+	expect(t, a.post("/api/users/create", url.Values{"name": {"bob"}}), http.StatusOK, "toast-success")
+	users := a.hs.Users()
+	if len(users) != 1 || users[0].Name != "bob" {
+		t.Fatalf("users = %+v, want bob", users)
+	}
+	id := users[0].ID
+
+	expect(t, a.post("/api/users/create", url.Values{"name": {"bob"}}), http.StatusConflict, "toast-error")
+	expect(t, a.post("/api/users/create", url.Values{}), http.StatusOK, "Username is required")
+
+	expect(t, a.post("/api/users/rename", url.Values{"oldId": {id}, "newName": {"robert"}}), http.StatusOK, "robert")
+	if got := a.hs.Users()[0].Name; got != "robert" {
+		t.Errorf("name after rename = %q", got)
+	}
+
+	expect(t, a.post("/api/users/delete", url.Values{"id": {id}}), http.StatusOK, "will be deleted", "Undo")
+	expect(t, a.post("/api/users/delete", url.Values{"id": {id}}), http.StatusConflict, "already being deleted")
+	expect(t, a.post("/api/users/delete", url.Values{"id": {"999"}}), http.StatusNotFound, "deleted already")
+}
+
+func TestUserPage(t *testing.T) {
+	a := newApp(t, true)
+	gina := a.hs.AddUser("gina")
+	a.hs.AddUser("hank")
+	tablet := a.hs.AddNode("gina", model.Node{Name: "tablet"}).ID
+	a.hs.AddNode("hank", model.Node{Name: "desktop"})
+	a.hs.AddPreAuthKey("gina", headscaletest.PreAuthKey{Reusable: true})
+
+	expect(t, a.post("/api/nodes/tags", url.Values{"nodeId": {tablet}, "tags": {"tag:home"}}), http.StatusOK, "toast-success")
+	expect(t, a.post("/api/users/expire-nodes", url.Values{"id": {gina.ID}}), http.StatusOK, "Expired the user&#39;s node")
+	if n, _ := a.hs.Node(tablet); n.Expiry == "" {
+		t.Error("tablet not expired")
+	}
+
+	rec := a.get("/users/"+gina.ID, true)
+	expect(t, rec, http.StatusOK, "gina", "tablet", "hskey-auth-", "Reusable",
+		"Set tags of <strong>tablet</strong>", "Expired node <strong>tablet</strong>", "Expire All Nodes")
+	if strings.Contains(rec.Body.String(), "desktop") {
+		t.Error("user page lists another user's node")
+	}
+	for _, htmx := range []bool{true, false} {
+		rec := a.get("/users/999", htmx)
+		expect(t, rec, http.StatusNotFound, "User not found")
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("htmx=%v: Content-Type = %q, want text/html", htmx, ct)
+		}
+	}
+
+	a.login("viewer", model.RoleViewer)
+	expect(t, a.get("/users/"+gina.ID, true), http.StatusOK, "tablet")
+	expect(t, a.post("/api/users/expire-nodes", url.Values{"id": {gina.ID}}), http.StatusForbidden)
+}
+
+func TestUserProfile(t *testing.T) {
+	a := newSignedOutApp(t, true, func(o *handler.Options) { o.AvatarStrategy = avatar.Gravatar })
+	a.login("admin", model.RoleAdmin)
+
+	expect(t, a.post("/api/users/create", url.Values{"name": {"ivy"}, "email": {"Ivy <ivy@example.com>"}}), http.StatusOK, "not an email address")
+	expect(t, a.post("/api/users/create", url.Values{"name": {"ivy"}, "email": {"ivy@example.com"}}), http.StatusOK, "toast-success")
+	ivy := a.hs.Users()[0]
+	if want := avatar.URL(avatar.Gravatar, "ivy", "ivy@example.com"); ivy.ProfilePicURL != want {
+		t.Errorf("picture = %q, want %q", ivy.ProfilePicURL, want)
+	}
+
+	expect(t, a.post("/api/users/profile", url.Values{"id": {ivy.ID}, "email": {"ivy@"}}), http.StatusOK, "not an email address")
+	expect(t, a.post("/api/users/profile", url.Values{"id": {ivy.ID}, "pictureUrl": {"http://example.com/ivy.png"}}), http.StatusOK, "https URL")
+	expect(t, a.post("/api/users/profile", url.Values{"id": {ivy.ID}, "pictureUrl": {"https://example.com/ivy.png"}}), http.StatusOK,
+		"only load pictures from https://www.gravatar.com")
+	if p, _ := a.store.UserProfile(ivy.ID); p != nil {
+		t.Errorf("profile saved with a picture the page cannot load: %+v", p)
+	}
+	expect(t, a.post("/api/users/profile", url.Values{"id": {"999"}}), http.StatusNotFound, "User not found")
+	expect(t, a.post("/api/users/profile", url.Values{
+		"id": {ivy.ID}, "displayName": {"Ivy Lee"}, "email": {"ivy.lee@example.com"}, "pictureUrl": {ivy.ProfilePicURL},
+	}), http.StatusOK, "toast-success")
+	if got := a.hs.Users()[0]; got.DisplayName != "" || got.Email != "ivy@example.com" {
+		t.Errorf("Headscale user changed: %+v", got)
+	}
+
+	expect(t, a.get("/users/table", true), http.StatusOK, "Ivy Lee", "ivy.lee@example.com", `class="avatar"`)
+	expect(t, a.get("/users/"+ivy.ID, true), http.StatusOK, "Ivy Lee", "Edited in HeadControl",
+		"Edited the profile of <strong>ivy</strong>", "display name, email")
+
+	a.login("viewer", model.RoleViewer)
+	expect(t, a.post("/api/users/profile", url.Values{"id": {ivy.ID}, "displayName": {"x"}}), http.StatusForbidden)
+}
+
+func TestAvatarUpload(t *testing.T) {
+	a := newSignedOutApp(t, true, func(o *handler.Options) { o.AvatarStrategy = avatar.Upload })
+	a.login("admin", model.RoleAdmin)
+	jo := a.hs.AddUser("jo")
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	expect(t, a.upload("/api/users/profile", url.Values{"id": {jo.ID}}, []byte("<svg onload=alert(1)></svg>")), http.StatusOK, "PNG, JPEG, GIF or WebP")
+	expect(t, a.upload("/api/users/profile", url.Values{"id": {jo.ID}}, make([]byte, avatar.MaxUpload+1)), http.StatusOK, "larger than")
+	expect(t, a.get("/avatars/"+jo.ID, false), http.StatusNotFound)
+
+	expect(t, a.upload("/api/users/profile", url.Values{"id": {jo.ID}, "displayName": {"Jo"}}, png), http.StatusOK, "toast-success")
+	rec := a.get("/avatars/"+jo.ID, false)
+	expect(t, rec, http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" || !bytes.Equal(rec.Body.Bytes(), png) {
+		t.Errorf("avatar = %s %q", ct, rec.Body.Bytes())
+	}
+	expect(t, a.get("/users/"+jo.ID, true), http.StatusOK, `src="/avatars/`+jo.ID+`?v=`, "Uploaded image", "Remove the uploaded picture")
+
+	expect(t, a.post("/api/users/profile", url.Values{"id": {jo.ID}, "displayName": {"Jo"}, "removeAvatar": {"1"}}), http.StatusOK, "toast-success")
+	expect(t, a.get("/avatars/"+jo.ID, false), http.StatusNotFound)
+	expect(t, a.get("/users/"+jo.ID, true), http.StatusOK, `avatar-initials">J</span>`)
+}
+
+func TestNodePage(t *testing.T) {
+	a := newApp(t, true)
+	a.hs.AddUser("kim")
+	nas := a.hs.AddNode("kim", model.Node{
+		Name:       "nas",
+		PreAuthKey: &model.PreAuthKey{ID: "7", User: "kim", Key: "hskey-auth-0123456789-secretsecret"},
+		ForcedTags: []string{"tag:storage"},
+	})
+
+	rec := a.get("/nodes/"+nas.ID, true)
+	expect(t, rec, http.StatusOK, nas.MachineKey, nas.NodeKey, nas.DiscoKey, `data-copy="`+nas.IPAddresses[0]+`"`,
+		"Forced Tags", "tag:storage", "hskey-auth-01234…", "Raw JSON", "&#34;machineKey&#34;: &#34;mkey:")
+	if strings.Contains(rec.Body.String(), "secretsecret") {
+		t.Error("node page shows the whole pre-auth key")
+	}
+	expect(t, a.get("/nodes/999", true), http.StatusNotFound)
+
+	a.login("viewer", model.RoleViewer)
+	expect(t, a.get("/nodes/"+nas.ID, false), http.StatusOK, "<html", nas.MachineKey)
+}
+
+func TestNodeActions(t *testing.T) {
+	a := newApp(t, true)
+	a.hs.AddUser("carol")
+	id := a.hs.AddNode("carol", model.Node{Name: "pi"}).ID
+
+	expect(t, a.post("/api/nodes/rename", url.Values{"nodeId": {id}, "newName": {"garage"}}), http.StatusOK, "toast-success")
+	expect(t, a.post("/api/nodes/expire", url.Values{"nodeId": {id}}), http.StatusOK, "toast-success")
+	expect(t, a.post("/api/nodes/tags", url.Values{"nodeId": {id}, "tags": {"tag:iot, tag:home"}}), http.StatusOK, "toast-success")
+	expect(t, a.post("/api/nodes/tags", url.Values{"nodeId": {id}, "tags": {"iot"}}), http.StatusBadRequest, "toast-error")
+	expect(t, a.post("/api/nodes/routes", url.Values{"nodeId": {id}, "routes": {"10.1.0.0/16"}}), http.StatusOK, "toast-success")
+
+	n, _ := a.hs.Node(id)
+	if n.GivenName != "garage" || n.Expiry == "" ||
+		!slices.Equal(n.Tags, []string{"tag:iot", "tag:home"}) ||
+		!slices.Equal(n.ApprovedRoutes, []string{"10.1.0.0/16"}) {
+		t.Errorf("node after actions = %+v", n)
+	}
+
+	expect(t, a.post("/api/nodes/delete", url.Values{"nodeId": {id}}), http.StatusOK, "will be deleted", "Undo")
+	expect(t, a.get("/nodes", true), http.StatusOK, "Deleting")
+	expect(t, a.post("/api/nodes/delete", url.Values{"nodeId": {"999"}}), http.StatusNotFound, "deleted already")
+}
+
+func TestDeleteUndo(t *testing.T) {
+	a := newApp(t, true)
+	a.hs.AddUser("carol")
+	id := a.hs.AddNode("carol", model.Node{Name: "pi", Tags: []string{"tag:iot"}, ApprovedRoutes: []string{"10.1.0.0/16"}}).ID
+
+	expect(t, a.post("/api/nodes/delete", url.Values{"nodeId": {id}}), http.StatusOK, "pi&#39; will be deleted in 60 seconds")
+	pending, _ := a.store.PendingActions()
+	if len(pending) != 1 {
+		t.Fatalf("pending actions = %+v, want one", pending)
+	}
+	action := pending[0]
+	if s := action.Snapshot; len(s.Nodes) != 1 || s.User == nil || s.User.Name != "carol" ||
+		!slices.Equal(s.Nodes[0].Tags, []string{"tag:iot"}) || !slices.Equal(s.Nodes[0].ApprovedRoutes, []string{"10.1.0.0/16"}) {
+		t.Errorf("snapshot = %+v", s)
+	}
+
+	undo := url.Values{"id": {fmt.Sprint(action.ID)}}
+	expect(t, a.post("/api/actions/undo", undo), http.StatusOK, "undone")
+	expect(t, a.post("/api/actions/undo", undo), http.StatusConflict, "Too late")
+	if err := a.h.RunPendingActions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.hs.Node(id); !ok {
+		t.Error("node deleted after undo")
+	}
+
+	a.login("viewer", model.RoleViewer)
+	expect(t, a.post("/api/actions/undo", undo), http.StatusForbidden)
+}
+
+func TestDeleteRunsAfterWindow(t *testing.T) {
+	a := newSignedOutApp(t, true, func(o *handler.Options) { o.UndoWindow = 0 })
+	a.login("admin", model.RoleAdmin)
+	user := a.hs.AddUser("dave")
+	laptop := a.hs.AddNode("dave", model.Node{Name: "laptop"}).ID
+	phone := a.hs.AddNode("dave", model.Node{Name: "phone"}).ID
+
+	plan := url.Values{"id": {user.ID}, "plan-" + laptop: {"delete"}, "plan-" + phone: {"delete"}}
+	expect(t, a.post("/api/users/delete", url.Values{"id": {user.ID}}), http.StatusBadRequest, "Choose what happens to &#39;laptop&#39;")
+	expect(t, a.post("/api/users/delete", plan), http.StatusBadRequest, "deletes 2 nodes", "Type the username")
+	plan.Set("confirm", "dav")
+	expect(t, a.post("/api/users/delete", plan), http.StatusBadRequest, "Type the username")
+	plan.Set("confirm", "dave")
+	expect(t, a.post("/api/users/delete", plan), http.StatusOK, "is being deleted")
+	expect(t, a.get("/users", true), http.StatusOK, "Deleting")
+
+	if err := a.h.RunPendingActions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if users := a.hs.Users(); len(users) != 0 {
+		t.Errorf("users after deletion = %+v", users)
+	}
+	actions, _ := a.store.RecentActions(10)
+	if len(actions) != 1 || actions[0].Status != model.ActionDone || len(actions[0].Snapshot.Nodes) != 2 {
+		t.Errorf("actions = %+v, want one done with both nodes in the snapshot", actions)
+	}
+	expect(t, a.post("/api/actions/undo", url.Values{"id": {fmt.Sprint(actions[0].ID)}}), http.StatusConflict, "Too late")
+}
+
+func TestDeleteResumesAfterShutdown(t *testing.T) {
+	a := newSignedOutApp(t, true, func(o *handler.Options) { o.UndoWindow = 0 })
+	a.login("admin", model.RoleAdmin)
+	a.hs.AddUser("gina")
+	id := a.hs.AddNode("gina", model.Node{Name: "nas"}).ID
+	expect(t, a.post("/api/nodes/delete", url.Values{"nodeId": {id}}), http.StatusOK)
+
+	// Shutting down while the deletion runs leaves it queued, not failed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.h.RunPendingActions(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunPendingActions() = %v, want context.Canceled", err)
+	}
+	pending, _ := a.store.PendingActions()
+	if len(pending) != 1 {
+		t.Fatalf("pending actions = %+v, want the interrupted one", pending)
+	}
+	if _, ok := a.hs.Node(id); !ok {
+		t.Fatal("node deleted by a cancelled run")
+	}
+
+	if err := a.h.RunPendingActions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.hs.Node(id); ok {
+		t.Error("node still there after the deletion resumed")
+	}
+	actions, _ := a.store.RecentActions(1)
+	if actions[0].Status != model.ActionDone {
+		t.Errorf("action = %+v, want done", actions[0])
+	}
+}
+
+func TestDeletePlan(t *testing.T) {
+	a := newSignedOutApp(t, true, func(o *handler.Options) { o.UndoWindow = 0 })
+	a.login("admin", model.RoleAdmin)
+	erin := a.hs.AddUser("erin")
+	frank := a.hs.AddUser("frank")
+	laptop := a.hs.AddNode("erin", model.Node{Name: "laptop"}).ID
+	phone := a.hs.AddNode("erin", model.Node{Name: "phone"}).ID
+
+	rec := a.get("/users/delete-plan?id="+erin.ID, true)
+	expect(t, rec, http.StatusOK, "laptop", "phone", "Move to frank")
+	if strings.Contains(rec.Body.String(), "Move to erin") {
+		t.Error("plan offers to move nodes to the user being deleted")
+	}
+	expect(t, a.get("/users/delete-plan?id=999", true), http.StatusNotFound, "deleted already")
+
+	bad := url.Values{"id": {erin.ID}, "plan-" + laptop: {"move:999"}, "plan-" + phone: {"expire"}}
+	expect(t, a.post("/api/users/delete", bad), http.StatusBadRequest, "no longer exists")
+
+	// Moves and expiries need no typed confirmation. An expired node stays
+	// with erin, so she is kept.
+	plan := url.Values{"id": {erin.ID}, "plan-" + laptop: {"move:" + frank.ID}, "plan-" + phone: {"expire"}}
+	rec = a.post("/api/users/delete", plan)
+	expect(t, rec, http.StatusOK, "Move <strong>laptop</strong> to <strong>frank</strong>", "Waiting")
+	if got := rec.Header().Get("HX-Retarget"); got != "#delete-user-content" {
+		t.Errorf("HX-Retarget = %q, want the delete modal", got)
+	}
+	if err := a.h.RunPendingActions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := a.hs.Node(laptop); n.User == nil || n.User.Name != "frank" {
+		t.Errorf("laptop owner = %+v, want frank", n.User)
+	}
+	if n, _ := a.hs.Node(phone); n.Expiry == "" || n.User.Name != "erin" {
+		t.Errorf("phone = %+v, want expired and still erin's", n)
+	}
+	if len(a.hs.Users()) != 2 {
+		t.Errorf("users = %+v, want erin kept", a.hs.Users())
+	}
+	// The move is filed under erin but shows on frank's page too, through
+	// the node he now owns.
+	expect(t, a.get("/users/"+frank.ID, true), http.StatusOK, "Moved node <strong>laptop</strong>", "to frank")
+	actions, _ := a.store.RecentActions(1)
+	if actions[0].Status != model.ActionKept {
+		t.Errorf("action status = %q, want %q", actions[0].Status, model.ActionKept)
+	}
+	rec = a.get(fmt.Sprintf("/users/delete-progress?id=%d", actions[0].ID), true)
+	expect(t, rec, http.StatusOK, "user was kept", "Done")
+	expect(t, a.post("/api/actions/undo", url.Values{"id": {fmt.Sprint(actions[0].ID)}}), http.StatusConflict, "plan for &#39;erin&#39; has already run")
+	if strings.Contains(rec.Body.String(), "hx-trigger") {
+		t.Error("finished plan still polls")
+	}
+
+	// A failed step stops the plan before the user is deleted.
+	plan = url.Values{"id": {frank.ID}, "plan-" + laptop: {"move:" + erin.ID}}
+	expect(t, a.post("/api/users/delete", plan), http.StatusOK, "hx-trigger")
+	a.hs.Fail(500)
+	if err := a.h.RunPendingActions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	actions, _ = a.store.RecentActions(1)
+	if actions[0].Status != model.ActionFailed || !strings.Contains(actions[0].Error, "move node laptop to erin") {
+		t.Errorf("action = %+v, want failed at the move", actions[0])
+	}
+	expect(t, a.get(fmt.Sprintf("/users/delete-progress?id=%d", actions[0].ID), true), http.StatusOK, "Failed", "Skipped", "was not deleted")
+	if len(a.hs.Users()) != 2 {
+		t.Errorf("users = %+v, want frank kept after the failure", a.hs.Users())
+	}
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	a := newApp(t, true)
+	a.get("/users/table", true) // detect the version before injecting faults
+	a.hs.Fail(500, 500, 500)
+
+	rec := a.get("/users/table", true)
+	expect(t, rec, http.StatusBadGateway, "error-banner")
+	// The client only swaps HTML error responses in.
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+}
+
+func TestRevokedKeyRedirectsToSettings(t *testing.T) {
+	a := newApp(t, true)
+	a.hs.RevokeKey()
+
+	rec := a.get("/users", false)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/settings?error=unauthorized" {
+		t.Errorf("GET /users = %d %q, want redirect to settings", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = a.post("/api/users/create", url.Values{"name": {"x"}})
+	if rec.Header().Get("HX-Redirect") != "/settings?error=unauthorized" {
+		t.Errorf("HX-Redirect = %q, want settings", rec.Header().Get("HX-Redirect"))
+	}
+	expect(t, a.get("/settings?error=unauthorized", false), http.StatusOK, "rejected the saved API key")
+}
+
+func TestLoginNeedsFirstAccountFromCLI(t *testing.T) {
+	a := newSignedOutApp(t, true)
+
+	rec := a.get("/users", false)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/login?next=%2Fusers" {
+		t.Errorf("GET /users = %d %q, want redirect to /login", rec.Code, rec.Header().Get("Location"))
+	}
+	expect(t, a.get("/login", false), http.StatusOK, "Create the first admin account", "headcontrol accounts add --role admin")
+
+	form := url.Values{"username": {"root"}, "password": {testPassword}, "confirm": {testPassword}}
+	expect(t, a.post("/login", form), http.StatusForbidden, "No accounts exist yet")
+	if n, _ := a.store.CountAccounts(); n != 0 {
+		t.Fatalf("the login page created %d accounts", n)
+	}
+
+	a.login("root", model.RoleAdmin)
+	expect(t, a.get("/users", false), http.StatusOK, "root")
+
+	a.post("/logout", url.Values{})
+	expect(t, a.get("/login", false), http.StatusOK, "Sign in to continue")
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	a := newApp(t, true)
+	stolen := slices.Clone(a.cookies)
+
+	a.post("/logout", url.Values{})
+	a.cookies = stolen
+	if rec := a.get("/users", false); rec.Code != http.StatusFound {
+		t.Errorf("GET /users with a signed-out cookie = %d, want a redirect to /login", rec.Code)
+	}
+	expect(t, a.get("/login", false), http.StatusOK, "Sign in to continue")
+
+	a.cookies = nil
+	a.post("/login", url.Values{"username": {"admin"}, "password": {testPassword}})
+	expect(t, a.get("/users", false), http.StatusOK)
+}
+
+func TestLoginRedirectsToNext(t *testing.T) {
+	a := newApp(t, true)
+	a.post("/logout", url.Values{})
+	if rec := a.get("/", false); rec.Code != http.StatusFound {
+		t.Fatalf("GET / after logout = %d, want a redirect", rec.Code)
+	}
+
+	for next, want := range map[string]string{
+		"/nodes":               "/nodes",
+		"//evil.example/":      "/",
+		"https://evil.example": "/",
+	} {
+		a.cookies = nil
+		rec := a.post("/login", url.Values{"username": {"admin"}, "password": {testPassword}, "next": {next}})
+		if got := rec.Header().Get("HX-Redirect"); got != want {
+			t.Errorf("next=%q: HX-Redirect = %q, want %q", next, got, want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	a := newApp(t, true)
+	a.cookies = nil
+
+	bad := url.Values{"username": {"admin"}, "password": {"wrong password"}}
+	for i := 0; i < auth.DefaultLockoutPolicy.AccountThreshold; i++ {
+		expect(t, a.post("/login", bad), http.StatusUnauthorized, "Invalid username or password")
+	}
+	good := url.Values{"username": {"Admin"}, "password": {testPassword}}
+	rec := a.post("/login", good)
+	expect(t, rec, http.StatusTooManyRequests, "Too many failed attempts")
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+
+	if err := auth.NewLimiter(a.store).Clear(auth.AccountKey("admin")); err != nil {
+		t.Fatal(err)
+	}
+	if rec := a.post("/login", good); rec.Header().Get("HX-Redirect") != "/" {
+		t.Errorf("login after clearing = %d %s", rec.Code, rec.Body)
+	}
+	if failures, _ := a.store.ListLoginFailures(time.Time{}); len(failures) != 1 || failures[0].Key != auth.IPKey("192.0.2.1") || failures[0].Failures != 5 {
+		t.Errorf("failures after success = %+v, want only the IP record with the 5 wrong passwords", failures)
+	}
+	expect(t, a.get("/settings", false), http.StatusOK, "ip:192.0.2.1")
+	expect(t, a.post("/api/lockouts/clear", url.Values{"key": {auth.IPKey("192.0.2.1")}}), http.StatusOK, "No failed sign-ins")
+}
+
+func TestRoles(t *testing.T) {
+	a := newApp(t, true)
+	a.hs.AddUser("alice")
+
+	a.login("viewer", model.RoleViewer)
+	expect(t, a.get("/users", false), http.StatusOK, "alice")
+	expect(t, a.post("/api/users/create", url.Values{"name": {"mallory"}}), http.StatusForbidden, "needs the operator role")
+	expect(t, a.get("/settings", false), http.StatusForbidden)
+
+	a.login("operator", model.RoleOperator)
+	expect(t, a.post("/api/users/create", url.Values{"name": {"bob"}}), http.StatusOK, "toast-success")
+	expect(t, a.post("/api/update-settings", url.Values{}), http.StatusForbidden, "needs the admin role")
+	expect(t, a.post("/api/lockouts/clear", url.Values{"key": {"ip:192.0.2.1"}}), http.StatusForbidden)
+}
+
+func newOIDCApp(t *testing.T, passwords bool) (*app, *oidctest.Issuer) {
+	t.Helper()
+	iss := oidctest.New(t)
+	a := newSignedOutApp(t, true, func(o *handler.Options) {
+		o.OIDC = auth.NewOIDC(auth.OIDCOptions{
+			Issuer: iss.URL, ClientID: oidctest.ClientID, ClientSecret: oidctest.ClientSecret,
+			Name:   "Example ID",
+			Groups: map[string]string{"ops": model.RoleOperator, "admins": model.RoleAdmin},
+			Secret: "0123456789abcdef0123456789abcdef",
+		})
+		o.DisablePasswordLogin = !passwords
+	})
+	return a, iss
+}
+
+// signInOIDC runs the authorization code flow through the issuer and
+// returns the response to the callback.
+func (a *app) signInOIDC(iss *oidctest.Issuer, next string) *httptest.ResponseRecorder {
+	a.t.Helper()
+	rec := a.get("/login/oidc?next="+url.QueryEscape(next), false)
+	if rec.Code != http.StatusFound || !strings.HasPrefix(rec.Header().Get("Location"), iss.URL+"/authorize?") {
+		a.t.Fatalf("GET /login/oidc = %d %q, want a redirect to the issuer", rec.Code, rec.Header().Get("Location"))
+	}
+	callback, err := url.Parse(iss.Authorize(a.t, rec.Header().Get("Location")))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.get(callback.RequestURI(), false)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	a, iss := newOIDCApp(t, true)
+	expect(t, a.get("/login", false), http.StatusOK, "Sign in with Example ID", "Password")
+
+	iss.SignIn(map[string]interface{}{"sub": "u-42", "preferred_username": "carol", "groups": []string{"staff", "ops"}})
+	rec := a.signInOIDC(iss, "/nodes")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/nodes" {
+		t.Fatalf("callback = %d %q, want redirect to /nodes; body:\n%s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	account, _ := a.store.GetAccount("carol")
+	if account == nil || account.Role != model.RoleOperator || account.Subject != "u-42" || account.PasswordHash != "" {
+		t.Fatalf("account = %+v, want a passwordless operator", account)
+	}
+	expect(t, a.get("/users", false), http.StatusOK, "carol")
+
+	// The role follows the groups on the next sign-in.
+	a.post("/logout", url.Values{})
+	iss.SignIn(map[string]interface{}{"sub": "u-42", "preferred_username": "carol", "groups": []string{"admins"}})
+	a.signInOIDC(iss, "/")
+	if account, _ := a.store.GetAccount("carol"); account.Role != model.RoleAdmin {
+		t.Errorf("role after regrouping = %s, want admin", account.Role)
+	}
+	if n, _ := a.store.CountAccounts(); n != 1 {
+		t.Errorf("%d accounts, want 1", n)
+	}
+}
+
+func TestOIDCLoginRefused(t *testing.T) {
+	a, iss := newOIDCApp(t, false)
+	expect(t, a.post("/login", url.Values{"username": {"x"}, "password": {testPassword}, "confirm": {testPassword}}),
+		http.StatusForbidden, "Password sign-in is disabled")
+
+	iss.SignIn(map[string]interface{}{"sub": "u-7", "preferred_username": "dave", "groups": []string{"staff"}})
+	expect(t, a.signInOIDC(iss, "/"), http.StatusForbidden, "not allowed to use HeadControl")
+
+	iss.SignIn(map[string]interface{}{"sub": "u-8", "preferred_username": "erin", "groups": []string{"ops"}})
+	iss.Tamper(func(c map[string]interface{}) { c["aud"] = "another-client" })
+	expect(t, a.signInOIDC(iss, "/"), http.StatusUnauthorized, "Single sign-on failed")
+
+	expect(t, a.get("/login/oidc/callback?code=x&state=y", false), http.StatusUnauthorized, "Single sign-on failed")
+	if n, _ := a.store.CountAccounts(); n != 0 {
+		t.Errorf("%d accounts after refused sign-ins, want 0", n)
+	}
+}
+
+// enrolTOTP sets up two-factor authentication for the signed-in account
+// and returns its secret and recovery codes.
+func (a *app) enrolTOTP(username string) (string, []string) {
+	a.t.Helper()
+	expect(a.t, a.post("/api/account/totp/start", url.Values{}), http.StatusOK, "qr-code")
+	account, err := a.store.GetAccount(username)
+	if err != nil || account.TOTPSecret == "" {
+		a.t.Fatalf("no secret after start: %+v, %v", account, err)
+	}
+	expect(a.t, a.post("/api/account/totp/confirm", url.Values{"code": {"000000"}}), http.StatusBadRequest, "not right")
+	rec := a.post("/api/account/totp/confirm", url.Values{"code": {auth.TOTPCode(account.TOTPSecret, time.Now())}})
+	expect(a.t, rec, http.StatusOK, "recovery codes")
+	var codes []string
+	for _, m := range regexp.MustCompile(`<li><code class="text-mono">([a-z2-7]{5}-[a-z2-7]{5})</code>`).FindAllStringSubmatch(rec.Body.String(), -1) {
+		codes = append(codes, m[1])
+	}
+	if len(codes) != auth.RecoveryCodeCount {
+		a.t.Fatalf("got %d recovery codes, want %d", len(codes), auth.RecoveryCodeCount)
+	}
+	return account.TOTPSecret, codes
+}
+
+func TestTOTPLogin(t *testing.T) {
+	a := newApp(t, true)
+	secret, codes := a.enrolTOTP("admin")
+	a.post("/logout", url.Values{})
+
+	rec := a.post("/login", url.Values{"username": {"admin"}, "password": {testPassword}, "next": {"/nodes"}})
+	if got := rec.Header().Get("HX-Redirect"); got != "/login/2fa?next=%2Fnodes" {
+		t.Fatalf("password step: HX-Redirect = %q, want the code step", got)
+	}
+	if rec := a.get("/nodes", false); rec.Code != http.StatusFound {
+		t.Errorf("GET /nodes between steps = %d, want a redirect to sign in", rec.Code)
+	}
+	expect(t, a.get("/login/2fa?next=%2Fnodes", false), http.StatusOK, "authenticator app")
+	expect(t, a.post("/login/2fa", url.Values{"code": {"000000"}}), http.StatusUnauthorized, "Invalid code")
+
+	// The enrolment used the current step, so the app's next code is needed.
+	code := auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+	if rec := a.post("/login/2fa", url.Values{"code": {code}, "next": {"/nodes"}}); rec.Header().Get("HX-Redirect") != "/nodes" {
+		t.Fatalf("code step = %d %s", rec.Code, rec.Body)
+	}
+	expect(t, a.get("/account", false), http.StatusOK, "Recovery Codes", "10 unused")
+
+	a.post("/logout", url.Values{})
+	a.post("/login", url.Values{"username": {"admin"}, "password": {testPassword}})
+	expect(t, a.post("/login/2fa", url.Values{"code": {code}}), http.StatusUnauthorized, "Invalid code")
+	if rec := a.post("/login/2fa", url.Values{"code": {strings.ToUpper(codes[0])}}); rec.Header().Get("HX-Redirect") != "/" {
+		t.Fatalf("recovery code = %d %s", rec.Code, rec.Body)
+	}
+
+	a.post("/logout", url.Values{})
+	a.post("/login", url.Values{"username": {"admin"}, "password": {testPassword}})
+	expect(t, a.post("/login/2fa", url.Values{"code": {codes[0]}}), http.StatusUnauthorized, "Invalid code")
+	if rec := a.post("/login/2fa", url.Values{"code": {codes[1]}}); rec.Header().Get("HX-Redirect") != "/" {
+		t.Fatalf("second recovery code = %d %s", rec.Code, rec.Body)
+	}
+	expect(t, a.get("/account", false), http.StatusOK, "8 unused")
+
+	expect(t, a.post("/api/account/totp/disable", url.Values{"code": {"000000"}}), http.StatusBadRequest, "not right")
+	expect(t, a.post("/api/account/totp/disable", url.Values{"code": {codes[2]}}), http.StatusOK, "is off")
+	a.post("/logout", url.Values{})
+	if rec := a.post("/login", url.Values{"username": {"admin"}, "password": {testPassword}}); rec.Header().Get("HX-Redirect") != "/" {
+		t.Errorf("login after disabling = %d %q", rec.Code, rec.Header().Get("HX-Redirect"))
+	}
+}
+
+func TestTOTPPolicy(t *testing.T) {
+	a := newApp(t, true)
+	expect(t, a.post("/api/update-policy", url.Values{"require_totp": {"1"}}), http.StatusOK, "Set up two-factor authentication")
+	if rec := a.get("/users", false); rec.Code != http.StatusFound || rec.Header().Get("Location") != "/account" {
+		t.Errorf("admin without 2FA: GET /users = %d %q, want redirect to /account", rec.Code, rec.Header().Get("Location"))
+	}
+
+	a.login("viewer", model.RoleViewer)
+	expect(t, a.get("/users", false), http.StatusOK)
+
+	a.login("operator", model.RoleOperator)
+	expect(t, a.post("/api/users/create", url.Values{"name": {"bob"}}), http.StatusForbidden, "Set up two-factor authentication")
+	expect(t, a.get("/account", false), http.StatusOK, "required for your role")
+	_, codes := a.enrolTOTP("operator")
+	expect(t, a.post("/api/users/create", url.Values{"name": {"bob"}}), http.StatusOK, "toast-success")
+	expect(t, a.post("/api/account/totp/disable", url.Values{"code": {codes[0]}}), http.StatusForbidden, "required for your role")
+}
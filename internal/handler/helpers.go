@@ -1,8 +1,9 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
-	"headcontrol/internal/headscale"
+	"headcontrol/internal/assets"
 	"html/template"
 	"net/http"
 	"time"
@@ -10,8 +11,15 @@ import (
 
 func (h *Handler) renderPartialError(w http.ResponseWriter, msg string) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, `<div class="error-banner"><i data-lucide="x-circle"></i><span>%s</span></div>`,
-		template.HTMLEscapeString(msg))
+	icon, _ := assets.Icon("x-circle")
+	fmt.Fprintf(w, `<div class="error-banner">%s<span>%s</span></div>`,
+		icon, template.HTMLEscapeString(msg))
+}
+
+func (h *Handler) renderPartialErrorStatus(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	h.renderPartialError(w, msg)
 }
 
 func (h *Handler) renderToast(w http.ResponseWriter, msg, kind string) {
@@ -20,8 +28,43 @@ func (h *Handler) renderToast(w http.ResponseWriter, msg, kind string) {
 		kind, template.HTMLEscapeString(msg))
 }
 
-func newTempClient(url, key string) *headscale.Client {
-	return headscale.NewClient(url, key)
+func (h *Handler) renderToastStatus(w http.ResponseWriter, status int, msg, kind string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	h.renderToast(w, msg, kind)
+}
+
+// pollEvery formats d as an hx-trigger polling interval, or "" when disabled.
+func pollEvery(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("every %dms", d.Milliseconds())
+}
+
+// keyPrefix shortens a pre-auth key to enough to tell keys apart without
+// showing the secret to everyone who can view the page.
+func keyPrefix(key string) string {
+	if len(key) <= 16 {
+		return key
+	}
+	return key[:16] + "…"
+}
+
+// dict builds the data for a sub-template from key, value pairs.
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict: odd number of arguments")
+	}
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		k, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key %v is not a string", pairs[i])
+		}
+		m[k] = pairs[i+1]
+	}
+	return m, nil
 }
 
 func formatTime(s string) string {
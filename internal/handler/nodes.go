@@ -1,6 +1,11 @@
 package handler
 
 import (
+	"bytes"
+	"encoding/json"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/model"
+	"log"
 	"net/http"
 	"strings"
 )
@@ -12,17 +17,13 @@ func (h *Handler) NodesPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nodes, apiErr := client.ListNodes()
+	nodes, apiErr := client.ListNodes(r.Context())
 	if apiErr != nil {
-		h.renderPageWithError(w, r, "Nodes", "nodes", apiErr.Error())
+		h.pageError(w, r, "Nodes", "nodes", apiErr)
 		return
 	}
 
-	h.renderPage(w, r, "nodes", map[string]interface{}{
-		"Title":      "Nodes",
-		"ActivePage": "nodes",
-		"Nodes":      nodes,
-	})
+	h.renderPage(w, r, "nodes", h.nodesData(client, nodes))
 }
 
 func (h *Handler) NodesTable(w http.ResponseWriter, r *http.Request) {
@@ -32,17 +33,30 @@ func (h *Handler) NodesTable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nodes, apiErr := client.ListNodes()
+	nodes, apiErr := client.ListNodes(r.Context())
 	if apiErr != nil {
-		h.renderPartialError(w, apiErr.Error())
+		h.partialError(w, r, apiErr)
 		return
 	}
 
-	h.render(w, "nodes-content.html", map[string]interface{}{
+	h.render(w, "nodes-content.html", h.nodesData(client, nodes))
+}
+
+// nodesData marks the nodes with a pending deletion, if that can be loaded.
+func (h *Handler) nodesData(client headscale.API, nodes []model.Node) map[string]interface{} {
+	data := map[string]interface{}{
 		"Title":      "Nodes",
 		"ActivePage": "nodes",
 		"Nodes":      nodes,
-	})
+		"AsOf":       client.AsOf(),
+		"Refresh":    pollEvery(h.opts.NodesRefresh),
+	}
+	if pending, err := h.pendingTargets(model.ActionDeleteNode); err != nil {
+		log.Printf("nodes: pending deletions: %v", err)
+	} else {
+		data["Pending"] = pending
+	}
+	return data
 }
 
 func (h *Handler) NodeDetail(w http.ResponseWriter, r *http.Request) {
@@ -58,15 +72,94 @@ func (h *Handler) NodeDetail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	node, apiErr := client.GetNode(nodeID)
+	node, apiErr := client.GetNode(r.Context(), nodeID)
 	if apiErr != nil {
-		h.renderPartialError(w, apiErr.Error())
+		h.partialError(w, r, apiErr)
 		return
 	}
 
 	h.render(w, "node-detail.html", map[string]interface{}{"Node": node})
 }
 
+// NodePage shows everything Headscale reports about a node, with the
+// response itself on a second tab.
+func (h *Handler) NodePage(w http.ResponseWriter, r *http.Request) {
+	client, err := h.getClient()
+	if err != nil || client == nil {
+		h.renderPageWithError(w, r, "Node", "node", "Failed to load settings.")
+		return
+	}
+
+	node, apiErr := client.GetNode(r.Context(), r.PathValue("id"))
+	if apiErr != nil {
+		h.pageError(w, r, "Node", "node", apiErr)
+		return
+	}
+
+	raw, err := rawNode(node)
+	if err != nil {
+		log.Printf("nodes: raw JSON of %s: %v", node.ID, err)
+	}
+	data := map[string]interface{}{
+		"Title":      node.GivenName,
+		"ActivePage": "node",
+		"Node":       node,
+		"Raw":        raw,
+		// Over gRPC there is no JSON to show, only what was decoded.
+		"RawDecoded": node.Raw == nil,
+		"AsOf":       client.AsOf(),
+	}
+	if pending, err := h.pendingTargets(model.ActionDeleteNode); err != nil {
+		log.Printf("nodes: pending deletions: %v", err)
+	} else {
+		data["PendingID"] = pending[node.ID]
+	}
+	h.renderPage(w, r, "node", data)
+}
+
+// rawNode indents the node as Headscale returned it, or as decoded when
+// it came over gRPC. The secret of the pre-auth key is shortened as it is
+// everywhere else.
+func rawNode(node *model.Node) (string, error) {
+	raw := []byte(node.Raw)
+	if raw == nil {
+		n := *node
+		if n.PreAuthKey != nil {
+			k := *n.PreAuthKey
+			k.Key = keyPrefix(k.Key)
+			n.PreAuthKey = &k
+		}
+		b, err := json.MarshalIndent(n, "", "  ")
+		return string(b), err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return "", err
+	}
+	var (
+		key    map[string]json.RawMessage
+		secret string
+	)
+	if json.Unmarshal(fields["preAuthKey"], &key) == nil && json.Unmarshal(key["key"], &secret) == nil && secret != "" {
+		// Re-encoding sorts the fields, so only do it when there is a
+		// secret to shorten.
+		key["key"], _ = json.Marshal(keyPrefix(secret))
+		fields["preAuthKey"], _ = json.Marshal(key)
+		var err error
+		if raw, err = json.Marshal(fields); err != nil {
+			return "", err
+		}
+	}
+	return indentJSON(raw)
+}
+
+func indentJSON(b []byte) (string, error) {
+	var out bytes.Buffer
+	err := json.Indent(&out, b, "", "  ")
+	return out.String(), err
+}
+
 func (h *Handler) RenameNode(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", 405)
@@ -87,10 +180,12 @@ func (h *Handler) RenameNode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, apiErr := client.RenameNode(nodeID, newName); apiErr != nil {
-		h.renderToast(w, apiErr.Error(), "error")
+	node, apiErr := client.RenameNode(r.Context(), nodeID, newName)
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
 		return
 	}
+	h.auditNode(r, model.EventNodeRename, node, "")
 
 	h.renderToast(w, "Node renamed to '"+newName+"' successfully!", "success")
 }
@@ -113,10 +208,12 @@ func (h *Handler) ExpireNode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, apiErr := client.ExpireNode(nodeID); apiErr != nil {
-		h.renderToast(w, apiErr.Error(), "error")
+	node, apiErr := client.ExpireNode(r.Context(), nodeID)
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
 		return
 	}
+	h.auditNode(r, model.EventNodeExpire, node, "")
 
 	h.renderToast(w, "Node expired successfully!", "success")
 }
@@ -139,12 +236,18 @@ func (h *Handler) DeleteNode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if apiErr := client.DeleteNode(nodeID); apiErr != nil {
-		h.renderToast(w, apiErr.Error(), "error")
+	node, apiErr := client.GetNode(r.Context(), nodeID)
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
 		return
 	}
 
-	h.renderToast(w, "Node deleted successfully!", "success")
+	h.scheduleDelete(w, r, &model.PendingAction{
+		Kind:       model.ActionDeleteNode,
+		TargetID:   nodeID,
+		TargetName: node.GivenName,
+		Snapshot:   model.Snapshot{User: node.User, Nodes: []model.Node{*node}},
+	}, "nodes")
 }
 
 func (h *Handler) SetNodeTags(w http.ResponseWriter, r *http.Request) {
@@ -167,10 +270,12 @@ func (h *Handler) SetNodeTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, apiErr := client.SetNodeTags(nodeID, tags); apiErr != nil {
-		h.renderToast(w, apiErr.Error(), "error")
+	node, apiErr := client.SetNodeTags(r.Context(), nodeID, tags)
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
 		return
 	}
+	h.auditNode(r, model.EventNodeTags, node, strings.Join(node.Tags, ", "))
 
 	h.renderToast(w, "Tags updated successfully!", "success")
 }
@@ -195,10 +300,12 @@ func (h *Handler) SetNodeRoutes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, apiErr := client.SetApprovedRoutes(nodeID, routes); apiErr != nil {
-		h.renderToast(w, apiErr.Error(), "error")
+	node, apiErr := client.SetApprovedRoutes(r.Context(), nodeID, routes)
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
 		return
 	}
+	h.auditNode(r, model.EventNodeRoutes, node, strings.Join(node.ApprovedRoutes, ", "))
 
 	h.renderToast(w, "Routes approved successfully!", "success")
 }
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"headcontrol/internal/server"
+	"headcontrol/internal/store"
+	"log"
+	"net/http"
+)
+
+// OIDCLogin sends the browser to the identity provider.
+func (h *Handler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	target, err := h.opts.OIDC.Start(r.Context(), w, r, h.oidcRedirectURL(r), next)
+	if err != nil {
+		log.Printf("oidc: start: %v", err)
+		h.renderLogin(w, r, http.StatusBadGateway, next, "Could not reach the identity provider.")
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallback finishes single sign-on. The account is created on first
+// sign-in, and its username and role are refreshed from the ID token every
+// time after.
+func (h *Handler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	id, next, err := h.opts.OIDC.Finish(r.Context(), w, r, h.oidcRedirectURL(r))
+	if err != nil {
+		log.Printf("oidc: callback from %s: %v", clientIP(r), err)
+		h.renderLogin(w, r, http.StatusUnauthorized, next, "Single sign-on failed: "+err.Error())
+		return
+	}
+	if id.Role == "" {
+		log.Printf("oidc: %q (%s) is in no group with access, groups %v", id.Username, id.Subject, id.Groups)
+		h.renderLogin(w, r, http.StatusForbidden, next, "Your account "+id.Username+" is not allowed to use HeadControl.")
+		return
+	}
+	account, err := h.store.SaveOIDCAccount(id.Subject, id.Username, id.Role)
+	if store.IsDuplicate(err) {
+		h.renderLogin(w, r, http.StatusConflict, next, "The username "+id.Username+" belongs to a local account.")
+		return
+	}
+	if err != nil {
+		log.Printf("oidc: save account %q: %v", id.Username, err)
+		h.renderLogin(w, r, http.StatusInternalServerError, next, "Could not save the account.")
+		return
+	}
+	log.Printf("oidc: %q signed in as %s from %s", account.Username, account.Role, clientIP(r))
+	h.sessions.Issue(w, r, account.ID, account.SessionGen)
+	http.Redirect(w, r, h.safeNext(next), http.StatusFound)
+}
+
+func (h *Handler) oidcRedirectURL(r *http.Request) string {
+	if h.opts.OIDCRedirectURL != "" {
+		return h.opts.OIDCRedirectURL
+	}
+	return server.Scheme(r) + "://" + r.Host + h.url("/login/oidc/callback")
+}
@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"headcontrol/internal/avatar"
+	"headcontrol/internal/model"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxDisplayName is the longest display name accepted, in characters.
+const maxDisplayName = 100
+
+// withProfiles shows the profiles edited in HeadControl on users. Users
+// are returned as they are when the profiles cannot be loaded.
+func (h *Handler) withProfiles(users []model.User) []model.User {
+	profiles, err := h.store.UserProfiles()
+	if err != nil {
+		log.Printf("users: profiles: %v", err)
+		return users
+	}
+	for i := range users {
+		if p := profiles[users[i].ID]; p != nil {
+			h.applyProfile(p, &users[i])
+		}
+	}
+	return users
+}
+
+func (h *Handler) applyProfile(p *model.UserProfile, u *model.User) {
+	p.Apply(u)
+	if p.AvatarType != "" {
+		u.ProfilePicURL = h.avatarPath(p)
+	}
+}
+
+// avatarPath is where an uploaded picture is served. The upload time
+// busts browser caches when it is replaced.
+func (h *Handler) avatarPath(p *model.UserProfile) string {
+	return fmt.Sprintf("%s?v=%d", h.url("/avatars/"+url.PathEscape(p.UserID)), p.UpdatedAt.Unix())
+}
+
+// avatarSrc is the picture shown for u: its own when the page may load
+// it, otherwise the one the avatar strategy offers, or "" for initials.
+func (h *Handler) avatarSrc(u model.User) string {
+	if pic := u.ProfilePicURL; pic != "" &&
+		(strings.HasPrefix(pic, h.url("/avatars/")) || avatar.Allowed(h.opts.AvatarStrategy, pic)) {
+		return pic
+	}
+	return avatar.URL(h.opts.AvatarStrategy, u.Name, u.Email)
+}
+
+// initials is the placeholder shown when a user has no picture.
+func initials(u model.User) string {
+	name := u.DisplayName
+	if name == "" {
+		name = u.Name
+	}
+	var out []rune
+	for _, word := range strings.Fields(name) {
+		r, _ := utf8.DecodeRuneInString(word)
+		out = append(out, unicode.ToUpper(r))
+		if len(out) == 2 {
+			break
+		}
+	}
+	return string(out)
+}
+
+// UpdateProfile saves the display name, email and picture HeadControl
+// shows for a user. Headscale has no call to change them once the user
+// exists, so the edits are kept in HeadControl's database.
+func (h *Handler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	upload := h.opts.AvatarStrategy == avatar.Upload
+	if upload {
+		// Room for the other fields and the multipart framing.
+		r.Body = http.MaxBytesReader(w, r.Body, avatar.MaxUpload+64<<10)
+		if err := r.ParseMultipartForm(avatar.MaxUpload); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			h.renderToast(w, fmt.Sprintf("The picture is larger than %d KB.", avatar.MaxUpload>>10), "error")
+			return
+		}
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		h.renderToast(w, "User ID is required.", "error")
+		return
+	}
+	p := &model.UserProfile{
+		UserID:      id,
+		DisplayName: strings.TrimSpace(r.FormValue("displayName")),
+		Email:       strings.TrimSpace(r.FormValue("email")),
+		PictureURL:  strings.TrimSpace(r.FormValue("pictureUrl")),
+	}
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayName {
+		h.renderToast(w, fmt.Sprintf("Display name must be at most %d characters.", maxDisplayName), "error")
+		return
+	}
+	if p.Email != "" && !model.ValidEmail(p.Email) {
+		h.renderToast(w, "'"+p.Email+"' is not an email address.", "error")
+		return
+	}
+	if p.PictureURL != "" {
+		if u, err := url.Parse(p.PictureURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			h.renderToast(w, "Picture URL must be an https URL.", "error")
+			return
+		}
+	}
+
+	var data []byte
+	if upload {
+		if f, _, err := r.FormFile("avatar"); err == nil {
+			data, err = io.ReadAll(io.LimitReader(f, avatar.MaxUpload+1))
+			f.Close()
+			if err != nil {
+				h.renderToast(w, "Could not read the picture.", "error")
+				return
+			}
+			if len(data) > avatar.MaxUpload {
+				h.renderToast(w, fmt.Sprintf("The picture is larger than %d KB.", avatar.MaxUpload>>10), "error")
+				return
+			}
+		}
+	}
+	contentType := ""
+	if len(data) > 0 {
+		var ok bool
+		if contentType, ok = avatar.ContentType(data); !ok {
+			h.renderToast(w, "The picture must be a PNG, JPEG, GIF or WebP image.", "error")
+			return
+		}
+	}
+
+	client, err := h.getClient()
+	if err != nil || client == nil {
+		h.renderToast(w, "Failed to load settings.", "error")
+		return
+	}
+	users, apiErr := client.ListUsers(r.Context())
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
+		return
+	}
+	i := slices.IndexFunc(users, func(u model.User) bool { return u.ID == id })
+	if i < 0 {
+		h.renderToastStatus(w, http.StatusNotFound, "User not found. It may have been deleted already.", "error")
+		return
+	}
+	user := users[i]
+
+	before, err := h.store.UserProfile(id)
+	if err != nil {
+		h.renderToast(w, "Failed to load the profile.", "error")
+		return
+	}
+	if before == nil {
+		before = &model.UserProfile{DisplayName: user.DisplayName, Email: user.Email, PictureURL: user.ProfilePicURL}
+	}
+	// The content security policy only lets the page load pictures from
+	// the strategy's hosts. A URL kept from before is left alone so the
+	// other fields can still be edited.
+	if p.PictureURL != "" && p.PictureURL != before.PictureURL && !avatar.Allowed(h.opts.AvatarStrategy, p.PictureURL) {
+		h.renderToast(w, h.pictureRefused(), "error")
+		return
+	}
+	if err := h.store.SaveUserProfile(p); err != nil {
+		h.renderToast(w, "Failed to save the profile.", "error")
+		return
+	}
+	var changed []string
+	if p.DisplayName != before.DisplayName {
+		changed = append(changed, "display name")
+	}
+	if p.Email != before.Email {
+		changed = append(changed, "email")
+	}
+	if p.PictureURL != before.PictureURL {
+		changed = append(changed, "picture URL")
+	}
+	switch {
+	case contentType != "":
+		err = h.store.SetAvatar(id, contentType, data)
+		changed = append(changed, "uploaded picture")
+	case r.FormValue("removeAvatar") != "" && before.AvatarType != "":
+		err = h.store.SetAvatar(id, "", nil)
+		changed = append(changed, "removed picture")
+	}
+	if err != nil {
+		h.renderToast(w, "Failed to save the picture.", "error")
+		return
+	}
+	if len(changed) > 0 {
+		h.audit(r, model.AuditEvent{Action: model.EventUserProfile, UserID: id, Target: user.Name, Detail: strings.Join(changed, ", ")})
+	}
+
+	h.renderToast(w, "Profile of '"+user.Name+"' saved.", "success")
+}
+
+// pictureRefused explains which picture URLs the avatar strategy lets
+// the page load.
+func (h *Handler) pictureRefused() string {
+	if sources := avatar.Sources(h.opts.AvatarStrategy); len(sources) > 0 {
+		return "The page can only load pictures from " + strings.Join(sources, ", ") + "."
+	}
+	if h.opts.AvatarStrategy == avatar.Upload {
+		return "The page cannot load pictures from other sites. Upload the picture instead."
+	}
+	return "The page cannot load pictures from other sites, so leave the picture URL empty."
+}
+
+// Avatar serves a picture uploaded for a user.
+func (h *Handler) Avatar(w http.ResponseWriter, r *http.Request) {
+	data, contentType, updated, err := h.store.Avatar(r.PathValue("id"))
+	if err != nil {
+		log.Printf("avatars: %v", err)
+		http.Error(w, "Failed to load the picture", http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", updated, bytes.NewReader(data))
+}
@@ -1,8 +1,12 @@
 package handler
 
 import (
+	"fmt"
+	"headcontrol/internal/headscale"
 	"headcontrol/internal/model"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (h *Handler) SettingsPage(w http.ResponseWriter, r *http.Request) {
@@ -15,14 +19,37 @@ func (h *Handler) SettingsPage(w http.ResponseWriter, r *http.Request) {
 			BaseURL:   settings.BaseURL,
 			CreatedAt: settings.CreatedAt,
 			UpdatedAt: settings.UpdatedAt,
+
+			ReadTimeout:  min(settings.ReadTimeout, maxTimeout),
+			WriteTimeout: min(settings.WriteTimeout, maxTimeout),
+
+			Transport:   settings.Transport,
+			GRPCAddress: settings.GRPCAddress,
+			GRPCTLS:     settings.GRPCTLS,
 		}
 	}
 
-	h.renderPage(w, r, "settings", map[string]interface{}{
+	data := map[string]interface{}{
 		"Title":      "Settings",
 		"ActivePage": "settings",
 		"Settings":   masked,
-	})
+		"MaxTimeout": maxTimeout,
+
+		"KeyRejected": r.URL.Query().Get("error") == "unauthorized",
+		"Lockouts":    h.lockoutsData(),
+	}
+	if settings != nil {
+		data["GRPCDefault"] = headscale.GRPCAddress(&model.Settings{BaseURL: settings.BaseURL})
+		if ep, err := h.endpointFor(settings); err == nil {
+			data["Breaker"] = ep.Breaker.Snapshot()
+			if info, err := ep.Info(r.Context()); err == nil {
+				data["Server"] = info
+			} else {
+				data["ServerError"] = err.Error()
+			}
+		}
+	}
+	h.renderPage(w, r, "settings", data)
 }
 
 func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
@@ -31,10 +58,8 @@ func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	baseURL := r.FormValue("base_url")
-	apiKey := r.FormValue("api_key")
-
-	if baseURL == "" {
+	cfg := connectionForm(r)
+	if cfg.BaseURL == "" {
 		h.render(w, "settings-result.html", map[string]interface{}{
 			"Success": false,
 			"Message": "Base URL is required.",
@@ -42,13 +67,24 @@ func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if apiKey == "" {
+	readTimeout, readErr := parseTimeout(r.FormValue("read_timeout"), headscale.DefaultTimeouts.Read)
+	writeTimeout, writeErr := parseTimeout(r.FormValue("write_timeout"), headscale.DefaultTimeouts.Write)
+	if readErr != nil || writeErr != nil {
+		h.render(w, "settings-result.html", map[string]interface{}{
+			"Success": false,
+			"Message": fmt.Sprintf("Timeouts must be whole seconds between 1 and %d.", maxTimeout),
+		})
+		return
+	}
+	cfg.ReadTimeout, cfg.WriteTimeout = readTimeout, writeTimeout
+
+	if cfg.APIKey == "" {
 		if existing, _ := h.store.GetSettings(); existing != nil {
-			apiKey = existing.APIKey
+			cfg.APIKey = existing.APIKey
 		}
 	}
 
-	if apiKey == "" {
+	if cfg.APIKey == "" {
 		h.render(w, "settings-result.html", map[string]interface{}{
 			"Success": false,
 			"Message": "API Key is required.",
@@ -56,7 +92,15 @@ func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.store.SaveSettings(baseURL, apiKey); err != nil {
+	if err := testConnection(r.Context(), &cfg); err != nil {
+		h.render(w, "settings-result.html", map[string]interface{}{
+			"Success": false,
+			"Message": "Connection test failed, nothing was saved: " + err.Error(),
+		})
+		return
+	}
+
+	if err := h.store.SaveConnection(&cfg); err != nil {
 		h.render(w, "settings-result.html", map[string]interface{}{
 			"Success": false,
 			"Message": "Failed to save: " + err.Error(),
@@ -69,3 +113,21 @@ func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		"Message": "Settings saved successfully!",
 	})
 }
+
+// maxTimeout is headscale.MaxTimeout in the whole seconds the form uses.
+const maxTimeout = int(headscale.MaxTimeout / time.Second)
+
+// parseTimeout reads a timeout field in seconds; empty means def.
+func parseTimeout(raw string, def time.Duration) (int, error) {
+	if raw == "" {
+		return int(def.Seconds()), nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > maxTimeout {
+		return 0, fmt.Errorf("timeout %d out of range", n)
+	}
+	return n, nil
+}
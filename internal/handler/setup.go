@@ -1,13 +1,52 @@
 package handler
 
-import "net/http"
+import (
+	"context"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/model"
+	"net/http"
+)
 
 func (h *Handler) SetupPage(w http.ResponseWriter, r *http.Request) {
 	if h.store.HasSettings() {
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, h.url("/"), http.StatusFound)
 		return
 	}
-	h.renderFile(w, "templates/pages/setup.html", nil)
+	h.render(w, "setup.html", pageData(r, map[string]interface{}{}))
+}
+
+// connectionForm reads the connection fields shared by the setup and
+// settings forms, filling in the defaults for the ones left empty.
+func connectionForm(r *http.Request) model.Settings {
+	cfg := model.Settings{
+		BaseURL:      r.FormValue("base_url"),
+		APIKey:       r.FormValue("api_key"),
+		ReadTimeout:  int(headscale.DefaultTimeouts.Read.Seconds()),
+		WriteTimeout: int(headscale.DefaultTimeouts.Write.Seconds()),
+		Transport:    r.FormValue("transport"),
+		GRPCAddress:  r.FormValue("grpc_address"),
+		GRPCTLS:      r.FormValue("grpc_tls"),
+	}
+	if cfg.Transport == "" {
+		cfg.Transport = headscale.TransportREST
+	}
+	if cfg.GRPCTLS == "" {
+		cfg.GRPCTLS = headscale.GRPCTLSVerify
+	}
+	return cfg
+}
+
+// testConnection checks cfg over the transport it selects.
+func testConnection(ctx context.Context, cfg *model.Settings) error {
+	if err := headscale.ValidateTransport(cfg); err != nil {
+		return err
+	}
+	client, done, err := headscale.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return client.TestConnection(ctx)
 }
 
 func (h *Handler) TestConnection(w http.ResponseWriter, r *http.Request) {
@@ -16,10 +55,8 @@ func (h *Handler) TestConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	baseURL := r.FormValue("base_url")
-	apiKey := r.FormValue("api_key")
-
-	if baseURL == "" || apiKey == "" {
+	cfg := connectionForm(r)
+	if cfg.BaseURL == "" || cfg.APIKey == "" {
 		h.render(w, "connection-result.html", map[string]interface{}{
 			"Success": false,
 			"Message": "Both Base URL and API Key are required.",
@@ -27,7 +64,7 @@ func (h *Handler) TestConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := newTempClient(baseURL, apiKey).TestConnection(); err != nil {
+	if err := testConnection(r.Context(), &cfg); err != nil {
 		h.render(w, "connection-result.html", map[string]interface{}{
 			"Success": false,
 			"Message": err.Error(),
@@ -47,10 +84,8 @@ func (h *Handler) SaveSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	baseURL := r.FormValue("base_url")
-	apiKey := r.FormValue("api_key")
-
-	if baseURL == "" || apiKey == "" {
+	cfg := connectionForm(r)
+	if cfg.BaseURL == "" || cfg.APIKey == "" {
 		h.render(w, "connection-result.html", map[string]interface{}{
 			"Success": false,
 			"Message": "Both Base URL and API Key are required.",
@@ -58,7 +93,7 @@ func (h *Handler) SaveSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := newTempClient(baseURL, apiKey).TestConnection(); err != nil {
+	if err := testConnection(r.Context(), &cfg); err != nil {
 		h.render(w, "connection-result.html", map[string]interface{}{
 			"Success": false,
 			"Message": "Connection test failed: " + err.Error(),
@@ -66,7 +101,7 @@ func (h *Handler) SaveSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.store.SaveSettings(baseURL, apiKey); err != nil {
+	if err := h.store.SaveConnection(&cfg); err != nil {
 		h.render(w, "connection-result.html", map[string]interface{}{
 			"Success": false,
 			"Message": "Failed to save settings: " + err.Error(),
@@ -74,6 +109,6 @@ func (h *Handler) SaveSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("HX-Redirect", "/")
+	w.Header().Set("HX-Redirect", h.url("/"))
 	w.WriteHeader(200)
 }
@@ -0,0 +1,325 @@
+package handler
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"headcontrol/internal/assets"
+	"headcontrol/internal/avatar"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/model"
+	"html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// Fixture times lie well in the past so relative times render as dates.
+var (
+	fixtureAsOf  = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	fixtureCSRF  = "fixture-csrf-token"
+	fixtureNonce = "fixture-nonce"
+
+	fixtureUsers = []model.User{
+		{ID: "1", Name: "alice", DisplayName: "Alice Smith", Email: "alice@example.com", CreatedAt: "2024-03-01T10:00:00Z"},
+		{ID: "2", Name: "bob", CreatedAt: "2024-04-15T08:30:00Z"},
+	}
+
+	fixtureNodes = []model.Node{
+		{
+			ID: "1", Name: "laptop", GivenName: "laptop", User: &fixtureUsers[0],
+			IPAddresses: []string{"100.64.0.1", "fd7a:115c:a1e0::1"},
+			LastSeen:    "2024-06-01T12:00:00Z", Expiry: "2024-12-01T00:00:00Z", CreatedAt: "2024-03-02T09:00:00Z",
+			RegisterMethod: "REGISTER_METHOD_AUTH_KEY", Online: true,
+			AvailableRoutes: []string{"10.0.0.0/24", "0.0.0.0/0"}, ApprovedRoutes: []string{"10.0.0.0/24"},
+			Tags: []string{"tag:prod"},
+		},
+		{
+			ID: "2", Name: "raspberrypi", GivenName: "garage", User: &fixtureUsers[1],
+			IPAddresses: []string{"100.64.0.2"},
+			LastSeen:    "2024-05-20T18:45:00Z", Expiry: "0001-01-01T00:00:00Z", CreatedAt: "2024-04-16T07:00:00Z",
+			RegisterMethod: "REGISTER_METHOD_CLI",
+		},
+	}
+
+	fixtureAccount = &model.Account{ID: 1, Username: "admin", Role: model.RoleAdmin}
+
+	fixtureTOTPAccount = &model.Account{ID: 2, Username: "olivia", Role: model.RoleOperator, TOTPEnabled: true}
+
+	fixtureLockouts = map[string]interface{}{
+		"Now": fixtureAsOf,
+		"Lockouts": []model.LoginFailure{
+			{Key: "account:alice", Failures: 6, LastFailure: fixtureAsOf.Add(-time.Minute), LockedUntil: fixtureAsOf.Add(time.Minute)},
+			{Key: "ip:192.0.2.7", Failures: 3, LastFailure: fixtureAsOf.Add(-time.Hour)},
+		},
+	}
+
+	fixtureSettings = &model.Settings{
+		ID: 1, BaseURL: "https://headscale.example.com", CreatedAt: "2024-01-01 00:00:00", UpdatedAt: "2024-02-01 00:00:00",
+		ReadTimeout: 10, WriteTimeout: 15, Transport: headscale.TransportREST, GRPCTLS: headscale.GRPCTLSVerify,
+	}
+)
+
+func templateCases() map[string]struct {
+	name string
+	data interface{}
+} {
+	dashboard := map[string]interface{}{
+		"Title": "Dashboard", "ActivePage": "dashboard", "CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce, "Account": fixtureAccount,
+		"Stats":       model.DashboardStats{UserCount: 2, NodeCount: 2, OnlineNodes: 1, ExpiringSoon: 0},
+		"RecentNodes": fixtureNodes, "Refresh": "every 30000ms", "AsOf": fixtureAsOf,
+	}
+	users := map[string]interface{}{
+		"Title": "Users", "ActivePage": "users", "Users": fixtureUsers, "AsOf": fixtureAsOf, "CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce,
+		"Account": fixtureAccount, "NodeCounts": map[string]int{"1": 1, "2": 1}, "Pending": map[string]int64{"2": 7},
+	}
+	nodes := map[string]interface{}{
+		"Title": "Nodes", "ActivePage": "nodes", "Nodes": fixtureNodes, "Refresh": "", "AsOf": fixtureAsOf, "CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce,
+		"Account": fixtureAccount, "Pending": map[string]int64{"2": 8},
+	}
+	settings := map[string]interface{}{
+		"Title": "Settings", "ActivePage": "settings", "Settings": fixtureSettings, "MaxTimeout": 15, "CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce,
+		"Account": fixtureAccount, "Lockouts": fixtureLockouts,
+		"GRPCDefault": "headscale.example.com:50443",
+		"Breaker": headscale.BreakerSnapshot{
+			State: headscale.BreakerOpen, Failures: 5, LastError: "connection refused",
+			DownSince: fixtureAsOf, RetryAt: fixtureAsOf.Add(30 * time.Second),
+		},
+		"Server": &headscale.ServerInfo{
+			Version: headscale.Version{Major: 0, Minor: 24, Raw: "v0.24–v0.25"}, Source: "probed",
+			Adapter: "v0.24–v0.25 (routes API)", Unsupported: []string{"gRPC transport (needs v0.26 or newer)"},
+		},
+	}
+
+	return map[string]struct {
+		name string
+		data interface{}
+	}{
+		"layout-dashboard": {"layout.html", dashboard},
+		"layout-users":     {"layout.html", users},
+		"layout-nodes":     {"layout.html", nodes},
+		"layout-settings":  {"layout.html", settings},
+		"layout-error": {"layout.html", map[string]interface{}{
+			"Title": "Users", "ActivePage": "users", "Error": "Headscale is unreachable.", "CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce,
+		}},
+		"dashboard-content": {"dashboard-content.html", dashboard},
+		"users-content":     {"users-content.html", users},
+		"user-content": {"user-content.html", map[string]interface{}{
+			"Title": "alice", "ActivePage": "user", "User": fixtureUsers[0], "Nodes": fixtureNodes[:1], "AsOf": fixtureAsOf,
+			"Keys": []model.PreAuthKey{
+				{ID: "4", User: "alice", Key: "hskey-auth-abcdef123456-secretsecretsecret", Reusable: true, Expiration: "2025-06-01T00:00:00Z", CreatedAt: "2024-03-01T10:05:00Z"},
+				{ID: "5", User: "alice", Key: "0123456789abcdef0123456789abcdef", Used: true, Expiration: "2024-04-01T00:00:00Z", CreatedAt: "2024-03-01T10:06:00Z"},
+			},
+			"Events": []model.AuditEvent{
+				{ID: 2, At: fixtureAsOf, Actor: "admin", Action: model.EventNodeTags, UserID: "1", NodeID: "1", Target: "laptop", Detail: "tag:prod"},
+				{ID: 1, At: fixtureAsOf.Add(-time.Hour), Actor: "admin", Action: model.EventUserCreate, UserID: "1", Target: "alice"},
+			},
+		}},
+		"user-profile": {"user-content.html", map[string]interface{}{
+			"Title": "bob", "ActivePage": "user", "AsOf": fixtureAsOf, "AvatarUpload": true,
+			"User":    model.User{ID: "2", Name: "bob", DisplayName: "Bob Jones", Email: "bob@example.com", ProfilePicURL: "/avatars/2?v=1735787045", CreatedAt: "2024-04-15T08:30:00Z"},
+			"Profile": &model.UserProfile{UserID: "2", DisplayName: "Bob Jones", Email: "bob@example.com", AvatarType: "image/png", UpdatedAt: fixtureAsOf},
+		}},
+		"user-pending": {"user-content.html", map[string]interface{}{
+			"Title": "bob", "ActivePage": "user", "User": fixtureUsers[1], "AsOf": fixtureAsOf, "PendingID": int64(7),
+			"KeysError": "Headscale is unavailable",
+		}},
+		"users-empty": {"users-content.html", map[string]interface{}{
+			"Title": "Users", "ActivePage": "users", "Users": []model.User{},
+		}},
+		"nodes-content": {"nodes-content.html", nodes},
+		"nodes-empty": {"nodes-content.html", map[string]interface{}{
+			"Title": "Nodes", "ActivePage": "nodes", "Nodes": []model.Node{},
+		}},
+		"settings-content": {"settings-content.html", settings},
+		"settings-key-rejected": {"settings-content.html", map[string]interface{}{
+			"Title": "Settings", "ActivePage": "settings", "Settings": fixtureSettings, "MaxTimeout": 15,
+			"KeyRejected": true, "ServerError": "API key rejected",
+		}},
+		"setup": {"setup.html", map[string]interface{}{"CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce}},
+		"login": {"login.html", map[string]interface{}{
+			"CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce, "Next": "/nodes", "MinPassword": 12,
+			"PasswordLogin": true, "OIDCName": "Example ID",
+		}},
+		"login-no-accounts": {"login.html", map[string]interface{}{
+			"CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce, "NoAccounts": true, "MinPassword": 12,
+			"PasswordLogin": true,
+		}},
+		"login-sso-only": {"login.html", map[string]interface{}{
+			"CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce, "OIDCName": "Example ID",
+			"Error": "Your account dave is not allowed to use HeadControl.",
+		}},
+		"login-totp": {"login.html", map[string]interface{}{
+			"CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce, "TOTP": true, "Next": "/nodes",
+		}},
+		"layout-account": {"layout.html", map[string]interface{}{
+			"Title": "Account", "ActivePage": "account", "CSRFToken": fixtureCSRF, "CSPNonce": fixtureNonce,
+			"Account": fixtureAccount, "Required": true,
+		}},
+		"totp-enrolling": {"totp-section.html", map[string]interface{}{
+			"Account": fixtureAccount, "Enrolling": true, "Secret": "JBSWY3DPEHPK3PXP",
+			"QRCode": template.HTML(`<svg class="qr-code"></svg>`), "Error": "That code is not right.",
+		}},
+		"totp-enabled": {"totp-section.html", map[string]interface{}{
+			"Account": fixtureTOTPAccount, "Required": true, "Remaining": 2,
+		}},
+		"totp-recovery-codes": {"totp-section.html", map[string]interface{}{
+			"Account": fixtureTOTPAccount, "Remaining": 2, "RecoveryCodes": []string{"abcde-fghij", "klmno-pqrst"},
+		}},
+		"totp-sso": {"totp-section.html", map[string]interface{}{
+			"Account": &model.Account{ID: 3, Username: "carol", Role: model.RoleAdmin, Subject: "u-1"},
+		}},
+		"pending-toast": {"pending-toast.html", map[string]interface{}{
+			"Action":  &model.PendingAction{ID: 7, Kind: model.ActionDeleteUser, TargetID: "2", TargetName: "bob"},
+			"Message": "'bob' will be deleted in 10 seconds.", "Timeout": 10000, "Refresh": "users",
+		}},
+		"delete-user-plan": {"delete-user-plan.html", map[string]interface{}{
+			"User": fixtureUsers[0], "Nodes": fixtureNodes[:1], "Others": fixtureUsers[1:],
+		}},
+		"delete-user-plan-empty": {"delete-user-plan.html", map[string]interface{}{"User": fixtureUsers[1]}},
+		"delete-progress": {"delete-progress.html", map[string]interface{}{
+			"Action": &model.PendingAction{ID: 8, Kind: model.ActionDeleteUser, TargetID: "1", TargetName: "alice", Status: model.ActionFailed,
+				Steps: []model.PlanStep{
+					{Op: model.StepMove, NodeID: "1", NodeName: "laptop", UserID: "2", UserName: "bob", Status: model.StepDone},
+					{Op: model.StepDelete, NodeID: "3", NodeName: "phone", Status: model.StepFailed, Error: "node 3 not found"},
+					{Op: model.StepDeleteUser, UserID: "1", UserName: "alice", Status: model.StepSkipped},
+				}},
+			"Message": "The plan stopped at a failed step and 'alice' was not deleted. Steps after it did not run.",
+		}},
+		"delete-progress-pending": {"delete-progress.html", map[string]interface{}{
+			"Action": &model.PendingAction{ID: 9, Kind: model.ActionDeleteUser, TargetID: "2", TargetName: "bob", Status: model.ActionPending,
+				Steps: []model.PlanStep{{Op: model.StepDeleteUser, UserID: "2", UserName: "bob"}}},
+			"Message": "'bob' will be deleted in 10 seconds.", "Poll": "every 1000ms",
+		}},
+		"lockouts":       {"lockouts.html", fixtureLockouts},
+		"lockouts-empty": {"lockouts.html", map[string]interface{}{"Now": fixtureAsOf}},
+		"node-detail":    {"node-detail.html", map[string]interface{}{"Node": &fixtureNodes[0]}},
+		"node-content": {"node-content.html", map[string]interface{}{
+			"Title": "nas", "ActivePage": "node", "AsOf": fixtureAsOf,
+			"Node": &model.Node{
+				ID: "3", Name: "nas", GivenName: "nas", User: &fixtureUsers[0], IPAddresses: []string{"100.64.0.3"},
+				LastSeen: "2024-06-01T12:00:00Z", Expiry: "0001-01-01T00:00:00Z", CreatedAt: "2024-03-03T09:00:00Z",
+				RegisterMethod: "REGISTER_METHOD_AUTH_KEY", Online: true,
+				AvailableRoutes: []string{"192.168.1.0/24"}, ApprovedRoutes: []string{"192.168.1.0/24"}, SubnetRoutes: []string{"192.168.1.0/24"},
+				Tags: []string{"tag:storage", "tag:home"}, ForcedTags: []string{"tag:storage"}, ValidTags: []string{"tag:home"}, InvalidTags: []string{"tag:admin"},
+				MachineKey: "mkey:1f2e3d4c5b6a", NodeKey: "nodekey:a1b2c3d4e5f6", DiscoKey: "discokey:0a1b2c3d4e5f",
+				PreAuthKey: &model.PreAuthKey{ID: "4", User: "alice", Key: "hskey-auth-abcdef123456-secretsecretsecret", Reusable: true, Used: true,
+					Expiration: "2025-06-01T00:00:00Z", CreatedAt: "2024-03-01T10:05:00Z", ACLTags: []string{"tag:storage"}},
+			},
+			"Raw": "{\n  \"id\": \"3\",\n  \"machineKey\": \"mkey:1f2e3d4c5b6a\"\n}",
+		}},
+		"node-decoded": {"node-content.html", map[string]interface{}{
+			"Title": "garage", "ActivePage": "node", "AsOf": fixtureAsOf, "Node": &fixtureNodes[1], "PendingID": int64(8),
+			"Raw": "{\n  \"id\": \"2\"\n}", "RawDecoded": true,
+		}},
+		"connection-result-ok":   {"connection-result.html", map[string]interface{}{"Success": true, "Message": "Connection successful!"}},
+		"connection-result-fail": {"connection-result.html", map[string]interface{}{"Success": false, "Message": "authentication failed"}},
+		"settings-result-ok":     {"settings-result.html", map[string]interface{}{"Success": true, "Message": "Settings saved."}},
+		"settings-result-fail":   {"settings-result.html", map[string]interface{}{"Success": false, "Message": "Invalid URL."}},
+	}
+}
+
+func newTemplateHandler(t *testing.T, templates fstest.MapFS) (*Handler, error) {
+	t.Helper()
+	// Dev mode keeps asset URLs free of content hashes.
+	static, err := assets.New(os.DirFS("../../static"), "/static", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Templates: os.DirFS("../../templates"), Static: static, AvatarStrategy: avatar.Gravatar}
+	if templates != nil {
+		opts.Templates = templates
+	}
+	return New(nil, opts)
+}
+
+func TestTemplatesGolden(t *testing.T) {
+	h, err := newTemplateHandler(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for golden, tc := range templateCases() {
+		t.Run(golden, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := h.templates.ExecuteTemplate(&buf, tc.name, tc.data); err != nil {
+				t.Fatalf("execute %s: %v", tc.name, err)
+			}
+			path := filepath.Join("testdata", "golden", golden+".html")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run go test ./internal/handler -run TestTemplatesGolden -update)", err)
+			}
+			if got := buf.Bytes(); !bytes.Equal(got, want) {
+				t.Errorf("%s differs from %s at %s\nrun go test ./internal/handler -run TestTemplatesGolden -update if the change is intended",
+					tc.name, path, firstDiff(string(got), string(want)))
+			}
+		})
+	}
+}
+
+// inlineCode matches what the Content-Security-Policy refuses to run:
+// event handler and style attributes, hx-on and scripts without the nonce.
+var inlineCode = regexp.MustCompile(`\s(on[a-z]+|style|hx-on[:\w-]*)=|<script(>| src)`)
+
+func TestTemplatesCSPClean(t *testing.T) {
+	h, err := newTemplateHandler(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for golden, tc := range templateCases() {
+		var buf bytes.Buffer
+		if err := h.templates.ExecuteTemplate(&buf, tc.name, tc.data); err != nil {
+			t.Fatalf("execute %s: %v", tc.name, err)
+		}
+		for i, line := range strings.Split(buf.String(), "\n") {
+			if inlineCode.MatchString(line) {
+				t.Errorf("%s line %d would be blocked by the CSP: %s", golden, i+1, strings.TrimSpace(line))
+			}
+		}
+	}
+}
+
+// firstDiff describes the first line where got and want disagree.
+func firstDiff(got, want string) string {
+	g, w := strings.Split(got, "\n"), strings.Split(want, "\n")
+	for i := 0; i < len(g) || i < len(w); i++ {
+		var gl, wl string
+		if i < len(g) {
+			gl = g[i]
+		}
+		if i < len(w) {
+			wl = w[i]
+		}
+		if gl != wl {
+			return fmt.Sprintf("line %d:\n  got:  %s\n  want: %s", i+1, strings.TrimSpace(gl), strings.TrimSpace(wl))
+		}
+	}
+	return "trailing bytes"
+}
+
+func TestNewFailsOnParseError(t *testing.T) {
+	_, err := newTemplateHandler(t, fstest.MapFS{
+		"layout/layout.html": {Data: []byte(`{{define "layout.html"}}ok{{end}}`)},
+		"pages/broken.html":  {Data: []byte(`{{define "broken.html"}}{{if .X}}unclosed{{end}}`)},
+		"partials/ok.html":   {Data: []byte(`{{define "ok.html"}}ok{{end}}`)},
+	})
+	if err == nil || !strings.Contains(err.Error(), "parse pages templates") {
+		t.Errorf("New = %v, want a parse error for the pages templates", err)
+	}
+}
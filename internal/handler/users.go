@@ -1,7 +1,16 @@
 package handler
 
 import (
+	"context"
+	"fmt"
+	"headcontrol/internal/avatar"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/model"
+	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 )
 
 func (h *Handler) UsersPage(w http.ResponseWriter, r *http.Request) {
@@ -11,17 +20,13 @@ func (h *Handler) UsersPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, apiErr := client.ListUsers()
+	users, apiErr := client.ListUsers(r.Context())
 	if apiErr != nil {
-		h.renderPageWithError(w, r, "Users", "users", apiErr.Error())
+		h.pageError(w, r, "Users", "users", apiErr)
 		return
 	}
 
-	h.renderPage(w, r, "users", map[string]interface{}{
-		"Title":      "Users",
-		"ActivePage": "users",
-		"Users":      users,
-	})
+	h.renderPage(w, r, "users", h.usersData(r.Context(), client, users))
 }
 
 func (h *Handler) UsersTable(w http.ResponseWriter, r *http.Request) {
@@ -31,17 +36,166 @@ func (h *Handler) UsersTable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, apiErr := client.ListUsers()
+	users, apiErr := client.ListUsers(r.Context())
 	if apiErr != nil {
-		h.renderPartialError(w, apiErr.Error())
+		h.partialError(w, r, apiErr)
 		return
 	}
 
-	h.render(w, "users-content.html", map[string]interface{}{
+	h.render(w, "users-content.html", h.usersData(r.Context(), client, users))
+}
+
+// usersData adds what the delete buttons need to the user list: how many
+// nodes each user owns and which deletions are pending. Either is left out
+// when it cannot be loaded; the delete handler checks again anyway.
+func (h *Handler) usersData(ctx context.Context, client headscale.API, users []model.User) map[string]interface{} {
+	data := map[string]interface{}{
 		"Title":      "Users",
 		"ActivePage": "users",
-		"Users":      users,
-	})
+		"Users":      h.withProfiles(users),
+		"AsOf":       client.AsOf(),
+	}
+	if nodes, err := client.ListNodes(ctx); err != nil {
+		log.Printf("users: count nodes: %v", err)
+	} else {
+		counts := make(map[string]int)
+		for _, n := range nodes {
+			if n.User != nil {
+				counts[n.User.ID]++
+			}
+		}
+		data["NodeCounts"] = counts
+	}
+	if pending, err := h.pendingTargets(model.ActionDeleteUser); err != nil {
+		log.Printf("users: pending deletions: %v", err)
+	} else {
+		data["Pending"] = pending
+	}
+	return data
+}
+
+// UserPage shows one user with the nodes and pre-auth keys they own and
+// the latest changes made to them through HeadControl.
+func (h *Handler) UserPage(w http.ResponseWriter, r *http.Request) {
+	client, err := h.getClient()
+	if err != nil || client == nil {
+		h.renderPageWithError(w, r, "User", "user", "Failed to load settings.")
+		return
+	}
+
+	id := r.PathValue("id")
+	users, apiErr := client.ListUsers(r.Context())
+	if apiErr != nil {
+		h.pageError(w, r, "User", "user", apiErr)
+		return
+	}
+	i := slices.IndexFunc(users, func(u model.User) bool { return u.ID == id })
+	if i < 0 {
+		h.renderPageStatus(w, r, http.StatusNotFound, "user", map[string]interface{}{
+			"Title":      "User",
+			"ActivePage": "user",
+			"Error":      "User not found. It may have been deleted already.",
+		})
+		return
+	}
+	user := users[i]
+
+	nodes, apiErr := client.ListNodes(r.Context())
+	if apiErr != nil {
+		h.pageError(w, r, "User", "user", apiErr)
+		return
+	}
+	owned := ownedNodes(nodes, id)
+
+	data := map[string]interface{}{
+		"Title":        user.Name,
+		"ActivePage":   "user",
+		"Nodes":        owned,
+		"AsOf":         client.AsOf(),
+		"AvatarUpload": h.opts.AvatarStrategy == avatar.Upload,
+	}
+	if p, err := h.store.UserProfile(id); err != nil {
+		log.Printf("users: profile of %s: %v", id, err)
+	} else if p != nil {
+		h.applyProfile(p, &user)
+		data["Profile"] = p
+	}
+	data["User"] = user
+	// The keys and the audit trail are extras; the page is still useful
+	// without them.
+	if keys, err := client.ListPreAuthKeys(r.Context(), id); err != nil {
+		log.Printf("users: pre-auth keys of %s: %v", id, err)
+		data["KeysError"] = errorMessage(err)
+	} else {
+		data["Keys"] = keys
+	}
+	nodeIDs := make([]string, len(owned))
+	for i, n := range owned {
+		nodeIDs[i] = n.ID
+	}
+	if events, err := h.store.UserAuditEvents(id, nodeIDs, userEventLimit); err != nil {
+		log.Printf("users: audit events of %s: %v", id, err)
+	} else {
+		data["Events"] = events
+	}
+	if pending, err := h.pendingTargets(model.ActionDeleteUser); err != nil {
+		log.Printf("users: pending deletions: %v", err)
+	} else {
+		data["PendingID"] = pending[id]
+	}
+	h.renderPage(w, r, "user", data)
+}
+
+// userEventLimit is how many audit events the user page shows.
+const userEventLimit = 25
+
+// ExpireUserNodes expires every node a user owns, logging them all out.
+func (h *Handler) ExpireUserNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		h.renderToast(w, "User ID is required.", "error")
+		return
+	}
+
+	client, err := h.getClient()
+	if err != nil || client == nil {
+		h.renderToast(w, "Failed to load settings.", "error")
+		return
+	}
+
+	nodes, apiErr := client.ListNodes(r.Context())
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
+		return
+	}
+	owned := ownedNodes(nodes, id)
+	if len(owned) == 0 {
+		h.renderToast(w, "This user owns no nodes.", "error")
+		return
+	}
+	for i, n := range owned {
+		node, apiErr := client.ExpireNode(r.Context(), n.ID)
+		if apiErr != nil {
+			if i == 0 {
+				h.toastError(w, r, apiErr)
+				return
+			}
+			h.renderToastStatus(w, errorStatus(apiErr), fmt.Sprintf("Expired %d of %d nodes, then '%s' failed: %s", i, len(owned), n.GivenName, errorMessage(apiErr)), "error")
+			return
+		}
+		h.auditNode(r, model.EventNodeExpire, node, "")
+	}
+
+	msg := fmt.Sprintf("Expired all %d nodes.", len(owned))
+	if len(owned) == 1 {
+		msg = "Expired the user's node."
+	}
+	h.renderToast(w, msg, "success")
 }
 
 func (h *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
@@ -55,6 +209,11 @@ func (h *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
 		h.renderToast(w, "Username is required.", "error")
 		return
 	}
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email != "" && !model.ValidEmail(email) {
+		h.renderToast(w, "'"+email+"' is not an email address.", "error")
+		return
+	}
 
 	client, err := h.getClient()
 	if err != nil || client == nil {
@@ -62,11 +221,12 @@ func (h *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, apiErr := client.CreateUser(name, r.FormValue("displayName"), r.FormValue("email"), "https://robohash.org/"+name)
+	user, apiErr := client.CreateUser(r.Context(), name, r.FormValue("displayName"), email, avatar.URL(h.opts.AvatarStrategy, name, email))
 	if apiErr != nil {
-		h.renderToast(w, apiErr.Error(), "error")
+		h.toastError(w, r, apiErr)
 		return
 	}
+	h.audit(r, model.AuditEvent{Action: model.EventUserCreate, UserID: user.ID, Target: user.Name})
 
 	h.renderToast(w, "User '"+name+"' created successfully!", "success")
 }
@@ -91,14 +251,82 @@ func (h *Handler) RenameUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, apiErr := client.RenameUser(oldID, newName); apiErr != nil {
-		h.renderToast(w, apiErr.Error(), "error")
+	user, apiErr := client.RenameUser(r.Context(), oldID, newName)
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
 		return
 	}
+	h.audit(r, model.AuditEvent{Action: model.EventUserRename, UserID: oldID, Target: user.Name})
 
 	h.renderToast(w, "User renamed to '"+newName+"' successfully!", "success")
 }
 
+// DeletePlan renders the delete form for a user: the nodes they own, each
+// with a choice of moving it to another user, expiring it or deleting it.
+func (h *Handler) DeletePlan(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		h.renderPartialError(w, "User ID is required.")
+		return
+	}
+
+	client, err := h.getClient()
+	if err != nil || client == nil {
+		h.renderPartialError(w, "Failed to load settings.")
+		return
+	}
+
+	users, apiErr := client.ListUsers(r.Context())
+	if apiErr != nil {
+		h.partialError(w, r, apiErr)
+		return
+	}
+	i := slices.IndexFunc(users, func(u model.User) bool { return u.ID == id })
+	if i < 0 {
+		h.renderStatus(w, http.StatusNotFound, "delete-user-plan.html", map[string]interface{}{"Error": "User not found. It may have been deleted already — refresh to see the current state."})
+		return
+	}
+	nodes, apiErr := client.ListNodes(r.Context())
+	if apiErr != nil {
+		h.partialError(w, r, apiErr)
+		return
+	}
+	pending, err := h.pendingTargets(model.ActionDeleteUser)
+	if err != nil {
+		log.Printf("users: pending deletions: %v", err)
+		h.renderPartialError(w, "Could not load pending deletions.")
+		return
+	}
+
+	h.render(w, "delete-user-plan.html", map[string]interface{}{
+		"User":   users[i],
+		"Nodes":  ownedNodes(nodes, id),
+		"Others": moveTargets(users, id, pending),
+	})
+}
+
+func ownedNodes(nodes []model.Node, userID string) []model.Node {
+	var owned []model.Node
+	for _, n := range nodes {
+		if n.User != nil && n.User.ID == userID {
+			owned = append(owned, n)
+		}
+	}
+	return owned
+}
+
+// moveTargets lists the users a deleted user's nodes can go to: everyone
+// else who is not being deleted too.
+func moveTargets(users []model.User, userID string, pending map[string]int64) []model.User {
+	var out []model.User
+	for _, u := range users {
+		if _, ok := pending[u.ID]; u.ID != userID && !ok {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
 func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", 405)
@@ -117,10 +345,101 @@ func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if apiErr := client.DeleteUser(id); apiErr != nil {
-		h.renderToast(w, apiErr.Error(), "error")
+	users, apiErr := client.ListUsers(r.Context())
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
+		return
+	}
+	i := slices.IndexFunc(users, func(u model.User) bool { return u.ID == id })
+	if i < 0 {
+		h.renderToastStatus(w, http.StatusNotFound, "User not found. It may have been deleted already — refresh to see the current state.", "error")
+		return
+	}
+	user := users[i]
+
+	nodes, apiErr := client.ListNodes(r.Context())
+	if apiErr != nil {
+		h.toastError(w, r, apiErr)
+		return
+	}
+	pending, err := h.pendingTargets(model.ActionDeleteUser)
+	if err != nil {
+		log.Printf("users: pending deletions: %v", err)
+		h.renderToastStatus(w, 500, "Could not schedule the deletion.", "error")
+		return
+	}
+	owned := ownedNodes(nodes, id)
+	steps, err := planDeletion(r.Form, user, owned, moveTargets(users, id, pending))
+	if err != nil {
+		h.renderToastStatus(w, http.StatusBadRequest, err.Error(), "error")
+		return
+	}
+
+	deletes := 0
+	for _, st := range steps {
+		if st.Op == model.StepDelete {
+			deletes++
+		}
+	}
+	if deletes > 0 && strings.TrimSpace(r.FormValue("confirm")) != user.Name {
+		msg := fmt.Sprintf("The plan deletes %d nodes. Type the username to confirm.", deletes)
+		if deletes == 1 {
+			msg = "The plan deletes a node. Type the username to confirm."
+		}
+		h.renderToastStatus(w, http.StatusBadRequest, msg, "error")
+		return
+	}
+
+	a := &model.PendingAction{
+		Kind:       model.ActionDeleteUser,
+		TargetID:   id,
+		TargetName: user.Name,
+		Snapshot:   model.Snapshot{User: &user, Nodes: owned},
+		Steps:      steps,
+	}
+	if !h.schedule(w, r, a) {
 		return
 	}
+	// Errors above land in the toast container; the plan's progress
+	// replaces the form in the modal instead.
+	w.Header().Set("HX-Retarget", "#delete-user-content")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	h.render(w, "delete-progress.html", h.progressData(a))
+}
 
-	h.renderToast(w, "User deleted successfully!", "success")
+// planDeletion turns the plan-<node ID> fields of the delete form into
+// steps. Moves go first and deletions last, so a failure stops the plan
+// before anything is lost. The user is deleted at the end unless a node
+// was only expired and still belongs to them.
+func planDeletion(form url.Values, user model.User, owned []model.Node, others []model.User) ([]model.PlanStep, error) {
+	var moves, expires, deletes []model.PlanStep
+	for _, n := range owned {
+		choice := form.Get("plan-" + n.ID)
+		step := model.PlanStep{NodeID: n.ID, NodeName: n.GivenName}
+		switch {
+		case choice == "":
+			return nil, fmt.Errorf("Choose what happens to '%s'.", n.GivenName)
+		case choice == model.StepExpire:
+			step.Op = model.StepExpire
+			expires = append(expires, step)
+		case choice == model.StepDelete:
+			step.Op = model.StepDelete
+			deletes = append(deletes, step)
+		case strings.HasPrefix(choice, model.StepMove+":"):
+			to := strings.TrimPrefix(choice, model.StepMove+":")
+			i := slices.IndexFunc(others, func(u model.User) bool { return u.ID == to })
+			if i < 0 {
+				return nil, fmt.Errorf("Can't move '%s' there: that user no longer exists or is being deleted.", n.GivenName)
+			}
+			step.Op, step.UserID, step.UserName = model.StepMove, others[i].ID, others[i].Name
+			moves = append(moves, step)
+		default:
+			return nil, fmt.Errorf("Unknown choice for '%s'.", n.GivenName)
+		}
+	}
+	steps := slices.Concat(moves, expires, deletes)
+	if len(expires) == 0 {
+		steps = append(steps, model.PlanStep{Op: model.StepDeleteUser, UserID: user.ID, UserName: user.Name})
+	}
+	return steps, nil
 }
@@ -0,0 +1,202 @@
+package headscale
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"headcontrol/internal/model"
+	"slices"
+)
+
+// adapter captures how a range of Headscale releases differs from the
+// current REST API. The zero adapter is the current one. Releases before
+// v0.23 call nodes machines and are not supported.
+type adapter struct {
+	name string
+	// userByName: users are addressed by name rather than ID in rename and
+	// delete, and have no display name, email or picture (v0.23).
+	userByName bool
+	// routesAPI: subnet routes live under /api/v1/routes with their own
+	// IDs instead of on the node object (before 0.26).
+	routesAPI bool
+	// ownerByName: moving a node and listing pre-auth keys name the user
+	// rather than giving its ID (before 0.26).
+	ownerByName bool
+}
+
+var (
+	adapterCurrent   = adapter{name: "v0.26+"}
+	adapterRoutesAPI = adapter{name: "v0.24–v0.25 (routes API)", routesAPI: true, ownerByName: true}
+	adapterLegacy    = adapter{name: "v0.23 (name-addressed users)", userByName: true, routesAPI: true, ownerByName: true}
+)
+
+func adapterFor(v Version) adapter {
+	switch {
+	case !v.Known() || v.AtLeast(0, 26):
+		return adapterCurrent
+	case v.AtLeast(0, 24):
+		return adapterRoutesAPI
+	default:
+		return adapterLegacy
+	}
+}
+
+func (a adapter) unsupported() []string {
+	var out []string
+	if a.userByName {
+		out = append(out, "User display name, email and profile picture")
+	}
+	if a.routesAPI {
+		out = append(out, "gRPC transport (needs v0.26 or newer)")
+	}
+	return out
+}
+
+// adapter returns the adapter for the server, falling back to the current
+// API for reads when detection is off or failed.
+func (c *Client) adapter(ctx context.Context) adapter {
+	a, _ := c.writeAdapter(ctx)
+	return a
+}
+
+// writeAdapter is adapter for calls that change state. Guessing the API of
+// a write could rename, move or delete the wrong thing, so it fails when
+// the server version could not be worked out.
+func (c *Client) writeAdapter(ctx context.Context) (adapter, error) {
+	if c.Detector == nil {
+		return adapterCurrent, nil
+	}
+	info, err := c.Detector.Info(ctx, c)
+	if err != nil {
+		if ctx.Err() != nil {
+			return adapterCurrent, err
+		}
+		return adapterCurrent, fmt.Errorf("not changing anything while the server version is unknown: %w", err)
+	}
+	return info.adapter, nil
+}
+
+// userName resolves a user ID to the name older servers address users by.
+func (c *Client) userName(ctx context.Context, id string) (string, error) {
+	users, err := c.ListUsers(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, u := range users {
+		if u.ID == id {
+			return u.Name, nil
+		}
+	}
+	return "", &APIError{Status: 404, Code: CodeNotFound, Message: fmt.Sprintf("user %s not found", id)}
+}
+
+// legacyRoute is a route from the pre-0.26 routes API.
+type legacyRoute struct {
+	ID   string `json:"id"`
+	Node struct {
+		ID string `json:"id"`
+	} `json:"node"`
+	Prefix     string `json:"prefix"`
+	Advertised bool   `json:"advertised"`
+	Enabled    bool   `json:"enabled"`
+}
+
+func (c *Client) legacyRoutes(ctx context.Context, path string) ([]legacyRoute, error) {
+	data, err := c.doGet(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Routes []legacyRoute `json:"routes"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("decode routes: %w", err)
+	}
+	return resp.Routes, nil
+}
+
+// attachRoutes fills in the route fields current servers put on nodes.
+func attachRoutes(nodes []model.Node, routes []legacyRoute) {
+	byNode := map[string]*model.Node{}
+	for i := range nodes {
+		nodes[i].ApprovedRoutes, nodes[i].AvailableRoutes = nil, nil
+		byNode[nodes[i].ID] = &nodes[i]
+	}
+	for _, r := range routes {
+		n := byNode[r.Node.ID]
+		if n == nil {
+			continue
+		}
+		if r.Advertised {
+			n.AvailableRoutes = append(n.AvailableRoutes, r.Prefix)
+		}
+		if r.Enabled {
+			n.ApprovedRoutes = append(n.ApprovedRoutes, r.Prefix)
+		}
+	}
+}
+
+// setLegacyRoutes enables exactly the given prefixes of a node through the
+// routes API.
+func (c *Client) setLegacyRoutes(ctx context.Context, nodeID string, prefixes []string) error {
+	routes, err := c.legacyRoutes(ctx, fmt.Sprintf("/api/v1/node/%s/routes", nodeID))
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		want := slices.Contains(prefixes, r.Prefix)
+		if want == r.Enabled {
+			continue
+		}
+		action := "disable"
+		if want {
+			action = "enable"
+		}
+		if _, err := c.doPost(ctx, fmt.Sprintf("/api/v1/routes/%s/%s", r.ID, action), nil); err != nil {
+			return fmt.Errorf("%s route %s: %w", action, r.Prefix, err)
+		}
+	}
+	return nil
+}
+
+// restNode is a node as any supported release encodes it. Before the tags
+// rework nodes carried forced and valid tags separately; the pre-auth key
+// changes with restPreAuthKey.
+type restNode struct {
+	model.Node
+	PreAuthKey *restPreAuthKey `json:"preAuthKey"`
+}
+
+func (n restNode) normalize() model.Node {
+	node := n.Node
+	if n.PreAuthKey != nil {
+		key := n.PreAuthKey.normalize()
+		node.PreAuthKey = &key
+	}
+	if len(node.Tags) == 0 {
+		for _, t := range append(slices.Clone(node.ForcedTags), node.ValidTags...) {
+			if !slices.Contains(node.Tags, t) {
+				node.Tags = append(node.Tags, t)
+			}
+		}
+	}
+	return node
+}
+
+// restPreAuthKey is a pre-auth key as any supported release encodes it.
+// Before 0.26 the user is a name; since then it is the user object.
+type restPreAuthKey struct {
+	model.PreAuthKey
+	User json.RawMessage `json:"user"`
+}
+
+func (k restPreAuthKey) normalize() model.PreAuthKey {
+	key := k.PreAuthKey
+	var u model.User
+	if json.Unmarshal(k.User, &u) == nil {
+		key.User = u.Name
+	} else {
+		json.Unmarshal(k.User, &key.User)
+	}
+	return key
+}
@@ -0,0 +1,233 @@
+package headscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"headcontrol/internal/model"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Transports a connection can use.
+const (
+	TransportREST = "rest"
+	TransportGRPC = "grpc"
+)
+
+// DefaultGRPCPort is Headscale's default grpc_listen_addr port.
+const DefaultGRPCPort = "50443"
+
+// API is what HeadControl needs from a Headscale server. Client speaks to
+// the REST gateway, GRPCClient to the native gRPC service.
+type API interface {
+	TestConnection(ctx context.Context) error
+
+	ListUsers(ctx context.Context) ([]model.User, error)
+	CreateUser(ctx context.Context, name, displayName, email, pictureURL string) (*model.User, error)
+	RenameUser(ctx context.Context, oldID, newName string) (*model.User, error)
+	DeleteUser(ctx context.Context, id string) error
+
+	ListNodes(ctx context.Context) ([]model.Node, error)
+	GetNode(ctx context.Context, nodeID string) (*model.Node, error)
+	RenameNode(ctx context.Context, nodeID, newName string) (*model.Node, error)
+	ExpireNode(ctx context.Context, nodeID string) (*model.Node, error)
+	DeleteNode(ctx context.Context, nodeID string) error
+	MoveNode(ctx context.Context, nodeID, userID string) (*model.Node, error)
+	SetNodeTags(ctx context.Context, nodeID string, tags []string) (*model.Node, error)
+	SetApprovedRoutes(ctx context.Context, nodeID string, routes []string) (*model.Node, error)
+
+	ListPreAuthKeys(ctx context.Context, userID string) ([]model.PreAuthKey, error)
+
+	// AsOf reports when the oldest data returned by this client so far
+	// was fetched from the server.
+	AsOf() time.Time
+}
+
+var (
+	_ API = (*Client)(nil)
+	_ API = (*GRPCClient)(nil)
+)
+
+type asOfTracker struct {
+	mu   sync.Mutex
+	asOf time.Time
+}
+
+func (t *asOfTracker) noteAsOf(at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.asOf.IsZero() || at.Before(t.asOf) {
+		t.asOf = at
+	}
+}
+
+// AsOf returns the zero time if nothing has been read yet.
+func (t *asOfTracker) AsOf() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.asOf
+}
+
+// GRPCAddress returns the gRPC target for cfg, defaulting to the REST
+// host on Headscale's default gRPC port.
+func GRPCAddress(cfg *model.Settings) string {
+	if cfg.GRPCAddress != "" {
+		return cfg.GRPCAddress
+	}
+	if u, err := url.Parse(cfg.BaseURL); err == nil && u.Hostname() != "" {
+		return net.JoinHostPort(u.Hostname(), DefaultGRPCPort)
+	}
+	return ""
+}
+
+// ValidateTransport checks the transport fields of cfg.
+func ValidateTransport(cfg *model.Settings) error {
+	switch cfg.Transport {
+	case TransportREST:
+		return nil
+	case TransportGRPC:
+	default:
+		return fmt.Errorf("unknown transport %q, use %s or %s", cfg.Transport, TransportREST, TransportGRPC)
+	}
+	switch cfg.GRPCTLS {
+	case GRPCTLSVerify, GRPCTLSSkipVerify, GRPCTLSInsecure:
+	default:
+		return fmt.Errorf("unknown gRPC TLS mode %q, use %s, %s or %s", cfg.GRPCTLS, GRPCTLSVerify, GRPCTLSSkipVerify, GRPCTLSInsecure)
+	}
+	if cfg.GRPCAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.GRPCAddress); err != nil {
+			return fmt.Errorf("gRPC address %q is not host:port", cfg.GRPCAddress)
+		}
+	}
+	if GRPCAddress(cfg) == "" {
+		return errors.New("gRPC address is required when the base URL has no host")
+	}
+	return nil
+}
+
+// Endpoint is one saved connection plus the state every request to it
+// shares: the circuit breaker, the response cache and, for gRPC, the
+// open channel. Clients are cheap and made per request.
+type Endpoint struct {
+	Breaker  *Breaker
+	Cache    *Cache
+	Detector *Detector
+
+	cfg  model.Settings
+	conn *grpc.ClientConn
+}
+
+func NewEndpoint(cfg *model.Settings, cacheTTL time.Duration) (*Endpoint, error) {
+	e := &Endpoint{
+		Breaker:  NewBreaker(),
+		Cache:    NewCache(cacheTTL),
+		Detector: NewDetector(),
+		cfg:      *cfg,
+	}
+	if cfg.Transport == TransportGRPC {
+		addr := GRPCAddress(cfg)
+		if addr == "" {
+			return nil, fmt.Errorf("no gRPC address for %q", cfg.BaseURL)
+		}
+		conn, err := DialGRPC(addr, cfg.GRPCTLS)
+		if err != nil {
+			return nil, fmt.Errorf("gRPC %s: %w", addr, err)
+		}
+		e.conn = conn
+	}
+	return e, nil
+}
+
+// Matches reports whether cfg describes the same connection, so the
+// endpoint can keep being used.
+func (e *Endpoint) Matches(cfg *model.Settings) bool {
+	a, b := e.cfg, *cfg
+	a.ID, a.CreatedAt, a.UpdatedAt = 0, "", ""
+	b.ID, b.CreatedAt, b.UpdatedAt = 0, "", ""
+	return a == b
+}
+
+// Client returns a fresh client using the endpoint's shared state.
+// Timeouts saved before MaxTimeout existed are capped to it.
+func (e *Endpoint) Client() API {
+	timeouts := Timeouts{
+		Read:  min(time.Duration(e.cfg.ReadTimeout)*time.Second, MaxTimeout),
+		Write: min(time.Duration(e.cfg.WriteTimeout)*time.Second, MaxTimeout),
+	}
+	if e.conn != nil {
+		return &GRPCClient{
+			Conn:     e.conn,
+			APIKey:   e.cfg.APIKey,
+			Timeouts: timeouts,
+			Retry:    DefaultRetryPolicy,
+			Breaker:  e.Breaker,
+			Cache:    e.Cache,
+			Detect:   e.Info,
+		}
+	}
+	return e.restClient(timeouts)
+}
+
+func (e *Endpoint) restClient(timeouts Timeouts) *Client {
+	c := NewClient(e.cfg.BaseURL, e.cfg.APIKey)
+	c.Timeouts = timeouts
+	c.Breaker = e.Breaker
+	c.Cache = e.Cache
+	c.Detector = e.Detector
+	return c
+}
+
+// Info returns the detected server version and the features it lacks.
+// Detection always goes through the REST gateway's base URL.
+func (e *Endpoint) Info(ctx context.Context) (*ServerInfo, error) {
+	c := e.restClient(Timeouts{Read: time.Duration(e.cfg.ReadTimeout) * time.Second})
+	info, err := e.Detector.Info(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if e.conn == nil || !info.adapter.routesAPI {
+		return info, nil
+	}
+	// Too old for the gRPC messages this client speaks.
+	withGRPC := *info
+	withGRPC.Unsupported = append(slices.Clip(info.Unsupported), "Every operation over gRPC: switch the transport to REST")
+	return &withGRPC, nil
+}
+
+// Retire closes the endpoint once requests that already hold one of its
+// clients have had time to finish. Every call is bounded by the timeouts
+// and the retry policy, so waiting out the longest possible call is enough.
+func (e *Endpoint) Retire() {
+	time.AfterFunc(e.drainTime(), func() { e.Close() })
+}
+
+func (e *Endpoint) drainTime() time.Duration {
+	longest := min(time.Duration(max(e.cfg.ReadTimeout, e.cfg.WriteTimeout))*time.Second, MaxTimeout)
+	if longest <= 0 {
+		longest = max(DefaultTimeouts.Read, DefaultTimeouts.Write)
+	}
+	return LongestCall(longest)
+}
+
+func (e *Endpoint) Close() error {
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	return nil
+}
+
+// Open returns a standalone client for cfg, for one-off use such as a
+// connection test or a CLI command. Call the returned func when done.
+func Open(cfg *model.Settings) (API, func(), error) {
+	e, err := NewEndpoint(cfg, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.Client(), func() { e.Close() }, nil
+}
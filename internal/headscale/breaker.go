@@ -0,0 +1,131 @@
+package headscale
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// Breaker short-circuits calls to a Headscale server that keeps failing.
+// After Threshold consecutive failures it opens and rejects calls for
+// Cooldown, then lets a single probe through; a successful probe closes it.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	downSince time.Time
+	lastErr   error
+	probing   bool
+}
+
+func NewBreaker() *Breaker {
+	return &Breaker{Threshold: 5, Cooldown: 30 * time.Second, state: BreakerClosed}
+}
+
+// UnavailableError is returned without contacting the server while the
+// breaker is open.
+type UnavailableError struct {
+	Since time.Time
+	Last  error
+}
+
+func (e *UnavailableError) Error() string {
+	msg := fmt.Sprintf("Headscale server unreachable since %s", e.Since.Format("Jan 02, 15:04:05"))
+	if e.Last != nil {
+		msg += ": " + e.Last.Error()
+	}
+	return msg
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Last
+}
+
+// Allow reports whether a call may proceed.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			return &UnavailableError{Since: b.downSince, Last: b.lastErr}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return &UnavailableError{Since: b.downSince, Last: b.lastErr}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record feeds the outcome of a call that Allow let through.
+func (b *Breaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		b.downSince = time.Time{}
+		b.lastErr = nil
+		return
+	}
+
+	if b.failures == 0 {
+		b.downSince = time.Now()
+	}
+	b.failures++
+	b.lastErr = err
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Release gives back a call that Allow let through without an outcome,
+// e.g. because the caller cancelled it.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+type BreakerSnapshot struct {
+	State     BreakerState
+	Failures  int
+	DownSince time.Time
+	RetryAt   time.Time
+	LastError string
+}
+
+func (b *Breaker) Snapshot() BreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerSnapshot{State: b.state, Failures: b.failures, DownSince: b.downSince}
+	if b.state == BreakerOpen {
+		s.RetryAt = b.openedAt.Add(b.Cooldown)
+	}
+	if b.lastErr != nil {
+		s.LastError = b.lastErr.Error()
+	}
+	return s
+}
@@ -0,0 +1,103 @@
+package headscale
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Cache keeps successful GET responses for a short TTL and coalesces
+// concurrent requests for the same path into a single call. Like Breaker it
+// is meant to be shared by every Client for one server.
+type Cache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	gen     uint64
+	entries map[string]cacheEntry
+	calls   map[string]*flight
+}
+
+type cacheEntry struct {
+	data []byte
+	at   time.Time
+}
+
+type flight struct {
+	done chan struct{}
+	data []byte
+	at   time.Time
+	err  error
+}
+
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{
+		TTL:     ttl,
+		entries: map[string]cacheEntry{},
+		calls:   map[string]*flight{},
+	}
+}
+
+type freshKey struct{}
+
+// Fresh returns a context whose reads skip cached responses, for when the
+// user asks for a refresh. Identical calls already in flight are still
+// shared, and the result is cached for everyone else.
+func Fresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshKey{}, true)
+}
+
+func wantsFresh(ctx context.Context) bool {
+	fresh, _ := ctx.Value(freshKey{}).(bool)
+	return fresh
+}
+
+// get returns the response for path and when it was fetched, calling fetch
+// only if nothing fresh is cached and no identical call is in flight.
+func (c *Cache) get(ctx context.Context, path string, fetch func(context.Context) ([]byte, error)) ([]byte, time.Time, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[path]; ok && time.Since(e.at) < c.TTL && !wantsFresh(ctx) {
+		c.mu.Unlock()
+		return e.data, e.at, nil
+	}
+	if f, ok := c.calls[path]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.data, f.at, f.err
+		case <-ctx.Done():
+			return nil, time.Time{}, ctx.Err()
+		}
+	}
+	f := &flight{done: make(chan struct{})}
+	c.calls[path] = f
+	gen := c.gen
+	c.mu.Unlock()
+
+	// Other callers may be waiting on this fetch, so it must not fail just
+	// because the first caller went away.
+	f.data, f.err = fetch(context.WithoutCancel(ctx))
+	f.at = time.Now()
+
+	c.mu.Lock()
+	if c.calls[path] == f {
+		delete(c.calls, path)
+	}
+	if f.err == nil && gen == c.gen {
+		c.entries[path] = cacheEntry{data: f.data, at: f.at}
+	}
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.data, f.at, f.err
+}
+
+// Invalidate drops every cached response. Calls already in flight finish
+// but their results are not stored.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	clear(c.entries)
+	clear(c.calls)
+}
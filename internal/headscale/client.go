@@ -2,21 +2,59 @@ package headscale
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"headcontrol/internal/model"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
+// Timeouts bound a single API call. Read applies to GET requests, Write to
+// everything that changes state on the server. Zero means no limit beyond
+// the caller's context.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+var DefaultTimeouts = Timeouts{Read: 15 * time.Second, Write: 15 * time.Second}
+
+// MaxTimeout caps the configured timeouts so that a read, retried under
+// DefaultRetryPolicy, still ends inside the dashboard's 60-second write
+// timeout and the page can report the failure.
+const MaxTimeout = 15 * time.Second
+
+// LongestCall is how long a call with timeout t may take, counting every
+// retry and the backoff between them.
+func LongestCall(t time.Duration) time.Duration {
+	p := DefaultRetryPolicy
+	return time.Duration(p.MaxAttempts) * (t + p.MaxDelay)
+}
+
 type Client struct {
 	BaseURL    string
 	APIKey     string
 	HTTPClient *http.Client
+	Timeouts   Timeouts
+	Retry      RetryPolicy
+	// Breaker is optional and usually shared between clients for the
+	// same server, since a Client is created per request.
+	Breaker *Breaker
+	// Cache is optional and shared the same way. Every call that is not a
+	// GET invalidates it.
+	Cache *Cache
+	// Detector picks the adapter for older releases. Without one the
+	// current API is assumed.
+	Detector *Detector
+
+	asOfTracker
 }
 
 func NewClient(baseURL, apiKey string) *Client {
@@ -24,15 +62,82 @@ func NewClient(baseURL, apiKey string) *Client {
 		BaseURL: strings.TrimRight(baseURL, "/"),
 		APIKey:  apiKey,
 		HTTPClient: &http.Client{
-			Timeout: 15 * time.Second,
 			Transport: &http.Transport{
 				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 			},
 		},
+		Timeouts: DefaultTimeouts,
+		Retry:    DefaultRetryPolicy,
 	}
 }
 
-func (c *Client) doRequest(method, path string, body interface{}) ([]byte, int, error) {
+// doRequest sends a request through the circuit breaker, retrying GETs
+// that fail with a transport error or a transient 5xx status.
+func (c *Client) doRequest(ctx context.Context, method, path string, body interface{}) ([]byte, int, error) {
+	if method != http.MethodGet {
+		if _, err := c.writeAdapter(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+	if c.Breaker != nil {
+		if err := c.Breaker.Allow(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	attempts := 1
+	if method == http.MethodGet && c.Retry.MaxAttempts > 1 {
+		attempts = c.Retry.MaxAttempts
+	}
+
+	var (
+		data   []byte
+		status int
+		err    error
+	)
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if serr := sleep(ctx, c.Retry.backoff(attempt)); serr != nil {
+				break
+			}
+		}
+		data, status, err = c.send(ctx, method, path, body)
+		if !isTransport(ctx, err) && !isTransientStatus(status) {
+			break
+		}
+	}
+
+	if method != http.MethodGet && c.Cache != nil {
+		c.Cache.Invalidate()
+	}
+
+	if c.Breaker != nil {
+		switch {
+		case ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded):
+			// The caller went away; this says nothing about the server.
+			c.Breaker.Release()
+		case err != nil:
+			c.Breaker.Record(err)
+		case status >= 500:
+			c.Breaker.Record(fmt.Errorf("HTTP %d", status))
+		default:
+			c.Breaker.Record(nil)
+		}
+	}
+	return data, status, err
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body interface{}) ([]byte, int, error) {
+	timeout := c.Timeouts.Write
+	if method == http.MethodGet {
+		timeout = c.Timeouts.Read
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	var reqBody io.Reader
 	if body != nil {
 		b, err := json.Marshal(body)
@@ -42,7 +147,7 @@ func (c *Client) doRequest(method, path string, body interface{}) ([]byte, int,
 		reqBody = bytes.NewReader(b)
 	}
 
-	req, err := http.NewRequest(method, c.BaseURL+path, reqBody)
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reqBody)
 	if err != nil {
 		return nil, 0, fmt.Errorf("create request: %w", err)
 	}
@@ -53,6 +158,9 @@ func (c *Client) doRequest(method, path string, body interface{}) ([]byte, int,
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, 0, fmt.Errorf("request timed out after %s: %w", timeout, err)
+		}
 		return nil, 0, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
@@ -65,8 +173,25 @@ func (c *Client) doRequest(method, path string, body interface{}) ([]byte, int,
 	return data, resp.StatusCode, nil
 }
 
-func (c *Client) doGet(path string) ([]byte, error) {
-	data, status, err := c.doRequest("GET", path, nil)
+func (c *Client) doGet(ctx context.Context, path string) ([]byte, error) {
+	if c.Cache == nil || c.Cache.TTL <= 0 {
+		data, err := c.fetch(ctx, path)
+		if err == nil {
+			c.noteAsOf(time.Now())
+		}
+		return data, err
+	}
+	data, at, err := c.Cache.get(ctx, path, func(ctx context.Context) ([]byte, error) {
+		return c.fetch(ctx, path)
+	})
+	if err == nil {
+		c.noteAsOf(at)
+	}
+	return data, err
+}
+
+func (c *Client) fetch(ctx context.Context, path string) ([]byte, error) {
+	data, status, err := c.doRequest(ctx, "GET", path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -76,8 +201,8 @@ func (c *Client) doGet(path string) ([]byte, error) {
 	return data, nil
 }
 
-func (c *Client) doPost(path string, body interface{}) ([]byte, error) {
-	data, status, err := c.doRequest("POST", path, body)
+func (c *Client) doPost(ctx context.Context, path string, body interface{}) ([]byte, error) {
+	data, status, err := c.doRequest(ctx, "POST", path, body)
 	if err != nil {
 		return nil, err
 	}
@@ -87,13 +212,13 @@ func (c *Client) doPost(path string, body interface{}) ([]byte, error) {
 	return data, nil
 }
 
-func (c *Client) doDelete(path string) error {
-	_, status, err := c.doRequest("DELETE", path, nil)
+func (c *Client) doDelete(ctx context.Context, path string) error {
+	data, status, err := c.doRequest(ctx, "DELETE", path, nil)
 	if err != nil {
 		return err
 	}
 	if status != 200 {
-		return fmt.Errorf("delete failed with status %d", status)
+		return c.parseError(data, status)
 	}
 	return nil
 }
@@ -101,13 +226,13 @@ func (c *Client) doDelete(path string) error {
 func (c *Client) parseError(data []byte, status int) error {
 	var apiErr model.ErrorResponse
 	if json.Unmarshal(data, &apiErr) == nil && apiErr.Message != "" {
-		return fmt.Errorf("API error (%d): %s", apiErr.Code, apiErr.Message)
+		return &APIError{Status: status, Code: apiErr.Code, Message: apiErr.Message}
 	}
-	return fmt.Errorf("unexpected status %d: %s", status, string(data))
+	return &APIError{Status: status, Message: strings.TrimSpace(string(data))}
 }
 
-func (c *Client) TestConnection() error {
-	data, status, err := c.doRequest("GET", "/api/v1/user", nil)
+func (c *Client) TestConnection(ctx context.Context) error {
+	data, status, err := c.doRequest(ctx, "GET", "/api/v1/user", nil)
 	if err != nil {
 		return fmt.Errorf("connection failed: %w", err)
 	}
@@ -116,10 +241,11 @@ func (c *Client) TestConnection() error {
 	log.Printf("[TestConnection] status=%d body=%q url=%s", status, body, c.BaseURL)
 
 	if status == 401 || status == 403 {
+		msg := "the API key was rejected by the server"
 		if body != "" && body != "Unauthorized" {
-			return fmt.Errorf("authentication failed (HTTP %d): %s", status, body)
+			msg = body
 		}
-		return fmt.Errorf("authentication failed (HTTP %d): the API key was rejected by the server", status)
+		return &APIError{Status: status, Code: CodeUnauthenticated, Message: fmt.Sprintf("authentication failed (HTTP %d): %s", status, msg)}
 	}
 	if status != 200 {
 		return c.parseError(data, status)
@@ -127,8 +253,8 @@ func (c *Client) TestConnection() error {
 	return nil
 }
 
-func (c *Client) ListUsers() ([]model.User, error) {
-	data, err := c.doGet("/api/v1/user")
+func (c *Client) ListUsers(ctx context.Context) ([]model.User, error) {
+	data, err := c.doGet(ctx, "/api/v1/user")
 	if err != nil {
 		return nil, err
 	}
@@ -139,8 +265,8 @@ func (c *Client) ListUsers() ([]model.User, error) {
 	return resp.Users, nil
 }
 
-func (c *Client) CreateUser(name, displayName, email, pictureURL string) (*model.User, error) {
-	data, err := c.doPost("/api/v1/user", map[string]string{
+func (c *Client) CreateUser(ctx context.Context, name, displayName, email, pictureURL string) (*model.User, error) {
+	data, err := c.doPost(ctx, "/api/v1/user", map[string]string{
 		"name":        name,
 		"displayName": displayName,
 		"email":       email,
@@ -156,8 +282,16 @@ func (c *Client) CreateUser(name, displayName, email, pictureURL string) (*model
 	return &resp.User, nil
 }
 
-func (c *Client) RenameUser(oldID, newName string) (*model.User, error) {
-	data, err := c.doPost(fmt.Sprintf("/api/v1/user/%s/rename/%s", oldID, newName), nil)
+func (c *Client) RenameUser(ctx context.Context, oldID, newName string) (*model.User, error) {
+	old := oldID
+	if c.adapter(ctx).userByName {
+		name, err := c.userName(ctx, oldID)
+		if err != nil {
+			return nil, err
+		}
+		old = name
+	}
+	data, err := c.doPost(ctx, fmt.Sprintf("/api/v1/user/%s/rename/%s", old, newName), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -168,82 +302,161 @@ func (c *Client) RenameUser(oldID, newName string) (*model.User, error) {
 	return &resp.User, nil
 }
 
-func (c *Client) DeleteUser(id string) error {
-	return c.doDelete(fmt.Sprintf("/api/v1/user/%s", id))
+func (c *Client) DeleteUser(ctx context.Context, id string) error {
+	if c.adapter(ctx).userByName {
+		name, err := c.userName(ctx, id)
+		if err != nil {
+			return err
+		}
+		id = name
+	}
+	return c.doDelete(ctx, fmt.Sprintf("/api/v1/user/%s", id))
 }
 
-func (c *Client) ListNodes() ([]model.Node, error) {
-	data, err := c.doGet("/api/v1/node")
+func (c *Client) ListNodes(ctx context.Context) ([]model.Node, error) {
+	data, err := c.doGet(ctx, "/api/v1/node")
 	if err != nil {
 		return nil, err
 	}
-	var resp model.NodesResponse
+	var resp struct {
+		Nodes []restNode `json:"nodes"`
+	}
 	if err := json.Unmarshal(data, &resp); err != nil {
 		return nil, fmt.Errorf("decode nodes: %w", err)
 	}
-	return resp.Nodes, nil
+	nodes := make([]model.Node, len(resp.Nodes))
+	for i, n := range resp.Nodes {
+		nodes[i] = n.normalize()
+	}
+	if c.adapter(ctx).routesAPI {
+		routes, err := c.legacyRoutes(ctx, "/api/v1/routes")
+		if err != nil {
+			return nil, err
+		}
+		attachRoutes(nodes, routes)
+	}
+	return nodes, nil
 }
 
-func (c *Client) GetNode(nodeID string) (*model.Node, error) {
-	data, err := c.doGet(fmt.Sprintf("/api/v1/node/%s", nodeID))
+func (c *Client) GetNode(ctx context.Context, nodeID string) (*model.Node, error) {
+	data, err := c.doGet(ctx, fmt.Sprintf("/api/v1/node/%s", nodeID))
 	if err != nil {
 		return nil, err
 	}
-	var resp model.NodeResponse
-	if err := json.Unmarshal(data, &resp); err != nil {
-		return nil, fmt.Errorf("decode node: %w", err)
+	node, err := decodeRESTNode(data)
+	if err != nil {
+		return nil, err
 	}
-	return &resp.Node, nil
+	if c.adapter(ctx).routesAPI {
+		routes, err := c.legacyRoutes(ctx, fmt.Sprintf("/api/v1/node/%s/routes", nodeID))
+		if err != nil {
+			return nil, err
+		}
+		nodes := []model.Node{*node}
+		attachRoutes(nodes, routes)
+		node = &nodes[0]
+	}
+	return node, nil
 }
 
-func (c *Client) RenameNode(nodeID, newName string) (*model.Node, error) {
-	data, err := c.doPost(fmt.Sprintf("/api/v1/node/%s/rename/%s", nodeID, newName), nil)
+func (c *Client) RenameNode(ctx context.Context, nodeID, newName string) (*model.Node, error) {
+	data, err := c.doPost(ctx, fmt.Sprintf("/api/v1/node/%s/rename/%s", nodeID, newName), nil)
 	if err != nil {
 		return nil, err
 	}
-	var resp model.NodeResponse
-	if err := json.Unmarshal(data, &resp); err != nil {
-		return nil, fmt.Errorf("decode node: %w", err)
+	return decodeRESTNode(data)
+}
+
+func (c *Client) ExpireNode(ctx context.Context, nodeID string) (*model.Node, error) {
+	data, err := c.doPost(ctx, fmt.Sprintf("/api/v1/node/%s/expire", nodeID), nil)
+	if err != nil {
+		return nil, err
 	}
-	return &resp.Node, nil
+	return decodeRESTNode(data)
 }
 
-func (c *Client) ExpireNode(nodeID string) (*model.Node, error) {
-	data, err := c.doPost(fmt.Sprintf("/api/v1/node/%s/expire", nodeID), nil)
+func (c *Client) DeleteNode(ctx context.Context, nodeID string) error {
+	return c.doDelete(ctx, fmt.Sprintf("/api/v1/node/%s", nodeID))
+}
+
+func (c *Client) MoveNode(ctx context.Context, nodeID, userID string) (*model.Node, error) {
+	path := fmt.Sprintf("/api/v1/node/%s/user", nodeID)
+	body := map[string]string{"user": userID}
+	if c.adapter(ctx).ownerByName {
+		name, err := c.userName(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		// v0.23 reads the name from the query, v0.24 and v0.25 from the body.
+		path, body["user"] = path+"?user="+url.QueryEscape(name), name
+	}
+	data, err := c.doPost(ctx, path, body)
 	if err != nil {
 		return nil, err
 	}
-	var resp model.NodeResponse
-	if err := json.Unmarshal(data, &resp); err != nil {
-		return nil, fmt.Errorf("decode node: %w", err)
+	return decodeRESTNode(data)
+}
+
+func (c *Client) SetNodeTags(ctx context.Context, nodeID string, tags []string) (*model.Node, error) {
+	data, err := c.doPost(ctx, fmt.Sprintf("/api/v1/node/%s/tags", nodeID), map[string][]string{"tags": tags})
+	if err != nil {
+		return nil, err
 	}
-	return &resp.Node, nil
+	return decodeRESTNode(data)
 }
 
-func (c *Client) DeleteNode(nodeID string) error {
-	return c.doDelete(fmt.Sprintf("/api/v1/node/%s", nodeID))
+func (c *Client) SetApprovedRoutes(ctx context.Context, nodeID string, routes []string) (*model.Node, error) {
+	if c.adapter(ctx).routesAPI {
+		if err := c.setLegacyRoutes(ctx, nodeID, routes); err != nil {
+			return nil, err
+		}
+		return c.GetNode(ctx, nodeID)
+	}
+	data, err := c.doPost(ctx, fmt.Sprintf("/api/v1/node/%s/approve_routes", nodeID), map[string][]string{"routes": routes})
+	if err != nil {
+		return nil, err
+	}
+	return decodeRESTNode(data)
 }
 
-func (c *Client) SetNodeTags(nodeID string, tags []string) (*model.Node, error) {
-	data, err := c.doPost(fmt.Sprintf("/api/v1/node/%s/tags", nodeID), map[string][]string{"tags": tags})
+func (c *Client) ListPreAuthKeys(ctx context.Context, userID string) ([]model.PreAuthKey, error) {
+	user := userID
+	if c.adapter(ctx).ownerByName {
+		name, err := c.userName(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		user = name
+	}
+	data, err := c.doGet(ctx, "/api/v1/preauthkey?user="+url.QueryEscape(user))
 	if err != nil {
 		return nil, err
 	}
-	var resp model.NodeResponse
+	var resp struct {
+		PreAuthKeys []restPreAuthKey `json:"preAuthKeys"`
+	}
 	if err := json.Unmarshal(data, &resp); err != nil {
-		return nil, fmt.Errorf("decode node: %w", err)
+		return nil, fmt.Errorf("decode pre-auth keys: %w", err)
 	}
-	return &resp.Node, nil
+	keys := make([]model.PreAuthKey, len(resp.PreAuthKeys))
+	for i, k := range resp.PreAuthKeys {
+		keys[i] = k.normalize()
+	}
+	return keys, nil
 }
 
-func (c *Client) SetApprovedRoutes(nodeID string, routes []string) (*model.Node, error) {
-	data, err := c.doPost(fmt.Sprintf("/api/v1/node/%s/approve_routes", nodeID), map[string][]string{"routes": routes})
-	if err != nil {
-		return nil, err
+func decodeRESTNode(data []byte) (*model.Node, error) {
+	var resp struct {
+		Node json.RawMessage `json:"node"`
 	}
-	var resp model.NodeResponse
 	if err := json.Unmarshal(data, &resp); err != nil {
 		return nil, fmt.Errorf("decode node: %w", err)
 	}
-	return &resp.Node, nil
+	var rn restNode
+	if err := json.Unmarshal(resp.Node, &rn); err != nil {
+		return nil, fmt.Errorf("decode node: %w", err)
+	}
+	node := rn.normalize()
+	node.Raw = resp.Node
+	return &node, nil
 }
@@ -0,0 +1,440 @@
+package headscale_test
+
+import (
+	"context"
+	"headcontrol/internal/headscale"
+	"headcontrol/internal/headscaletest"
+	"headcontrol/internal/model"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newClient(t *testing.T) (*headscaletest.Server, *headscale.Client) {
+	t.Helper()
+	hs := headscaletest.New(t)
+	c := headscale.NewClient(hs.URL, headscaletest.DefaultAPIKey)
+	c.Retry = headscale.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	return hs, c
+}
+
+func TestUsers(t *testing.T) {
+	hs, c := newClient(t)
+	ctx := context.Background()
+
+	u, err := c.CreateUser(ctx, "alice", "Alice", "alice@example.com", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if u.Name != "alice" || u.DisplayName != "Alice" {
+		t.Errorf("CreateUser = %+v", u)
+	}
+
+	if _, err := c.RenameUser(ctx, u.ID, "alicia"); err != nil {
+		t.Fatalf("RenameUser: %v", err)
+	}
+	users, err := c.ListUsers(ctx)
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if len(users) != 1 || users[0].Name != "alicia" {
+		t.Errorf("ListUsers = %+v, want alicia", users)
+	}
+
+	if err := c.DeleteUser(ctx, u.ID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if got := hs.Users(); len(got) != 0 {
+		t.Errorf("users after delete = %+v", got)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	hs, c := newClient(t)
+	ctx := context.Background()
+	hs.AddUser("bob")
+	dave := hs.AddUser("dave")
+	n := hs.AddNode("bob", model.Node{Name: "laptop", AvailableRoutes: []string{"10.0.0.0/24"}})
+
+	nodes, err := c.ListNodes(ctx)
+	if err != nil || len(nodes) != 1 || nodes[0].User.Name != "bob" {
+		t.Fatalf("ListNodes = %+v, %v", nodes, err)
+	}
+
+	if _, err := c.RenameNode(ctx, n.ID, "work"); err != nil {
+		t.Fatalf("RenameNode: %v", err)
+	}
+	if _, err := c.ExpireNode(ctx, n.ID); err != nil {
+		t.Fatalf("ExpireNode: %v", err)
+	}
+	if _, err := c.SetNodeTags(ctx, n.ID, []string{"tag:prod"}); err != nil {
+		t.Fatalf("SetNodeTags: %v", err)
+	}
+	if _, err := c.SetApprovedRoutes(ctx, n.ID, []string{"10.0.0.0/24"}); err != nil {
+		t.Fatalf("SetApprovedRoutes: %v", err)
+	}
+
+	got, err := c.GetNode(ctx, n.ID)
+	if err != nil {
+		t.Fatalf("GetNode: %v", err)
+	}
+	if got.GivenName != "work" || got.Expiry == "" ||
+		!slices.Equal(got.Tags, []string{"tag:prod"}) ||
+		!slices.Equal(got.ApprovedRoutes, []string{"10.0.0.0/24"}) {
+		t.Errorf("GetNode = %+v", got)
+	}
+
+	moved, err := c.MoveNode(ctx, n.ID, dave.ID)
+	if err != nil {
+		t.Fatalf("MoveNode: %v", err)
+	}
+	if moved.User == nil || moved.User.Name != "dave" {
+		t.Errorf("MoveNode owner = %+v, want dave", moved.User)
+	}
+	if _, err := c.MoveNode(ctx, n.ID, "999"); !headscale.IsNotFound(err) {
+		t.Errorf("MoveNode(missing user) = %v, want not found", err)
+	}
+
+	if err := c.DeleteNode(ctx, n.ID); err != nil {
+		t.Fatalf("DeleteNode: %v", err)
+	}
+	if _, ok := hs.Node(n.ID); ok {
+		t.Error("node still exists after delete")
+	}
+}
+
+func TestNodeMetadata(t *testing.T) {
+	hs, c := newClient(t)
+	ctx := context.Background()
+	hs.AddUser("gus")
+	n := hs.AddNode("gus", model.Node{
+		Name:        "nas",
+		PreAuthKey:  &model.PreAuthKey{ID: "9", User: "gus", Key: "hskey-auth-nas", Reusable: true},
+		ForcedTags:  []string{"tag:storage"},
+		ValidTags:   []string{"tag:home", "tag:storage"},
+		InvalidTags: []string{"tag:admin"},
+	})
+
+	got, err := c.GetNode(ctx, n.ID)
+	if err != nil {
+		t.Fatalf("GetNode: %v", err)
+	}
+	if got.MachineKey != n.MachineKey || got.NodeKey != n.NodeKey || got.DiscoKey != n.DiscoKey || got.MachineKey == "" {
+		t.Errorf("keys = %q %q %q, want %q %q %q", got.MachineKey, got.NodeKey, got.DiscoKey, n.MachineKey, n.NodeKey, n.DiscoKey)
+	}
+	if got.PreAuthKey == nil || got.PreAuthKey.User != "gus" || !got.PreAuthKey.Reusable {
+		t.Errorf("pre-auth key = %+v", got.PreAuthKey)
+	}
+	if !slices.Equal(got.Tags, []string{"tag:storage", "tag:home"}) || !slices.Equal(got.InvalidTags, []string{"tag:admin"}) {
+		t.Errorf("tags = %v, invalid %v", got.Tags, got.InvalidTags)
+	}
+	if !strings.Contains(string(got.Raw), `"machineKey":"mkey:`) {
+		t.Errorf("raw = %s", got.Raw)
+	}
+}
+
+func TestPreAuthKeys(t *testing.T) {
+	hs, c := newClient(t)
+	ctx := context.Background()
+	erin := hs.AddUser("erin")
+	hs.AddUser("frank")
+	hs.AddPreAuthKey("erin", headscaletest.PreAuthKey{Reusable: true})
+	hs.AddPreAuthKey("frank", headscaletest.PreAuthKey{})
+
+	keys, err := c.ListPreAuthKeys(ctx, erin.ID)
+	if err != nil {
+		t.Fatalf("ListPreAuthKeys: %v", err)
+	}
+	if len(keys) != 1 || keys[0].User != "erin" || !keys[0].Reusable || keys[0].Key == "" {
+		t.Errorf("ListPreAuthKeys = %+v, want erin's reusable key", keys)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	hs, c := newClient(t)
+	ctx := context.Background()
+	hs.AddUser("carol")
+	n := hs.AddNode("carol", model.Node{Name: "pi"})
+
+	_, err := c.GetNode(ctx, "999")
+	if !headscale.IsNotFound(err) {
+		t.Errorf("GetNode(missing) = %v, want not found", err)
+	}
+	if err := c.DeleteNode(ctx, "999"); !headscale.IsNotFound(err) {
+		t.Errorf("DeleteNode(missing) = %v, want not found", err)
+	}
+	if _, err := c.CreateUser(ctx, "carol", "", "", ""); !headscale.IsConflict(err) {
+		t.Errorf("CreateUser(duplicate) = %v, want conflict", err)
+	}
+	if _, err := c.SetNodeTags(ctx, n.ID, []string{"prod"}); !headscale.IsInvalid(err) {
+		t.Errorf("SetNodeTags(bad tag) = %v, want invalid", err)
+	}
+
+	hs.RevokeKey()
+	if _, err := c.ListUsers(ctx); !headscale.IsUnauthorized(err) {
+		t.Errorf("ListUsers(revoked) = %v, want unauthorized", err)
+	}
+	if err := c.TestConnection(ctx); !headscale.IsUnauthorized(err) {
+		t.Errorf("TestConnection(revoked) = %v, want unauthorized", err)
+	}
+}
+
+func TestRetriesOnlyReads(t *testing.T) {
+	hs, c := newClient(t)
+	ctx := context.Background()
+
+	hs.Fail(http.StatusServiceUnavailable, http.StatusBadGateway)
+	if _, err := c.ListUsers(ctx); err != nil {
+		t.Fatalf("ListUsers after two transient failures: %v", err)
+	}
+	if n := len(hs.Requests()); n != 3 {
+		t.Errorf("requests = %d, want 3", n)
+	}
+
+	hs.ResetRequests()
+	hs.Fail(http.StatusServiceUnavailable)
+	if _, err := c.CreateUser(ctx, "dave", "", "", ""); err == nil {
+		t.Fatal("CreateUser succeeded, want the injected failure")
+	}
+	if n := len(hs.Requests()); n != 1 {
+		t.Errorf("write was sent %d times, want 1", n)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	hs, c := newClient(t)
+	c.Retry = headscale.RetryPolicy{}
+	c.Timeouts = headscale.Timeouts{Read: 20 * time.Millisecond}
+	hs.SetLatency(200 * time.Millisecond)
+
+	_, err := c.ListUsers(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "timed out after 20ms") {
+		t.Errorf("ListUsers = %v, want a timeout", err)
+	}
+}
+
+func TestBreakerOpens(t *testing.T) {
+	hs, c := newClient(t)
+	c.Retry = headscale.RetryPolicy{}
+	c.Breaker = &headscale.Breaker{Threshold: 2, Cooldown: time.Hour}
+	ctx := context.Background()
+
+	hs.Fail(http.StatusInternalServerError, http.StatusInternalServerError)
+	for range 2 {
+		if _, err := c.ListUsers(ctx); err == nil {
+			t.Fatal("ListUsers succeeded, want the injected failure")
+		}
+	}
+
+	hs.ResetRequests()
+	_, err := c.ListUsers(ctx)
+	if !headscale.IsUnavailable(err) {
+		t.Errorf("ListUsers with open breaker = %v, want unavailable", err)
+	}
+	if n := len(hs.Requests()); n != 0 {
+		t.Errorf("open breaker let %d requests through", n)
+	}
+}
+
+func TestCache(t *testing.T) {
+	hs, c := newClient(t)
+	c.Cache = headscale.NewCache(time.Minute)
+	ctx := context.Background()
+	hs.AddUser("erin")
+	hs.SetLatency(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.ListUsers(ctx); err != nil {
+				t.Errorf("ListUsers: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(hs.Requests()); n != 1 {
+		t.Errorf("concurrent reads made %d requests, want 1", n)
+	}
+	if c.AsOf().IsZero() {
+		t.Error("AsOf is zero after a read")
+	}
+
+	hs.SetLatency(0)
+	if _, err := c.CreateUser(ctx, "frank", "", "", ""); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	users, err := c.ListUsers(ctx)
+	if err != nil || len(users) != 2 {
+		t.Errorf("ListUsers after write = %+v, %v; want the cache invalidated", users, err)
+	}
+
+	// Changes made elsewhere show up on an explicit refresh.
+	hs.AddUser("gina")
+	if users, _ := c.ListUsers(ctx); len(users) != 2 {
+		t.Errorf("ListUsers within the TTL = %d users, want the cached 2", len(users))
+	}
+	if users, _ := c.ListUsers(headscale.Fresh(ctx)); len(users) != 3 {
+		t.Errorf("fresh ListUsers = %d users, want 3", len(users))
+	}
+	if users, _ := c.ListUsers(ctx); len(users) != 3 {
+		t.Errorf("ListUsers after a fresh read = %d users, want the refreshed 3", len(users))
+	}
+}
+
+func newEndpoint(t *testing.T, hs *headscaletest.Server) *headscale.Endpoint {
+	t.Helper()
+	ep, err := headscale.NewEndpoint(&model.Settings{BaseURL: hs.URL, APIKey: headscaletest.DefaultAPIKey}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ep
+}
+
+func TestVersionDetection(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		reported    string
+		release     headscaletest.Release
+		label       string
+		adapter     string
+		unsupported int
+	}{
+		{"reported", "v0.26.1", headscaletest.Release026, "v0.26.1", "v0.26+", 0},
+		{"reported old", "v0.24.0", headscaletest.Release024, "v0.24.0", "v0.24–v0.25 (routes API)", 1},
+		{"probed current", "", headscaletest.Release026, "v0.26 or newer", "v0.26+", 0},
+		{"probed routes API", "", headscaletest.Release024, "v0.24–v0.25", "v0.24–v0.25 (routes API)", 1},
+		{"probed name-addressed users", "", headscaletest.Release023, "v0.23", "v0.23 (name-addressed users)", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := headscaletest.New(t)
+			hs.SetRelease(tc.release)
+			hs.SetVersion(tc.reported)
+			info, err := newEndpoint(t, hs).Info(context.Background())
+			if err != nil {
+				t.Fatalf("Info: %v", err)
+			}
+			if info.Label() != tc.label || info.Adapter != tc.adapter || len(info.Unsupported) != tc.unsupported {
+				t.Errorf("Info = %s %q %v, want %s %q with %d unsupported", info.Label(), info.Adapter, info.Unsupported, tc.label, tc.adapter, tc.unsupported)
+			}
+		})
+	}
+}
+
+// TestOlderReleases runs every call against the API shape of each
+// supported release line.
+func TestOlderReleases(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		release headscaletest.Release
+	}{
+		{"v0.26", headscaletest.Release026},
+		{"v0.24", headscaletest.Release024},
+		{"v0.23", headscaletest.Release023},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := headscaletest.New(t)
+			hs.SetRelease(tc.release)
+			c := newEndpoint(t, hs).Client()
+			ctx := context.Background()
+
+			u, err := c.CreateUser(ctx, "alice", "Alice", "", "")
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			if _, err := c.RenameUser(ctx, u.ID, "alicia"); err != nil {
+				t.Fatalf("RenameUser: %v", err)
+			}
+			bob := hs.AddUser("bob")
+			n := hs.AddNode("alicia", model.Node{Name: "router", AvailableRoutes: []string{"10.0.0.0/24", "10.1.0.0/24"}})
+			hs.AddPreAuthKey("alicia", headscaletest.PreAuthKey{Reusable: true})
+			hs.AddPreAuthKey("bob", headscaletest.PreAuthKey{})
+
+			nodes, err := c.ListNodes(ctx)
+			if err != nil || len(nodes) != 1 || !slices.Equal(nodes[0].AvailableRoutes, n.AvailableRoutes) {
+				t.Fatalf("ListNodes = %+v, %v", nodes, err)
+			}
+			if _, err := c.SetApprovedRoutes(ctx, n.ID, []string{"10.1.0.0/24"}); err != nil {
+				t.Fatalf("SetApprovedRoutes: %v", err)
+			}
+			if _, err := c.SetNodeTags(ctx, n.ID, []string{"tag:router"}); err != nil {
+				t.Fatalf("SetNodeTags: %v", err)
+			}
+			got, err := c.GetNode(ctx, n.ID)
+			if err != nil {
+				t.Fatalf("GetNode: %v", err)
+			}
+			if !slices.Equal(got.ApprovedRoutes, []string{"10.1.0.0/24"}) || !slices.Equal(got.Tags, []string{"tag:router"}) || got.User.Name != "alicia" {
+				t.Errorf("GetNode = routes %v tags %v owner %+v", got.ApprovedRoutes, got.Tags, got.User)
+			}
+
+			keys, err := c.ListPreAuthKeys(ctx, u.ID)
+			if err != nil || len(keys) != 1 || keys[0].User != "alicia" || !keys[0].Reusable {
+				t.Errorf("ListPreAuthKeys = %+v, %v; want alicia's reusable key", keys, err)
+			}
+
+			moved, err := c.MoveNode(ctx, n.ID, bob.ID)
+			if err != nil || moved.User == nil || moved.User.Name != "bob" {
+				t.Fatalf("MoveNode = %+v, %v; want bob", moved, err)
+			}
+			if err := c.DeleteUser(ctx, u.ID); err != nil {
+				t.Fatalf("DeleteUser: %v", err)
+			}
+			if users := hs.Users(); len(users) != 1 || users[0].Name != "bob" {
+				t.Errorf("users after delete = %+v", users)
+			}
+		})
+	}
+}
+
+func TestDetectionOutlivesCallers(t *testing.T) {
+	hs := headscaletest.New(t)
+	ep := newEndpoint(t, hs)
+	hs.SetLatency(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := ep.Info(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Info with a short deadline = %v, want its deadline error", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if info, err := ep.Info(context.Background()); err != nil || info.Label() != "v0.26.1" {
+				t.Errorf("Info = %v, %v; the earlier deadline must not be remembered", info, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(hs.Requests()); n != 1 {
+		t.Errorf("detection sent %d requests, want 1 shared by every caller", n)
+	}
+}
+
+func TestWritesNeedAKnownVersion(t *testing.T) {
+	hs := headscaletest.New(t)
+	hs.SetVersion("")
+	hs.AddUser("alice")
+	c := newEndpoint(t, hs).Client()
+	ctx := context.Background()
+
+	hs.Fail(http.StatusBadGateway, http.StatusBadGateway)
+	if _, err := c.CreateUser(ctx, "bob", "", "", ""); err == nil || !strings.Contains(err.Error(), "version is unknown") {
+		t.Errorf("CreateUser with detection failing = %v, want a refusal", err)
+	}
+	if users, err := c.ListUsers(ctx); err != nil || len(users) != 1 {
+		t.Errorf("ListUsers = %v, %v; reads should still work", users, err)
+	}
+	for _, r := range hs.Requests() {
+		if strings.HasPrefix(r, "POST") {
+			t.Errorf("refused write still sent %s", r)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package headscale
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// gRPC status codes used by Headscale's REST gateway in error bodies.
+const (
+	CodeInvalidArgument    = 3
+	CodeNotFound           = 5
+	CodeAlreadyExists      = 6
+	CodePermissionDenied   = 7
+	CodeFailedPrecondition = 9
+	CodeUnauthenticated    = 16
+)
+
+// APIError is a non-200 response from the Headscale API.
+type APIError struct {
+	Status  int
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status %d", e.Status)
+	}
+	if e.Code != 0 {
+		return fmt.Sprintf("API error (%d): %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("unexpected status %d: %s", e.Status, e.Message)
+}
+
+func asAPIError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+func IsNotFound(err error) bool {
+	e, ok := asAPIError(err)
+	return ok && (e.Status == http.StatusNotFound || e.Code == CodeNotFound)
+}
+
+func IsUnauthorized(err error) bool {
+	e, ok := asAPIError(err)
+	return ok && (e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden ||
+		e.Code == CodeUnauthenticated || e.Code == CodePermissionDenied)
+}
+
+func IsConflict(err error) bool {
+	e, ok := asAPIError(err)
+	return ok && (e.Status == http.StatusConflict || e.Code == CodeAlreadyExists || e.Code == CodeFailedPrecondition)
+}
+
+func IsInvalid(err error) bool {
+	e, ok := asAPIError(err)
+	return ok && (e.Status == http.StatusBadRequest || e.Code == CodeInvalidArgument)
+}
+
+// IsUnavailable reports whether the call was rejected by an open circuit
+// breaker without reaching the server.
+func IsUnavailable(err error) bool {
+	var u *UnavailableError
+	return errors.As(err, &u)
+}
@@ -0,0 +1,369 @@
+package headscale
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"headcontrol/internal/model"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TLS modes for the gRPC transport.
+const (
+	GRPCTLSVerify     = "verify"
+	GRPCTLSSkipVerify = "skip-verify"
+	GRPCTLSInsecure   = "insecure"
+)
+
+const grpcService = "/headscale.v1.HeadscaleService/"
+
+// DialGRPC opens a lazily connected gRPC channel to a Headscale server's
+// grpc_listen_addr.
+func DialGRPC(addr, tlsMode string) (*grpc.ClientConn, error) {
+	var creds credentials.TransportCredentials
+	switch tlsMode {
+	case GRPCTLSVerify, "":
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	case GRPCTLSSkipVerify:
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	case GRPCTLSInsecure:
+		creds = insecure.NewCredentials()
+	default:
+		return nil, fmt.Errorf("unknown gRPC TLS mode %q", tlsMode)
+	}
+	return grpc.NewClient(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(protoCodec{})),
+	)
+}
+
+// GRPCClient implements API over Headscale's native gRPC service. The
+// connection is owned by the caller and usually shared, like Breaker and
+// Cache.
+type GRPCClient struct {
+	Conn     *grpc.ClientConn
+	APIKey   string
+	Timeouts Timeouts
+	Retry    RetryPolicy
+	Breaker  *Breaker
+	Cache    *Cache
+	// Detect is optional and reports the server release. With it, writes
+	// are refused unless the server is known to speak these messages.
+	Detect func(context.Context) (*ServerInfo, error)
+
+	asOfTracker
+}
+
+func (c *GRPCClient) invoke(ctx context.Context, method string, req *request, write bool) ([]byte, error) {
+	if write && c.Detect != nil {
+		info, err := c.Detect(ctx)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return nil, err
+		case err != nil:
+			return nil, fmt.Errorf("not changing anything while the server version is unknown: %w", err)
+		case info.adapter.routesAPI:
+			return nil, fmt.Errorf("not changing anything over gRPC on Headscale %s: it needs v0.26 or newer, switch the transport to REST", info.Label())
+		}
+	}
+	if c.Breaker != nil {
+		if err := c.Breaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	attempts := 1
+	if !write && c.Retry.MaxAttempts > 1 {
+		attempts = c.Retry.MaxAttempts
+	}
+
+	var (
+		resp rawMessage
+		err  error
+	)
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if serr := sleep(ctx, c.Retry.backoff(attempt)); serr != nil {
+				break
+			}
+		}
+		resp, err = c.send(ctx, method, req, write)
+		if !isTransientCode(ctx, err) {
+			break
+		}
+	}
+
+	if write && c.Cache != nil {
+		c.Cache.Invalidate()
+	}
+
+	if c.Breaker != nil {
+		switch {
+		case ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded):
+			c.Breaker.Release()
+		case isServerFailure(err):
+			c.Breaker.Record(err)
+		default:
+			c.Breaker.Record(nil)
+		}
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp, nil
+}
+
+func (c *GRPCClient) send(ctx context.Context, method string, req *request, write bool) (rawMessage, error) {
+	timeout := c.Timeouts.Read
+	if write {
+		timeout = c.Timeouts.Write
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.APIKey)
+
+	var resp rawMessage
+	err := c.Conn.Invoke(ctx, grpcService+method, req, &resp)
+	if status.Code(err) == codes.DeadlineExceeded && timeout > 0 {
+		return nil, fmt.Errorf("request timed out after %s: %w", timeout, err)
+	}
+	return resp, err
+}
+
+func (c *GRPCClient) get(ctx context.Context, method string, req *request) ([]byte, error) {
+	fetch := func(ctx context.Context) ([]byte, error) {
+		return c.invoke(ctx, method, req, false)
+	}
+	if c.Cache == nil || c.Cache.TTL <= 0 {
+		data, err := fetch(ctx)
+		if err == nil {
+			c.noteAsOf(time.Now())
+		}
+		return data, err
+	}
+	data, at, err := c.Cache.get(ctx, "grpc:"+method+":"+hex.EncodeToString(req.b), fetch)
+	if err == nil {
+		c.noteAsOf(at)
+	}
+	return data, err
+}
+
+func isTransientCode(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// isServerFailure reports whether err counts against the circuit breaker.
+func isServerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.OK:
+		return false
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// grpcError converts a gRPC status into the errors the REST transport
+// returns, so callers can use IsNotFound and friends on either.
+func grpcError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.Unavailable:
+		return fmt.Errorf("request failed: %s", st.Message())
+	case codes.DeadlineExceeded, codes.Canceled:
+		return err
+	}
+	return &APIError{Status: httpStatus(st.Code()), Code: int(st.Code()), Message: st.Message()}
+}
+
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+func parseID(id string) (uint64, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, &APIError{Status: http.StatusBadRequest, Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid ID %q", id)}
+	}
+	return n, nil
+}
+
+func (c *GRPCClient) TestConnection(ctx context.Context) error {
+	_, err := c.invoke(ctx, "ListUsers", &request{}, false)
+	if err == nil {
+		return nil
+	}
+	if IsUnauthorized(err) {
+		return &APIError{Status: http.StatusUnauthorized, Code: CodeUnauthenticated,
+			Message: "authentication failed: " + apiMessage(err)}
+	}
+	return fmt.Errorf("connection failed: %w", err)
+}
+
+func apiMessage(err error) string {
+	if e, ok := asAPIError(err); ok {
+		return e.Message
+	}
+	return err.Error()
+}
+
+func (c *GRPCClient) ListUsers(ctx context.Context) ([]model.User, error) {
+	data, err := c.get(ctx, "ListUsers", &request{})
+	if err != nil {
+		return nil, err
+	}
+	return decodeList(data, decodeUser)
+}
+
+func (c *GRPCClient) CreateUser(ctx context.Context, name, displayName, email, pictureURL string) (*model.User, error) {
+	req := (&request{}).str(1, name).str(2, displayName).str(3, email).str(4, pictureURL)
+	data, err := c.invoke(ctx, "CreateUser", req, true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOne(data, decodeUser)
+}
+
+func (c *GRPCClient) RenameUser(ctx context.Context, oldID, newName string) (*model.User, error) {
+	id, err := parseID(oldID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.invoke(ctx, "RenameUser", (&request{}).uint(1, id).str(2, newName), true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOne(data, decodeUser)
+}
+
+func (c *GRPCClient) DeleteUser(ctx context.Context, userID string) error {
+	id, err := parseID(userID)
+	if err != nil {
+		return err
+	}
+	_, err = c.invoke(ctx, "DeleteUser", (&request{}).uint(1, id), true)
+	return err
+}
+
+func (c *GRPCClient) ListNodes(ctx context.Context) ([]model.Node, error) {
+	data, err := c.get(ctx, "ListNodes", &request{})
+	if err != nil {
+		return nil, err
+	}
+	return decodeList(data, decodeNode)
+}
+
+func (c *GRPCClient) GetNode(ctx context.Context, nodeID string) (*model.Node, error) {
+	id, err := parseID(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.get(ctx, "GetNode", (&request{}).uint(1, id))
+	if err != nil {
+		return nil, err
+	}
+	return decodeOne(data, decodeNode)
+}
+
+func (c *GRPCClient) nodeCall(ctx context.Context, method, nodeID string, build func(*request)) (*model.Node, error) {
+	id, err := parseID(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	req := (&request{}).uint(1, id)
+	if build != nil {
+		build(req)
+	}
+	data, err := c.invoke(ctx, method, req, true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOne(data, decodeNode)
+}
+
+func (c *GRPCClient) RenameNode(ctx context.Context, nodeID, newName string) (*model.Node, error) {
+	return c.nodeCall(ctx, "RenameNode", nodeID, func(r *request) { r.str(2, newName) })
+}
+
+func (c *GRPCClient) ExpireNode(ctx context.Context, nodeID string) (*model.Node, error) {
+	return c.nodeCall(ctx, "ExpireNode", nodeID, nil)
+}
+
+func (c *GRPCClient) DeleteNode(ctx context.Context, nodeID string) error {
+	id, err := parseID(nodeID)
+	if err != nil {
+		return err
+	}
+	_, err = c.invoke(ctx, "DeleteNode", (&request{}).uint(1, id), true)
+	return err
+}
+
+func (c *GRPCClient) MoveNode(ctx context.Context, nodeID, userID string) (*model.Node, error) {
+	id, err := parseID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return c.nodeCall(ctx, "MoveNode", nodeID, func(r *request) { r.uint(2, id) })
+}
+
+func (c *GRPCClient) SetNodeTags(ctx context.Context, nodeID string, tags []string) (*model.Node, error) {
+	return c.nodeCall(ctx, "SetTags", nodeID, func(r *request) { r.strs(2, tags) })
+}
+
+func (c *GRPCClient) SetApprovedRoutes(ctx context.Context, nodeID string, routes []string) (*model.Node, error) {
+	return c.nodeCall(ctx, "SetApprovedRoutes", nodeID, func(r *request) { r.strs(2, routes) })
+}
+
+func (c *GRPCClient) ListPreAuthKeys(ctx context.Context, userID string) ([]model.PreAuthKey, error) {
+	id, err := parseID(userID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.get(ctx, "ListPreAuthKeys", (&request{}).uint(1, id))
+	if err != nil {
+		return nil, err
+	}
+	return decodeList(data, decodePreAuthKey)
+}
@@ -0,0 +1,531 @@
+package headscale
+
+import (
+	"context"
+	"errors"
+	"headcontrol/internal/model"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pb builds a protobuf message field by field, independently of the
+// client's request encoder, following proto/headscale/v1/*.proto.
+type pb []byte
+
+func (m pb) varint(num protowire.Number, v uint64) pb {
+	m = protowire.AppendTag(m, num, protowire.VarintType)
+	return protowire.AppendVarint(m, v)
+}
+
+func (m pb) bytes(num protowire.Number, v []byte) pb {
+	m = protowire.AppendTag(m, num, protowire.BytesType)
+	return protowire.AppendBytes(m, v)
+}
+
+func (m pb) str(num protowire.Number, v string) pb { return m.bytes(num, []byte(v)) }
+
+func (m pb) fixed64(num protowire.Number, v uint64) pb {
+	m = protowire.AppendTag(m, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(m, v)
+}
+
+func ts(t time.Time) pb {
+	return pb(nil).varint(1, uint64(t.Unix())).varint(2, uint64(t.Nanosecond()))
+}
+
+// fields decodes a flat request into its fields, repeated ones in order.
+func fields(t *testing.T, b []byte) map[protowire.Number][]any {
+	t.Helper()
+	out := map[protowire.Number][]any{}
+	err := walk(b, func(num protowire.Number, typ protowire.Type, n uint64, v []byte) error {
+		if typ == protowire.BytesType {
+			out[num] = append(out[num], string(v))
+		} else {
+			out[num] = append(out[num], n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode request: %v", err)
+	}
+	return out
+}
+
+// fakeGRPC is an in-process HeadscaleService. Each method answers from
+// handlers; every call is recorded with its raw request.
+type fakeGRPC struct {
+	mu       sync.Mutex
+	handlers map[string]func(req []byte) ([]byte, error)
+	calls    []fakeCall
+}
+
+type fakeCall struct {
+	Method string
+	Auth   string
+	Req    []byte
+}
+
+var grpcMethods = []string{
+	"ListUsers", "CreateUser", "RenameUser", "DeleteUser",
+	"ListNodes", "GetNode", "RenameNode", "ExpireNode", "DeleteNode", "MoveNode", "SetTags", "SetApprovedRoutes",
+	"ListPreAuthKeys",
+}
+
+func newGRPCClient(t *testing.T) (*fakeGRPC, *GRPCClient) {
+	t.Helper()
+	f := &fakeGRPC{handlers: map[string]func([]byte) ([]byte, error){}}
+
+	desc := grpc.ServiceDesc{ServiceName: "headscale.v1.HeadscaleService", HandlerType: (*any)(nil)}
+	for _, name := range grpcMethods {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{MethodName: name, Handler: f.handler(name)})
+	}
+	srv := grpc.NewServer(grpc.ForceServerCodec(protoCodec{}))
+	srv.RegisterService(&desc, f)
+
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///headscale",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(protoCodec{})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &GRPCClient{
+		Conn:     conn,
+		APIKey:   "grpc-key",
+		Timeouts: Timeouts{Read: 5 * time.Second, Write: 5 * time.Second},
+		Retry:    RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond},
+	}
+	return f, c
+}
+
+func (f *fakeGRPC) handler(method string) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+		var req rawMessage
+		if err := dec(&req); err != nil {
+			return nil, err
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		f.mu.Lock()
+		f.calls = append(f.calls, fakeCall{Method: method, Auth: strings.Join(md.Get("authorization"), ","), Req: req})
+		h := f.handlers[method]
+		f.mu.Unlock()
+		if h == nil {
+			return nil, status.Error(codes.Unimplemented, method)
+		}
+		resp, err := h(req)
+		if err != nil {
+			return nil, err
+		}
+		out := rawMessage(resp)
+		return &out, nil
+	}
+}
+
+func (f *fakeGRPC) on(method string, h func(req []byte) ([]byte, error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[method] = h
+}
+
+// reply answers method with resp whatever the request.
+func (f *fakeGRPC) reply(method string, resp pb) {
+	f.on(method, func([]byte) ([]byte, error) { return resp, nil })
+}
+
+// last returns the most recent call to method.
+func (f *fakeGRPC) last(t *testing.T, method string) fakeCall {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.calls) - 1; i >= 0; i-- {
+		if f.calls[i].Method == method {
+			return f.calls[i]
+		}
+	}
+	t.Fatalf("no %s call", method)
+	return fakeCall{}
+}
+
+func (f *fakeGRPC) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+var created = time.Date(2025, 3, 4, 5, 6, 7, 890000000, time.UTC)
+
+func userMsg(id uint64, name string) pb {
+	return pb(nil).
+		varint(1, id).
+		str(2, name).
+		bytes(3, ts(created)).
+		str(4, strings.ToUpper(name[:1])+name[1:]).
+		str(5, name+"@example.com").
+		str(6, "oidc-subject"). // provider_id, not decoded
+		str(7, "oidc").
+		str(8, "https://example.com/"+name+".png")
+}
+
+func TestGRPCUsers(t *testing.T) {
+	f, c := newGRPCClient(t)
+	ctx := context.Background()
+
+	// Unknown fields of every wire type are skipped.
+	f.reply("ListUsers", pb(nil).
+		bytes(1, userMsg(1, "alice").fixed64(40, 7).varint(41, 1)).
+		bytes(1, userMsg(2, "bob")).
+		str(99, "future field"))
+	users, err := c.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.User{ID: "1", Name: "alice", CreatedAt: "2025-03-04T05:06:07.89Z", DisplayName: "Alice",
+		Email: "alice@example.com", ProfilePicURL: "https://example.com/alice.png"}
+	if len(users) != 2 || users[0] != want || users[1].Name != "bob" {
+		t.Errorf("ListUsers = %+v, want alice (%+v) and bob", users, want)
+	}
+	if got := f.last(t, "ListUsers").Auth; got != "Bearer grpc-key" {
+		t.Errorf("authorization = %q", got)
+	}
+
+	f.reply("CreateUser", pb(nil).bytes(1, userMsg(3, "carol")))
+	u, err := c.CreateUser(ctx, "carol", "Carol", "carol@example.com", "https://example.com/carol.png")
+	if err != nil || u.ID != "3" || u.Name != "carol" {
+		t.Fatalf("CreateUser = %+v, %v", u, err)
+	}
+	req := fields(t, f.last(t, "CreateUser").Req)
+	if req[1][0] != "carol" || req[2][0] != "Carol" || req[3][0] != "carol@example.com" || req[4][0] != "https://example.com/carol.png" {
+		t.Errorf("CreateUserRequest = %v", req)
+	}
+
+	f.reply("RenameUser", pb(nil).bytes(1, userMsg(3, "caroline")))
+	if u, err := c.RenameUser(ctx, "3", "caroline"); err != nil || u.Name != "caroline" {
+		t.Fatalf("RenameUser = %+v, %v", u, err)
+	}
+	if req := fields(t, f.last(t, "RenameUser").Req); req[1][0] != uint64(3) || req[2][0] != "caroline" {
+		t.Errorf("RenameUserRequest = %v", req)
+	}
+
+	f.reply("DeleteUser", nil)
+	if err := c.DeleteUser(ctx, "3"); err != nil {
+		t.Fatal(err)
+	}
+	if req := fields(t, f.last(t, "DeleteUser").Req); req[1][0] != uint64(3) {
+		t.Errorf("DeleteUserRequest = %v", req)
+	}
+}
+
+func nodeMsg(id uint64) pb {
+	key := pb(nil).
+		bytes(1, userMsg(1, "alice")).
+		varint(2, 9).
+		str(3, "hskey-auth-secret").
+		varint(4, 1).
+		varint(5, 0).
+		varint(6, 1).
+		bytes(7, ts(created.Add(24*time.Hour))).
+		bytes(8, ts(created)).
+		str(9, "tag:ci")
+	return pb(nil).
+		varint(1, id).
+		str(2, "mkey:abc").
+		str(3, "nodekey:def").
+		str(4, "discokey:ghi").
+		str(5, "100.64.0.1").
+		str(5, "fd7a:115c:a1e0::1").
+		str(6, "laptop-host").
+		bytes(7, userMsg(1, "alice")).
+		bytes(8, ts(created)).
+		bytes(10, ts(created.Add(90*24*time.Hour))).
+		bytes(11, key).
+		bytes(12, ts(created)).
+		varint(13, 3).
+		str(16, "reserved in 0.26").
+		str(18, "tag:server").
+		str(19, "tag:bogus").
+		str(20, "tag:server").
+		str(20, "tag:prod").
+		str(21, "laptop").
+		varint(22, 1).
+		str(23, "10.0.0.0/24").
+		str(24, "10.0.0.0/24").
+		str(24, "0.0.0.0/0").
+		str(25, "10.0.0.0/24")
+}
+
+func TestGRPCNodes(t *testing.T) {
+	f, c := newGRPCClient(t)
+	ctx := context.Background()
+
+	f.reply("ListNodes", pb(nil).bytes(1, nodeMsg(7)).bytes(1, pb(nil).varint(1, 8).str(21, "phone")))
+	nodes, err := c.ListNodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[1].ID != "8" || nodes[1].GivenName != "phone" {
+		t.Fatalf("ListNodes = %+v", nodes)
+	}
+	n := nodes[0]
+	checks := []struct {
+		field     string
+		got, want any
+	}{
+		{"ID", n.ID, "7"},
+		{"MachineKey", n.MachineKey, "mkey:abc"},
+		{"NodeKey", n.NodeKey, "nodekey:def"},
+		{"DiscoKey", n.DiscoKey, "discokey:ghi"},
+		{"IPAddresses", strings.Join(n.IPAddresses, ","), "100.64.0.1,fd7a:115c:a1e0::1"},
+		{"Name", n.Name, "laptop-host"},
+		{"GivenName", n.GivenName, "laptop"},
+		{"User", n.User != nil && n.User.ID == "1" && n.User.Name == "alice", true},
+		{"LastSeen", n.LastSeen, "2025-03-04T05:06:07.89Z"},
+		{"Expiry", n.Expiry, "2025-06-02T05:06:07.89Z"},
+		{"CreatedAt", n.CreatedAt, "2025-03-04T05:06:07.89Z"},
+		{"RegisterMethod", n.RegisterMethod, "REGISTER_METHOD_OIDC"},
+		{"ForcedTags", strings.Join(n.ForcedTags, ","), "tag:server"},
+		{"InvalidTags", strings.Join(n.InvalidTags, ","), "tag:bogus"},
+		{"ValidTags", strings.Join(n.ValidTags, ","), "tag:server,tag:prod"},
+		{"Tags", strings.Join(n.Tags, ","), "tag:server,tag:prod"},
+		{"Online", n.Online, true},
+		{"ApprovedRoutes", strings.Join(n.ApprovedRoutes, ","), "10.0.0.0/24"},
+		{"AvailableRoutes", strings.Join(n.AvailableRoutes, ","), "10.0.0.0/24,0.0.0.0/0"},
+		{"SubnetRoutes", strings.Join(n.SubnetRoutes, ","), "10.0.0.0/24"},
+	}
+	for _, ch := range checks {
+		if ch.got != ch.want {
+			t.Errorf("node %s = %v, want %v", ch.field, ch.got, ch.want)
+		}
+	}
+	if k := n.PreAuthKey; k == nil || k.ID != "9" || k.User != "alice" || k.Key != "hskey-auth-secret" ||
+		!k.Reusable || k.Ephemeral || !k.Used || k.Expiration != "2025-03-05T05:06:07.89Z" || !slices.Equal(k.ACLTags, []string{"tag:ci"}) {
+		t.Errorf("node PreAuthKey = %+v", k)
+	}
+
+	f.reply("GetNode", pb(nil).bytes(1, nodeMsg(7)))
+	if n, err := c.GetNode(ctx, "7"); err != nil || n.GivenName != "laptop" {
+		t.Fatalf("GetNode = %+v, %v", n, err)
+	}
+	if req := fields(t, f.last(t, "GetNode").Req); req[1][0] != uint64(7) {
+		t.Errorf("GetNodeRequest = %v", req)
+	}
+
+	writes := []struct {
+		method string
+		call   func() error
+		want   map[protowire.Number][]any
+	}{
+		{"RenameNode", func() error { _, err := c.RenameNode(ctx, "7", "workstation"); return err },
+			map[protowire.Number][]any{1: {uint64(7)}, 2: {"workstation"}}},
+		{"ExpireNode", func() error { _, err := c.ExpireNode(ctx, "7"); return err },
+			map[protowire.Number][]any{1: {uint64(7)}}},
+		{"MoveNode", func() error { _, err := c.MoveNode(ctx, "7", "2"); return err },
+			map[protowire.Number][]any{1: {uint64(7)}, 2: {uint64(2)}}},
+		{"SetTags", func() error { _, err := c.SetNodeTags(ctx, "7", []string{"tag:a", "tag:b"}); return err },
+			map[protowire.Number][]any{1: {uint64(7)}, 2: {"tag:a", "tag:b"}}},
+		{"SetApprovedRoutes", func() error { _, err := c.SetApprovedRoutes(ctx, "7", []string{"10.0.0.0/24"}); return err },
+			map[protowire.Number][]any{1: {uint64(7)}, 2: {"10.0.0.0/24"}}},
+		{"DeleteNode", func() error { return c.DeleteNode(ctx, "7") },
+			map[protowire.Number][]any{1: {uint64(7)}}},
+	}
+	for _, w := range writes {
+		f.reply(w.method, pb(nil).bytes(1, nodeMsg(7)))
+		if err := w.call(); err != nil {
+			t.Errorf("%s: %v", w.method, err)
+			continue
+		}
+		got := fields(t, f.last(t, w.method).Req)
+		for num, vals := range w.want {
+			if !slices.Equal(got[num], vals) {
+				t.Errorf("%sRequest field %d = %v, want %v", w.method, num, got[num], vals)
+			}
+		}
+		if len(got) != len(w.want) {
+			t.Errorf("%sRequest = %v, want only %v", w.method, got, w.want)
+		}
+	}
+}
+
+func TestGRPCPreAuthKeys(t *testing.T) {
+	f, c := newGRPCClient(t)
+
+	f.reply("ListPreAuthKeys", pb(nil).
+		bytes(1, pb(nil).bytes(1, userMsg(4, "dave")).varint(2, 11).str(3, "key-one").bytes(8, ts(created))).
+		bytes(1, pb(nil).bytes(1, userMsg(4, "dave")).varint(2, 12).str(3, "key-two").varint(5, 1)))
+	keys, err := c.ListPreAuthKeys(context.Background(), "4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != "11" || keys[0].User != "dave" || keys[0].CreatedAt != "2025-03-04T05:06:07.89Z" ||
+		keys[1].Key != "key-two" || !keys[1].Ephemeral {
+		t.Errorf("ListPreAuthKeys = %+v", keys)
+	}
+	if req := fields(t, f.last(t, "ListPreAuthKeys").Req); req[1][0] != uint64(4) {
+		t.Errorf("ListPreAuthKeysRequest = %v", req)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	f, c := newGRPCClient(t)
+	ctx := context.Background()
+
+	f.on("GetNode", func([]byte) ([]byte, error) { return nil, status.Error(codes.NotFound, "node not found") })
+	_, err := c.GetNode(ctx, "5")
+	if !IsNotFound(err) {
+		t.Errorf("NotFound: err = %v, want IsNotFound", err)
+	}
+	if e, ok := asAPIError(err); !ok || e.Status != http.StatusNotFound || e.Message != "node not found" {
+		t.Errorf("NotFound: APIError = %+v", e)
+	}
+
+	f.on("RenameNode", func([]byte) ([]byte, error) { return nil, status.Error(codes.InvalidArgument, "invalid name") })
+	if _, err := c.RenameNode(ctx, "5", "Bad Name"); !IsInvalid(err) {
+		t.Errorf("InvalidArgument: err = %v, want IsInvalid", err)
+	}
+	f.on("CreateUser", func([]byte) ([]byte, error) { return nil, status.Error(codes.AlreadyExists, "user exists") })
+	if _, err := c.CreateUser(ctx, "alice", "", "", ""); !IsConflict(err) {
+		t.Errorf("AlreadyExists: err = %v, want IsConflict", err)
+	}
+	f.on("ListUsers", func([]byte) ([]byte, error) { return nil, status.Error(codes.Unauthenticated, "invalid token") })
+	if err := c.TestConnection(ctx); !IsUnauthorized(err) || !strings.Contains(err.Error(), "invalid token") {
+		t.Errorf("Unauthenticated: err = %v, want IsUnauthorized", err)
+	}
+
+	// IDs are checked before anything is sent.
+	before := f.count("DeleteNode")
+	if err := c.DeleteNode(ctx, "not-a-number"); !IsInvalid(err) {
+		t.Errorf("bad ID: err = %v, want IsInvalid", err)
+	}
+	if f.count("DeleteNode") != before {
+		t.Error("bad ID reached the server")
+	}
+}
+
+func TestGRPCWritesNeedCurrentRelease(t *testing.T) {
+	f, c := newGRPCClient(t)
+	ctx := context.Background()
+	f.reply("ListUsers", pb{})
+	f.reply("DeleteUser", pb{})
+
+	for _, tc := range []struct {
+		name   string
+		detect func(context.Context) (*ServerInfo, error)
+		want   string
+	}{
+		{"unknown", func(context.Context) (*ServerInfo, error) { return nil, errors.New("HTTP 502") }, "version is unknown"},
+		{"routes API", func(context.Context) (*ServerInfo, error) {
+			return &ServerInfo{Version: Version{Minor: 24, Raw: "v0.24–v0.25"}, Source: "probed", adapter: adapterRoutesAPI}, nil
+		}, "needs v0.26 or newer"},
+	} {
+		c.Detect = tc.detect
+		if err := c.DeleteUser(ctx, "1"); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: DeleteUser = %v, want %q", tc.name, err, tc.want)
+		}
+		if _, err := c.ListUsers(ctx); err != nil {
+			t.Errorf("%s: ListUsers = %v, reads should still work", tc.name, err)
+		}
+	}
+	if n := f.count("DeleteUser"); n != 0 {
+		t.Errorf("refused writes reached the server %d times", n)
+	}
+
+	c.Detect = func(context.Context) (*ServerInfo, error) { return &ServerInfo{adapter: adapterCurrent}, nil }
+	if err := c.DeleteUser(ctx, "1"); err != nil {
+		t.Errorf("DeleteUser on a current server: %v", err)
+	}
+}
+
+func TestGRPCRetryAndBreaker(t *testing.T) {
+	f, c := newGRPCClient(t)
+	ctx := context.Background()
+	c.Breaker = &Breaker{Threshold: 2, Cooldown: time.Minute}
+
+	// Reads are retried while the server is unavailable.
+	var fails int
+	f.on("ListUsers", func([]byte) ([]byte, error) {
+		if fails < 2 {
+			fails++
+			return nil, status.Error(codes.Unavailable, "restarting")
+		}
+		return pb(nil).bytes(1, userMsg(1, "alice")), nil
+	})
+	if users, err := c.ListUsers(ctx); err != nil || len(users) != 1 {
+		t.Fatalf("ListUsers after transient failures = %+v, %v", users, err)
+	}
+	if n := f.count("ListUsers"); n != 3 {
+		t.Errorf("ListUsers attempts = %d, want 3", n)
+	}
+	if s := c.Breaker.Snapshot(); s.State != BreakerClosed || s.Failures != 0 {
+		t.Errorf("breaker after success = %+v", s)
+	}
+
+	// Writes are sent once.
+	f.on("DeleteNode", func([]byte) ([]byte, error) { return nil, status.Error(codes.Unavailable, "down") })
+	if err := c.DeleteNode(ctx, "1"); err == nil || IsNotFound(err) {
+		t.Errorf("DeleteNode while unavailable = %v", err)
+	}
+	if n := f.count("DeleteNode"); n != 1 {
+		t.Errorf("DeleteNode attempts = %d, want 1", n)
+	}
+	if s := c.Breaker.Snapshot(); s.Failures != 1 {
+		t.Errorf("breaker failures = %d, want 1", s.Failures)
+	}
+	// A NotFound is an answer from a healthy server and resets the count.
+	f.on("GetNode", func([]byte) ([]byte, error) { return nil, status.Error(codes.NotFound, "gone") })
+	c.GetNode(ctx, "1")
+	if s := c.Breaker.Snapshot(); s.Failures != 0 {
+		t.Errorf("breaker failures after NotFound = %d, want 0", s.Failures)
+	}
+
+	c.DeleteNode(ctx, "1")
+	c.DeleteNode(ctx, "1")
+	if s := c.Breaker.Snapshot(); s.State != BreakerOpen {
+		t.Fatalf("breaker after %d failures = %+v, want open", c.Breaker.Threshold, s)
+	}
+	before := f.count("ListUsers")
+	if _, err := c.ListUsers(ctx); !IsUnavailable(err) {
+		t.Errorf("ListUsers with open breaker = %v, want IsUnavailable", err)
+	}
+	if f.count("ListUsers") != before {
+		t.Error("open breaker let a call through")
+	}
+}
+
+func TestEndpointRetireKeepsConnectionForRunningCalls(t *testing.T) {
+	f, c := newGRPCClient(t)
+	f.reply("ListUsers", pb(nil).bytes(1, userMsg(1, "alice")))
+	e := &Endpoint{cfg: model.Settings{ReadTimeout: 2, WriteTimeout: 5}, conn: c.Conn}
+
+	e.Retire()
+	if _, err := c.ListUsers(context.Background()); err != nil {
+		t.Fatalf("ListUsers right after Retire: %v", err)
+	}
+	if d, min := e.drainTime(), 3*5*time.Second; d < min {
+		t.Errorf("drainTime = %s, want at least %s for three 5s attempts", d, min)
+	}
+}
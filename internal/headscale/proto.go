@@ -0,0 +1,293 @@
+package headscale
+
+import (
+	"errors"
+	"fmt"
+	"headcontrol/internal/model"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The headscale.v1 messages HeadControl needs, encoded by hand so the
+// module does not depend on Headscale's generated code. Field numbers
+// follow proto/headscale/v1/*.proto; unknown fields are skipped.
+
+// message is a request or response on the wire.
+type message interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+// protoCodec passes message values straight through protowire. Responses
+// are always read into *rawMessage so they can be cached before decoding.
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("proto codec: cannot marshal %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("proto codec: cannot unmarshal into %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+type rawMessage []byte
+
+func (m *rawMessage) marshal() []byte { return *m }
+
+func (m *rawMessage) unmarshal(b []byte) error {
+	*m = append((*m)[:0], b...)
+	return nil
+}
+
+// request is a flat request message built from its fields in order.
+type request struct {
+	b []byte
+}
+
+func (r *request) uint(num protowire.Number, v uint64) *request {
+	if v != 0 {
+		r.b = protowire.AppendTag(r.b, num, protowire.VarintType)
+		r.b = protowire.AppendVarint(r.b, v)
+	}
+	return r
+}
+
+func (r *request) str(num protowire.Number, v string) *request {
+	if v != "" {
+		r.b = protowire.AppendTag(r.b, num, protowire.BytesType)
+		r.b = protowire.AppendString(r.b, v)
+	}
+	return r
+}
+
+func (r *request) strs(num protowire.Number, vs []string) *request {
+	for _, v := range vs {
+		r.b = protowire.AppendTag(r.b, num, protowire.BytesType)
+		r.b = protowire.AppendString(r.b, v)
+	}
+	return r
+}
+
+func (r *request) marshal() []byte { return r.b }
+
+func (r *request) unmarshal(b []byte) error {
+	r.b = append(r.b[:0], b...)
+	return nil
+}
+
+var errMalformed = errors.New("malformed protobuf message")
+
+// walk calls fn for every field in b. For bytes fields v holds the
+// contents, for varints n holds the value.
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, n uint64, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return errMalformed
+		}
+		b = b[l:]
+		var (
+			n uint64
+			v []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return errMalformed
+		}
+		b = b[l:]
+		if err := fn(num, typ, n, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timestamp decodes a google.protobuf.Timestamp into the RFC 3339 form the
+// REST gateway uses.
+func timestamp(b []byte) (string, error) {
+	var secs, nanos uint64
+	err := walk(b, func(num protowire.Number, _ protowire.Type, n uint64, _ []byte) error {
+		switch num {
+		case 1:
+			secs = n
+		case 2:
+			nanos = n
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return time.Unix(int64(secs), int64(nanos)).UTC().Format(time.RFC3339Nano), nil
+}
+
+var registerMethods = map[uint64]string{
+	0: "REGISTER_METHOD_UNSPECIFIED",
+	1: "REGISTER_METHOD_AUTH_KEY",
+	2: "REGISTER_METHOD_CLI",
+	3: "REGISTER_METHOD_OIDC",
+}
+
+func decodeUser(b []byte) (model.User, error) {
+	var u model.User
+	err := walk(b, func(num protowire.Number, _ protowire.Type, n uint64, v []byte) (err error) {
+		switch num {
+		case 1:
+			u.ID = strconv.FormatUint(n, 10)
+		case 2:
+			u.Name = string(v)
+		case 3:
+			u.CreatedAt, err = timestamp(v)
+		case 4:
+			u.DisplayName = string(v)
+		case 5:
+			u.Email = string(v)
+		case 8:
+			u.ProfilePicURL = string(v)
+		}
+		return err
+	})
+	return u, err
+}
+
+func decodeNode(b []byte) (model.Node, error) {
+	var nd model.Node
+	seen := map[string]bool{}
+	addTag := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			nd.Tags = append(nd.Tags, t)
+		}
+	}
+	err := walk(b, func(num protowire.Number, _ protowire.Type, n uint64, v []byte) (err error) {
+		switch num {
+		case 1:
+			nd.ID = strconv.FormatUint(n, 10)
+		case 2:
+			nd.MachineKey = string(v)
+		case 3:
+			nd.NodeKey = string(v)
+		case 4:
+			nd.DiscoKey = string(v)
+		case 5:
+			nd.IPAddresses = append(nd.IPAddresses, string(v))
+		case 6:
+			nd.Name = string(v)
+		case 7:
+			var u model.User
+			u, err = decodeUser(v)
+			nd.User = &u
+		case 8:
+			nd.LastSeen, err = timestamp(v)
+		case 10:
+			nd.Expiry, err = timestamp(v)
+		case 11:
+			// Releases before 0.26 name the key's user with a string, which
+			// does not decode; the node is still useful without its key.
+			if k, kerr := decodePreAuthKey(v); kerr == nil {
+				nd.PreAuthKey = &k
+			}
+		case 12:
+			nd.CreatedAt, err = timestamp(v)
+		case 13:
+			nd.RegisterMethod = registerMethods[n]
+		case 18:
+			nd.ForcedTags = append(nd.ForcedTags, string(v))
+			addTag(string(v))
+		case 19:
+			nd.InvalidTags = append(nd.InvalidTags, string(v))
+		case 20:
+			nd.ValidTags = append(nd.ValidTags, string(v))
+			addTag(string(v))
+		case 21:
+			nd.GivenName = string(v)
+		case 22:
+			nd.Online = n != 0
+		case 23:
+			nd.ApprovedRoutes = append(nd.ApprovedRoutes, string(v))
+		case 24:
+			nd.AvailableRoutes = append(nd.AvailableRoutes, string(v))
+		case 25:
+			nd.SubnetRoutes = append(nd.SubnetRoutes, string(v))
+		}
+		return err
+	})
+	return nd, err
+}
+
+func decodePreAuthKey(b []byte) (model.PreAuthKey, error) {
+	var k model.PreAuthKey
+	err := walk(b, func(num protowire.Number, _ protowire.Type, n uint64, v []byte) (err error) {
+		switch num {
+		case 1:
+			var u model.User
+			u, err = decodeUser(v)
+			k.User = u.Name
+		case 2:
+			k.ID = strconv.FormatUint(n, 10)
+		case 3:
+			k.Key = string(v)
+		case 4:
+			k.Reusable = n != 0
+		case 5:
+			k.Ephemeral = n != 0
+		case 6:
+			k.Used = n != 0
+		case 7:
+			k.Expiration, err = timestamp(v)
+		case 8:
+			k.CreatedAt, err = timestamp(v)
+		case 9:
+			k.ACLTags = append(k.ACLTags, string(v))
+		}
+		return err
+	})
+	return k, err
+}
+
+// decodeList decodes every occurrence of field 1 in a List*Response.
+func decodeList[T any](b []byte, decode func([]byte) (T, error)) ([]T, error) {
+	var out []T
+	err := walk(b, func(num protowire.Number, _ protowire.Type, _ uint64, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		item, err := decode(v)
+		if err == nil {
+			out = append(out, item)
+		}
+		return err
+	})
+	return out, err
+}
+
+// decodeOne decodes field 1 of a response wrapping a single user or node.
+func decodeOne[T any](b []byte, decode func([]byte) (T, error)) (*T, error) {
+	items, err := decodeList(b, decode)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.New("empty response")
+	}
+	return &items[len(items)-1], nil
+}
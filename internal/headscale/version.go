@@ -0,0 +1,225 @@
+package headscale
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is a Headscale release number. Development builds parse as the
+// zero Version with Raw set.
+type Version struct {
+	Major, Minor, Patch int
+	Raw                 string
+}
+
+// ParseVersion accepts "v0.26.1", "0.26.1", "0.26.0-beta.2" and the like.
+func ParseVersion(s string) (Version, bool) {
+	v := Version{Raw: s}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+ "); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return v, false
+	}
+	nums := make([]int, 3)
+	for i := 0; i < len(parts) && i < 3; i++ {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return v, false
+		}
+		nums[i] = n
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+func (v Version) Known() bool {
+	return v.Major != 0 || v.Minor != 0 || v.Patch != 0
+}
+
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+func (v Version) String() string {
+	if !v.Known() {
+		if v.Raw != "" {
+			return v.Raw
+		}
+		return "unknown"
+	}
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// ServerInfo is what detection learned about a server.
+type ServerInfo struct {
+	Version Version
+	// Source says how the version was found: "reported" when the server
+	// told us, "probed" when it was inferred from which endpoints exist.
+	Source  string
+	Adapter string
+	// Unsupported lists features this server lacks, in words for the UI.
+	Unsupported []string
+
+	adapter adapter
+}
+
+// Label is the version as shown to users; probed versions are ranges.
+func (i *ServerInfo) Label() string {
+	if i.Source == "probed" && i.Version.Raw != "" {
+		return i.Version.Raw
+	}
+	return i.Version.String()
+}
+
+// detectRetry limits how often a failed detection is attempted again.
+const detectRetry = 30 * time.Second
+
+// detectTimeout bounds a whole detection run. It runs apart from the
+// request that started it, so it needs a limit of its own.
+const detectTimeout = time.Minute
+
+// Detector works out once which Headscale release a server runs and
+// remembers the answer. Like Breaker it is shared between clients.
+type Detector struct {
+	mu      sync.Mutex
+	info    *ServerInfo
+	err     error
+	checked time.Time
+	// running is closed when the detection in flight finishes.
+	running chan struct{}
+}
+
+func NewDetector() *Detector {
+	return &Detector{}
+}
+
+// Info returns the detected server info, running detection through c on
+// first use and again after a failure once detectRetry has passed.
+// Concurrent callers share one detection. It runs with its own context, so
+// a caller that gives up neither cancels it for the others nor leaves a
+// failure behind; that caller just gets its own context's error.
+func (d *Detector) Info(ctx context.Context, c *Client) (*ServerInfo, error) {
+	d.mu.Lock()
+	if d.info != nil {
+		defer d.mu.Unlock()
+		return d.info, nil
+	}
+	if d.err != nil && time.Since(d.checked) < detectRetry {
+		defer d.mu.Unlock()
+		return nil, d.err
+	}
+	if d.running == nil {
+		d.running = make(chan struct{})
+		go d.run(c, d.running)
+	}
+	running := d.running
+	d.mu.Unlock()
+
+	select {
+	case <-running:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.info, d.err
+}
+
+func (d *Detector) run(c *Client, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+	defer cancel()
+	info, err := detect(ctx, c)
+
+	d.mu.Lock()
+	d.info, d.err, d.checked = info, err, time.Now()
+	d.running = nil
+	d.mu.Unlock()
+	close(done)
+}
+
+// probeUser is looked up by name to tell v0.23 from later releases.
+const probeUser = "headcontrol-version-probe"
+
+func detect(ctx context.Context, c *Client) (*ServerInfo, error) {
+	info := &ServerInfo{Source: "reported"}
+
+	data, status, err := c.send(ctx, http.MethodGet, "/version", nil)
+	if err != nil {
+		return nil, fmt.Errorf("detect version: %w", err)
+	}
+	if status == http.StatusOK {
+		var body struct {
+			Version string `json:"version"`
+		}
+		raw := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &body) == nil && body.Version != "" {
+			raw = body.Version
+		}
+		info.Version, _ = ParseVersion(raw)
+	}
+
+	if !info.Version.Known() {
+		// /version only exists on recent releases; older ones are told
+		// apart by which endpoints they serve.
+		info.Source = "probed"
+		info.Version, err = probe(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info.adapter = adapterFor(info.Version)
+	info.Adapter = info.adapter.name
+	info.Unsupported = info.adapter.unsupported()
+	return info, nil
+}
+
+// probe infers the release line from the API. The routes API was removed
+// in v0.26. Until v0.23 users could be fetched by name; from v0.24 the
+// gateway has no GET route under /api/v1/user/ and answers 501, while
+// v0.23 looks the name up and fails with 500 for a missing user.
+func probe(ctx context.Context, c *Client) (Version, error) {
+	status, err := probeStatus(ctx, c, "/api/v1/routes")
+	if err != nil {
+		return Version{}, err
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusNotImplemented, http.StatusMethodNotAllowed:
+		return Version{Raw: "v0.26 or newer"}, nil
+	default:
+		return Version{}, fmt.Errorf("detect version: unexpected HTTP %d from the routes API", status)
+	}
+	status, err = probeStatus(ctx, c, "/api/v1/user/"+probeUser)
+	if err != nil {
+		return Version{}, err
+	}
+	switch status {
+	case http.StatusNotImplemented, http.StatusMethodNotAllowed:
+		return Version{Major: 0, Minor: 24, Raw: "v0.24–v0.25"}, nil
+	case http.StatusOK, http.StatusNotFound, http.StatusInternalServerError:
+		return Version{Major: 0, Minor: 23, Raw: "v0.23"}, nil
+	default:
+		return Version{}, fmt.Errorf("detect version: unexpected HTTP %d from the user lookup", status)
+	}
+}
+
+func probeStatus(ctx context.Context, c *Client, path string) (int, error) {
+	_, status, err := c.send(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return 0, fmt.Errorf("detect version: %w", err)
+	}
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		return 0, &APIError{Status: status, Code: CodeUnauthenticated, Message: "API key rejected while detecting the server version"}
+	}
+	return status, nil
+}
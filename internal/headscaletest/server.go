@@ -0,0 +1,794 @@
+// Package headscaletest runs an in-process fake of the Headscale REST API
+// for tests. State lives in memory; faults can be injected to exercise
+// retries, the circuit breaker and error handling.
+package headscaletest
+
+import (
+	"encoding/json"
+	"fmt"
+	"headcontrol/internal/model"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const DefaultAPIKey = "test-api-key"
+
+// PreAuthKey is a pre-authentication key as the API returns it.
+type PreAuthKey struct {
+	ID         string      `json:"id"`
+	User       *model.User `json:"user"`
+	Key        string      `json:"key"`
+	Reusable   bool        `json:"reusable"`
+	Ephemeral  bool        `json:"ephemeral"`
+	Used       bool        `json:"used"`
+	Expiration string      `json:"expiration"`
+	CreatedAt  string      `json:"createdAt"`
+}
+
+// Release selects which generation of the API the fake serves.
+type Release int
+
+const (
+	// Release026 is v0.26 and newer, the default.
+	Release026 Release = iota
+	// Release024 is v0.24 and v0.25: subnet routes have their own API,
+	// and node owners and pre-auth key users are given by name.
+	Release024
+	// Release023 is v0.23, which also addresses users by name and has
+	// no display name, email or picture for them.
+	Release023
+)
+
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	apiKey  string
+	version string
+	release Release
+	nextID  int
+	users   []model.User
+	nodes   []model.Node
+	keys    []PreAuthKey
+	policy  string
+
+	latency  time.Duration
+	failures []int
+	requests []string
+}
+
+// New starts a fake server accepting DefaultAPIKey and stops it when the
+// test ends.
+func New(t testing.TB) *Server {
+	t.Helper()
+	s := &Server{apiKey: DefaultAPIKey, version: "v0.26.1"}
+	s.Server = httptest.NewServer(s.routes())
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /version", s.getVersion)
+
+	mux.HandleFunc("GET /api/v1/user", s.listUsers)
+	mux.HandleFunc("GET /api/v1/user/{name}", s.getUser)
+	mux.HandleFunc("POST /api/v1/user", s.createUser)
+	mux.HandleFunc("POST /api/v1/user/{id}/rename/{name}", s.renameUser)
+	mux.HandleFunc("DELETE /api/v1/user/{id}", s.deleteUser)
+
+	mux.HandleFunc("GET /api/v1/node", s.listNodes)
+	mux.HandleFunc("GET /api/v1/node/{id}", s.getNode)
+	mux.HandleFunc("POST /api/v1/node/{id}/rename/{name}", s.renameNode)
+	mux.HandleFunc("POST /api/v1/node/{id}/expire", s.expireNode)
+	mux.HandleFunc("DELETE /api/v1/node/{id}", s.deleteNode)
+	mux.HandleFunc("POST /api/v1/node/{id}/user", s.moveNode)
+	mux.HandleFunc("POST /api/v1/node/{id}/tags", s.setTags)
+	mux.HandleFunc("POST /api/v1/node/{id}/approve_routes", s.approveRoutes)
+
+	mux.HandleFunc("GET /api/v1/routes", s.listRoutes)
+	mux.HandleFunc("GET /api/v1/node/{id}/routes", s.nodeRoutes)
+	mux.HandleFunc("POST /api/v1/routes/{id}/{action}", s.switchRoute)
+
+	mux.HandleFunc("GET /api/v1/preauthkey", s.listKeys)
+	mux.HandleFunc("POST /api/v1/preauthkey", s.createKey)
+	mux.HandleFunc("POST /api/v1/preauthkey/expire", s.expireKey)
+
+	mux.HandleFunc("GET /api/v1/policy", s.getPolicy)
+	mux.HandleFunc("PUT /api/v1/policy", s.setPolicy)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		latency := s.latency
+		var fail int
+		if len(s.failures) > 0 {
+			fail, s.failures = s.failures[0], s.failures[1:]
+		}
+		apiKey := s.apiKey
+		s.mu.Unlock()
+
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fail != 0 {
+			writeError(w, fail, 14, http.StatusText(fail))
+			return
+		}
+		if r.URL.Path != "/version" && r.Header.Get("Authorization") != "Bearer "+apiKey {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// SetLatency delays every following response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Fail makes the next len(statuses) requests fail with those statuses,
+// in order, before any other handling.
+func (s *Server) Fail(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// RevokeKey makes the server reject every API key with 401.
+func (s *Server) RevokeKey() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKey = "\x00revoked"
+}
+
+// SetVersion changes what /version reports; "" makes it 404.
+func (s *Server) SetVersion(v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = v
+}
+
+// SetRelease makes the server speak the API of an older release. Those
+// have no /version, so it stops reporting one.
+func (s *Server) SetRelease(r Release) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release = r
+	if r != Release026 {
+		s.version = ""
+	}
+}
+
+// Requests returns "METHOD /path" for every request received so far.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// ResetRequests clears the request log.
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+func (s *Server) id() string {
+	s.nextID++
+	return strconv.Itoa(s.nextID)
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// AddUser creates a user directly, bypassing the API.
+func (s *Server) AddUser(name string) model.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := model.User{ID: s.id(), Name: name, CreatedAt: now()}
+	s.users = append(s.users, u)
+	return u
+}
+
+// AddNode registers a node owned by the named user, which must exist.
+// Fields left zero get plausible defaults.
+func (s *Server) AddNode(user string, n model.Node) model.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.users, func(u model.User) bool { return u.Name == user })
+	if i < 0 {
+		panic("headscaletest: no user " + user)
+	}
+	u := s.users[i]
+	n.User = &u
+	if n.ID == "" {
+		n.ID = s.id()
+	}
+	if n.GivenName == "" {
+		n.GivenName = n.Name
+	}
+	if len(n.IPAddresses) == 0 {
+		n.IPAddresses = []string{"100.64.0." + n.ID, "fd7a:115c:a1e0::" + n.ID}
+	}
+	if n.CreatedAt == "" {
+		n.CreatedAt = now()
+	}
+	if n.LastSeen == "" {
+		n.LastSeen = now()
+	}
+	if n.RegisterMethod == "" {
+		n.RegisterMethod = "REGISTER_METHOD_AUTH_KEY"
+	}
+	for _, k := range []struct {
+		field  *string
+		prefix string
+	}{{&n.MachineKey, "mkey:"}, {&n.NodeKey, "nodekey:"}, {&n.DiscoKey, "discokey:"}} {
+		if *k.field == "" {
+			*k.field = k.prefix + fmt.Sprintf("%064s", n.ID)
+		}
+	}
+	s.nodes = append(s.nodes, n)
+	return n
+}
+
+// AddPreAuthKey creates a pre-auth key for the named user, which must
+// exist, bypassing the API.
+func (s *Server) AddPreAuthKey(user string, k PreAuthKey) PreAuthKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.users, func(u model.User) bool { return u.Name == user })
+	if i < 0 {
+		panic("headscaletest: no user " + user)
+	}
+	u := s.users[i]
+	k.User = &u
+	if k.ID == "" {
+		k.ID = s.id()
+	}
+	if k.Key == "" {
+		k.Key = "hskey-auth-" + k.ID
+	}
+	if k.CreatedAt == "" {
+		k.CreatedAt = now()
+	}
+	s.keys = append(s.keys, k)
+	return k
+}
+
+// Users returns a copy of the current users.
+func (s *Server) Users() []model.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.users)
+}
+
+// Node returns the node with id, if any.
+func (s *Server) Node(id string) (model.Node, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.nodeIndex(id); i >= 0 {
+		return s.nodes[i], true
+	}
+	return model.Node{}, false
+}
+
+// Policy returns the stored ACL policy.
+func (s *Server) Policy() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policy
+}
+
+func (s *Server) nodeIndex(id string) int {
+	return slices.IndexFunc(s.nodes, func(n model.Node) bool { return n.ID == id })
+}
+
+func (s *Server) userIndex(id string) int {
+	return slices.IndexFunc(s.users, func(u model.User) bool { return u.ID == id })
+}
+
+func (s *Server) userNamed(name string) int {
+	return slices.IndexFunc(s.users, func(u model.User) bool { return u.Name == name })
+}
+
+// userRef finds the user a path or body names: by name on v0.23, by ID
+// since v0.24.
+func (s *Server) userRef(ref string) int {
+	if s.release == Release023 {
+		return s.userNamed(ref)
+	}
+	return s.userIndex(ref)
+}
+
+// ownerRef finds the user that moving a node or listing pre-auth keys
+// names: by name before v0.26, by ID since.
+func (s *Server) ownerRef(ref string) int {
+	if s.release != Release026 {
+		return s.userNamed(ref)
+	}
+	return s.userIndex(ref)
+}
+
+// userNotFound answers like the release would: v0.23 returns its
+// not-found error unmapped, which the gateway turns into a 500.
+func (s *Server) userNotFound(w http.ResponseWriter, ref string) {
+	if s.release == Release023 {
+		writeError(w, http.StatusInternalServerError, 2, "user not found")
+		return
+	}
+	notFound(w, "user", ref)
+}
+
+// encodeNode returns n as the release encodes it: before v0.26 routes
+// are not on the node and tags are split into forced and valid ones.
+func (s *Server) encodeNode(n model.Node) model.Node {
+	if s.release == Release026 {
+		return n
+	}
+	n.ApprovedRoutes, n.AvailableRoutes, n.SubnetRoutes = nil, nil, nil
+	n.ForcedTags, n.Tags = n.Tags, nil
+	if n.User != nil {
+		u := *n.User
+		u.DisplayName, u.Email, u.ProfilePicURL = s.userExtras(u)
+		n.User = &u
+	}
+	return n
+}
+
+// userExtras drops the user fields v0.23 does not have.
+func (s *Server) userExtras(u model.User) (displayName, email, picture string) {
+	if s.release == Release023 {
+		return "", "", ""
+	}
+	return u.DisplayName, u.Email, u.ProfilePicURL
+}
+
+// gatewayError answers like the gRPC gateway does for a path or method
+// the release does not route.
+func gatewayError(w http.ResponseWriter, status int) {
+	code := 5
+	if status == http.StatusNotImplemented {
+		code = 12
+	}
+	writeError(w, status, code, http.StatusText(status))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers like the gRPC gateway: an HTTP status plus a JSON
+// body carrying the gRPC code.
+func writeError(w http.ResponseWriter, status, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(model.ErrorResponse{Code: code, Message: msg})
+}
+
+func notFound(w http.ResponseWriter, what, id string) {
+	writeError(w, http.StatusNotFound, 5, fmt.Sprintf("%s %s not found", what, id))
+}
+
+func (s *Server) getVersion(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	v := s.version
+	s.mu.Unlock()
+	if v == "" {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, map[string]string{"version": v})
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]model.User, len(s.users))
+	for i, u := range s.users {
+		u.DisplayName, u.Email, u.ProfilePicURL = s.userExtras(u)
+		users[i] = u
+	}
+	writeJSON(w, model.UsersResponse{Users: users})
+}
+
+// getUser only exists on v0.23; later gateways have no GET route there.
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.release != Release023 {
+		gatewayError(w, http.StatusNotImplemented)
+		return
+	}
+	i := s.userNamed(r.PathValue("name"))
+	if i < 0 {
+		s.userNotFound(w, r.PathValue("name"))
+		return
+	}
+	writeJSON(w, model.UserResponse{User: s.users[i]})
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+		Email       string `json:"email"`
+		PictureURL  string `json:"pictureUrl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, 3, "name is required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.ContainsFunc(s.users, func(u model.User) bool { return u.Name == req.Name }) {
+		writeError(w, http.StatusConflict, 6, "user already exists")
+		return
+	}
+	u := model.User{
+		ID: s.id(), Name: req.Name, CreatedAt: now(),
+		DisplayName: req.DisplayName, Email: req.Email, ProfilePicURL: req.PictureURL,
+	}
+	u.DisplayName, u.Email, u.ProfilePicURL = s.userExtras(u)
+	s.users = append(s.users, u)
+	writeJSON(w, model.UserResponse{User: u})
+}
+
+func (s *Server) renameUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.userRef(r.PathValue("id"))
+	if i < 0 {
+		s.userNotFound(w, r.PathValue("id"))
+		return
+	}
+	s.users[i].Name = r.PathValue("name")
+	for j := range s.nodes {
+		if s.nodes[j].User != nil && s.nodes[j].User.ID == s.users[i].ID {
+			u := s.users[i]
+			s.nodes[j].User = &u
+		}
+	}
+	writeJSON(w, model.UserResponse{User: s.users[i]})
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.userRef(r.PathValue("id"))
+	if i < 0 {
+		s.userNotFound(w, r.PathValue("id"))
+		return
+	}
+	id := s.users[i].ID
+	if slices.ContainsFunc(s.nodes, func(n model.Node) bool { return n.User != nil && n.User.ID == id }) {
+		writeError(w, http.StatusPreconditionFailed, 9, "user still owns nodes")
+		return
+	}
+	s.users = slices.Delete(s.users, i, i+1)
+	writeJSON(w, struct{}{})
+}
+
+func (s *Server) listNodes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := r.URL.Query().Get("user")
+	nodes := []model.Node{}
+	for _, n := range s.nodes {
+		if user == "" || (n.User != nil && n.User.Name == user) {
+			nodes = append(nodes, s.encodeNode(n))
+		}
+	}
+	writeJSON(w, model.NodesResponse{Nodes: nodes})
+}
+
+// withNode runs fn on the node named by the {id} path value under the lock
+// and answers with the node afterwards.
+func (s *Server) withNode(w http.ResponseWriter, r *http.Request, fn func(n *model.Node) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.nodeIndex(r.PathValue("id"))
+	if i < 0 {
+		notFound(w, "node", r.PathValue("id"))
+		return
+	}
+	if fn != nil && !fn(&s.nodes[i]) {
+		return
+	}
+	writeJSON(w, model.NodeResponse{Node: s.encodeNode(s.nodes[i])})
+}
+
+func (s *Server) getNode(w http.ResponseWriter, r *http.Request) {
+	s.withNode(w, r, nil)
+}
+
+func (s *Server) renameNode(w http.ResponseWriter, r *http.Request) {
+	s.withNode(w, r, func(n *model.Node) bool {
+		n.GivenName = r.PathValue("name")
+		return true
+	})
+}
+
+func (s *Server) expireNode(w http.ResponseWriter, r *http.Request) {
+	s.withNode(w, r, func(n *model.Node) bool {
+		n.Expiry = now()
+		return true
+	})
+}
+
+func (s *Server) deleteNode(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.nodeIndex(r.PathValue("id"))
+	if i < 0 {
+		notFound(w, "node", r.PathValue("id"))
+		return
+	}
+	s.nodes = slices.Delete(s.nodes, i, i+1)
+	writeJSON(w, struct{}{})
+}
+
+// moveNode takes the new owner from the body, except on v0.23 where the
+// route has no body and the owner's name comes from the query.
+func (s *Server) moveNode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User string `json:"user"`
+	}
+	s.mu.Lock()
+	release := s.release
+	s.mu.Unlock()
+	if release == Release023 {
+		req.User = r.URL.Query().Get("user")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+	s.withNode(w, r, func(n *model.Node) bool {
+		i := s.ownerRef(req.User)
+		if i < 0 {
+			notFound(w, "user", req.User)
+			return false
+		}
+		u := s.users[i]
+		n.User = &u
+		return true
+	})
+}
+
+func (s *Server) setTags(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+	s.withNode(w, r, func(n *model.Node) bool {
+		for _, t := range req.Tags {
+			if !strings.HasPrefix(t, "tag:") {
+				writeError(w, http.StatusBadRequest, 3, fmt.Sprintf("tag %q must start with tag:", t))
+				return false
+			}
+		}
+		n.Tags = req.Tags
+		return true
+	})
+}
+
+func (s *Server) approveRoutes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	release := s.release
+	s.mu.Unlock()
+	if release != Release026 {
+		gatewayError(w, http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Routes []string `json:"routes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+	s.withNode(w, r, func(n *model.Node) bool {
+		n.ApprovedRoutes = req.Routes
+		return true
+	})
+}
+
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []any{}
+	owner := -1
+	if user := r.URL.Query().Get("user"); user != "" {
+		if owner = s.ownerRef(user); owner < 0 {
+			writeJSON(w, map[string]any{"preAuthKeys": keys})
+			return
+		}
+	}
+	for _, k := range s.keys {
+		if owner >= 0 && k.User.ID != s.users[owner].ID {
+			continue
+		}
+		if s.release == Release026 {
+			keys = append(keys, k)
+			continue
+		}
+		// Before v0.26 a key names its user instead of embedding it.
+		keys = append(keys, struct {
+			PreAuthKey
+			User string `json:"user"`
+		}{k, k.User.Name})
+	}
+	writeJSON(w, map[string]any{"preAuthKeys": keys})
+}
+
+// route is a subnet route as the routes API before v0.26 returns it. Every
+// prefix a node advertises is one route, enabled when it is approved.
+type route struct {
+	ID   string `json:"id"`
+	Node struct {
+		ID string `json:"id"`
+	} `json:"node"`
+	Prefix     string `json:"prefix"`
+	Advertised bool   `json:"advertised"`
+	Enabled    bool   `json:"enabled"`
+}
+
+// routeID numbers a node's routes after the node: route "7.2" is the
+// second prefix of node 7.
+func routeID(nodeID string, i int) string {
+	return nodeID + "." + strconv.Itoa(i+1)
+}
+
+func (s *Server) nodeRouteList(n model.Node) []route {
+	out := []route{}
+	for i, p := range n.AvailableRoutes {
+		rt := route{ID: routeID(n.ID, i), Prefix: p, Advertised: true, Enabled: slices.Contains(n.ApprovedRoutes, p)}
+		rt.Node.ID = n.ID
+		out = append(out, rt)
+	}
+	return out
+}
+
+func (s *Server) listRoutes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.release == Release026 {
+		gatewayError(w, http.StatusNotFound)
+		return
+	}
+	routes := []route{}
+	for _, n := range s.nodes {
+		routes = append(routes, s.nodeRouteList(n)...)
+	}
+	writeJSON(w, map[string]any{"routes": routes})
+}
+
+func (s *Server) nodeRoutes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.release == Release026 {
+		gatewayError(w, http.StatusNotFound)
+		return
+	}
+	i := s.nodeIndex(r.PathValue("id"))
+	if i < 0 {
+		notFound(w, "node", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, map[string]any{"routes": s.nodeRouteList(s.nodes[i])})
+}
+
+// switchRoute enables or disables one route by approving or unapproving
+// its prefix on the node.
+func (s *Server) switchRoute(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	action := r.PathValue("action")
+	if s.release == Release026 || (action != "enable" && action != "disable") {
+		gatewayError(w, http.StatusNotFound)
+		return
+	}
+	id := r.PathValue("id")
+	for ni := range s.nodes {
+		n := &s.nodes[ni]
+		for i, p := range n.AvailableRoutes {
+			if routeID(n.ID, i) != id {
+				continue
+			}
+			n.ApprovedRoutes = slices.DeleteFunc(n.ApprovedRoutes, func(a string) bool { return a == p })
+			if action == "enable" {
+				n.ApprovedRoutes = append(n.ApprovedRoutes, p)
+			}
+			writeJSON(w, struct{}{})
+			return
+		}
+	}
+	notFound(w, "route", id)
+}
+
+func (s *Server) createKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User       string `json:"user"`
+		Reusable   bool   `json:"reusable"`
+		Ephemeral  bool   `json:"ephemeral"`
+		Expiration string `json:"expiration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.userIndex(req.User)
+	if i < 0 {
+		notFound(w, "user", req.User)
+		return
+	}
+	u := s.users[i]
+	id := s.id()
+	k := PreAuthKey{
+		ID: id, User: &u, Key: "hskey-auth-" + id,
+		Reusable: req.Reusable, Ephemeral: req.Ephemeral,
+		Expiration: req.Expiration, CreatedAt: now(),
+	}
+	s.keys = append(s.keys, k)
+	writeJSON(w, map[string]any{"preAuthKey": k})
+}
+
+func (s *Server) expireKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User string `json:"user"`
+		Key  string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.keys, func(k PreAuthKey) bool { return k.Key == req.Key })
+	if i < 0 {
+		notFound(w, "pre-auth key", req.Key)
+		return
+	}
+	s.keys[i].Expiration = now()
+	writeJSON(w, struct{}{})
+}
+
+func (s *Server) getPolicy(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, map[string]string{"policy": s.policy, "updatedAt": now()})
+}
+
+func (s *Server) setPolicy(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Policy string `json:"policy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, 3, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = req.Policy
+	writeJSON(w, map[string]string{"policy": s.policy, "updatedAt": now()})
+}
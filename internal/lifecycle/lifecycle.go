@@ -0,0 +1,82 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Manager runs background workers (HTTP servers, pollers, schedulers)
+// under a shared context. When the context is cancelled, or any worker
+// fails, every worker is asked to stop and Wait blocks until they have.
+type Manager struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func New(parent context.Context) *Manager {
+	ctx, cancel := context.WithCancel(parent)
+	return &Manager{ctx: ctx, cancel: cancel}
+}
+
+// Go starts fn in its own goroutine. fn must return once ctx is done.
+// A non-nil error other than context.Canceled stops all other workers.
+func (m *Manager) Go(name string, fn func(ctx context.Context) error) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		log.Printf("worker %s: started", name)
+		err := fn(m.ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("worker %s: %v", name, err)
+			m.mu.Lock()
+			if m.err == nil {
+				m.err = err
+			}
+			m.mu.Unlock()
+			m.cancel()
+			return
+		}
+		log.Printf("worker %s: stopped", name)
+	}()
+}
+
+// Every runs fn immediately and then at every interval until stopped.
+// Errors from fn are logged and do not stop the worker.
+func (m *Manager) Every(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	m.Go(name, func(ctx context.Context) error {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if err := fn(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("worker %s: %v", name, err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-t.C:
+			}
+		}
+	})
+}
+
+// Stop asks every worker to shut down.
+func (m *Manager) Stop() {
+	m.cancel()
+}
+
+// Wait blocks until the parent context is cancelled or a worker fails,
+// then until every worker has returned. It reports the first failure.
+func (m *Manager) Wait() error {
+	<-m.ctx.Done()
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
@@ -1,11 +1,29 @@
 package model
 
+import (
+	"encoding/json"
+	"net/mail"
+	"strings"
+	"time"
+)
+
 type Settings struct {
 	ID        int    `json:"id"`
 	BaseURL   string `json:"base_url"`
 	APIKey    string `json:"api_key"`
 	CreatedAt string `json:"created_at"`
 	UpdatedAt string `json:"updated_at"`
+	// Per-call timeouts in seconds for read (GET) and write operations.
+	ReadTimeout  int `json:"read_timeout"`
+	WriteTimeout int `json:"write_timeout"`
+	// Transport is "rest" or "grpc". The gRPC address defaults to the
+	// base URL's host on port 50443.
+	Transport   string `json:"transport"`
+	GRPCAddress string `json:"grpc_address"`
+	GRPCTLS     string `json:"grpc_tls"`
+	// RequireTOTP makes password accounts that can delete users or nodes
+	// set up two-factor authentication before they can do anything else.
+	RequireTOTP bool `json:"require_totp"`
 }
 
 type User struct {
@@ -30,7 +48,230 @@ type Node struct {
 	Online          bool     `json:"online"`
 	ApprovedRoutes  []string `json:"approvedRoutes"`
 	AvailableRoutes []string `json:"availableRoutes"`
+	SubnetRoutes    []string `json:"subnetRoutes"`
 	Tags            []string `json:"tags"`
+
+	MachineKey string `json:"machineKey"`
+	NodeKey    string `json:"nodeKey"`
+	DiscoKey   string `json:"discoKey"`
+	// PreAuthKey is the key the node registered with, if any.
+	PreAuthKey *PreAuthKey `json:"preAuthKey,omitempty"`
+	// Before the tags rework Headscale reported where tags came from:
+	// ForcedTags were set by an admin, ValidTags were requested by the node
+	// and allowed by the policy, InvalidTags were requested but refused.
+	// Tags holds the forced and valid ones either way.
+	ForcedTags  []string `json:"forcedTags,omitempty"`
+	ValidTags   []string `json:"validTags,omitempty"`
+	InvalidTags []string `json:"invalidTags,omitempty"`
+
+	// Raw is the node as the REST gateway returned it from a single-node
+	// call. It is nil for lists and over gRPC.
+	Raw json.RawMessage `json:"-"`
+}
+
+// PreAuthKey is a key that registers nodes for a user without logging in.
+// User is the owner's name.
+type PreAuthKey struct {
+	ID         string   `json:"id"`
+	User       string   `json:"user"`
+	Key        string   `json:"key"`
+	Reusable   bool     `json:"reusable"`
+	Ephemeral  bool     `json:"ephemeral"`
+	Used       bool     `json:"used"`
+	Expiration string   `json:"expiration"`
+	CreatedAt  string   `json:"createdAt"`
+	ACLTags    []string `json:"aclTags"`
+}
+
+// Account is a dashboard login. Accounts are HeadControl's own and have
+// nothing to do with Headscale users.
+type Account struct {
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	Role         string `json:"role"`
+	// Subject is the OpenID Connect subject of accounts that sign in
+	// through the identity provider. They have no password.
+	Subject   string `json:"subject,omitempty"`
+	CreatedAt string `json:"created_at"`
+	// TOTPSecret is set from the start of enrolment; TOTPEnabled once the
+	// first code was confirmed. TOTPLastStep is the time step of the last
+	// accepted code, which cannot be used again.
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"-"`
+	// SessionGen is part of every session cookie issued to the account.
+	// Raising it signs out every session issued before.
+	SessionGen int64 `json:"-"`
+}
+
+// NeedsTOTP reports whether policy requires an enrolment this account has
+// not done yet. Single sign-on accounts are left to the identity provider.
+func (a *Account) NeedsTOTP(s *Settings) bool {
+	return s != nil && s.RequireTOTP && a.Subject == "" && !a.TOTPEnabled && a.Can(RoleOperator)
+}
+
+// Roles, from least to most privileged. Viewers only read, operators also
+// change users and nodes, admins also manage settings and accounts.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// HigherRole returns the more privileged of a and b.
+func HigherRole(a, b string) string {
+	if roleRank[b] > roleRank[a] {
+		return b
+	}
+	return a
+}
+
+// Can reports whether the account's role includes role.
+func (a *Account) Can(role string) bool {
+	return a != nil && roleRank[a.Role] >= roleRank[role] && roleRank[role] > 0
+}
+
+// LoginFailure counts failed logins for one key, "ip:<addr>" or
+// "account:<username>".
+type LoginFailure struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// PendingAction is a deletion held back for the undo window before it is
+// sent to Headscale. Finished actions are kept for their snapshot. A user
+// deletion carries the steps planned for the user's nodes.
+type PendingAction struct {
+	ID          int64
+	Kind        string
+	TargetID    string
+	TargetName  string
+	Snapshot    Snapshot
+	Steps       []PlanStep
+	RequestedBy string
+	CreatedAt   time.Time
+	ExecuteAt   time.Time
+	Status      string
+	Error       string
+	FinishedAt  time.Time
+}
+
+const (
+	ActionDeleteUser = "delete-user"
+	ActionDeleteNode = "delete-node"
+)
+
+const (
+	ActionPending = "pending"
+	ActionRunning = "running"
+	ActionDone    = "done"
+	ActionUndone  = "undone"
+	ActionFailed  = "failed"
+	// ActionKept is a user deletion whose plan ran but kept the user,
+	// because it expired nodes that stay with them.
+	ActionKept = "kept"
+)
+
+// PlanStep is one step of a user deletion plan. Steps run in order and
+// the first failure stops the rest.
+type PlanStep struct {
+	Op       string `json:"op"`
+	NodeID   string `json:"nodeId,omitempty"`
+	NodeName string `json:"nodeName,omitempty"`
+	UserID   string `json:"userId,omitempty"`
+	UserName string `json:"userName,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Plan step operations. StepMove gives the node to UserID; StepDeleteUser
+// deletes the user the plan belongs to.
+const (
+	StepMove       = "move"
+	StepExpire     = "expire"
+	StepDelete     = "delete"
+	StepDeleteUser = "delete-user"
+)
+
+// Plan step states besides waiting, which is the empty string.
+const (
+	StepRunning = "running"
+	StepDone    = "done"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+)
+
+// Snapshot is what a deleted user or node looked like: enough to recreate
+// the user, re-register its nodes and put their tags and routes back.
+type Snapshot struct {
+	User  *User  `json:"user,omitempty"`
+	Nodes []Node `json:"nodes,omitempty"`
+}
+
+// AuditEvent records a change to a Headscale user or node made through
+// HeadControl. UserID is the owner at the time of the change.
+type AuditEvent struct {
+	ID     int64
+	At     time.Time
+	Actor  string
+	Action string
+	UserID string
+	NodeID string
+	Target string
+	Detail string
+}
+
+const (
+	EventUserCreate        = "user.create"
+	EventUserRename        = "user.rename"
+	EventUserProfile       = "user.profile"
+	EventUserDeleteRequest = "user.delete-requested"
+	EventUserDelete        = "user.delete"
+	EventNodeRename        = "node.rename"
+	EventNodeExpire        = "node.expire"
+	EventNodeTags          = "node.tags"
+	EventNodeRoutes        = "node.routes"
+	EventNodeMove          = "node.move"
+	EventNodeDeleteRequest = "node.delete-requested"
+	EventNodeDelete        = "node.delete"
+	EventUndo              = "undo"
+)
+
+// UserProfile holds the display name, email and picture HeadControl shows
+// for a user in place of Headscale's. Headscale cannot change them after
+// the user is created, so edits are kept here.
+type UserProfile struct {
+	UserID      string
+	DisplayName string
+	Email       string
+	PictureURL  string
+	// AvatarType is the content type of an uploaded picture, empty when
+	// there is none.
+	AvatarType string
+	UpdatedAt  time.Time
+}
+
+// Apply shows the profile's values on u.
+func (p *UserProfile) Apply(u *User) {
+	u.DisplayName = p.DisplayName
+	u.Email = p.Email
+	u.ProfilePicURL = p.PictureURL
+}
+
+// ValidEmail reports whether s is a bare email address such as
+// alice@example.com, without a display name or angle brackets.
+func ValidEmail(s string) bool {
+	a, err := mail.ParseAddress(s)
+	return err == nil && a.Address == s && strings.Contains(s[strings.LastIndex(s, "@"):], ".")
 }
 
 type DashboardStats struct {
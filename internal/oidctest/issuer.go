@@ -0,0 +1,243 @@
+// Package oidctest runs an in-process OpenID Connect provider for tests.
+// It implements discovery, the authorization code flow with PKCE and a
+// JWKS endpoint, and approves every authorization request as the user set
+// with SignIn.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	ClientID     = "headcontrol"
+	ClientSecret = "test-client-secret"
+	keyID        = "test-key"
+)
+
+type Issuer struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	user   map[string]interface{}
+	grants map[string]grant
+	// tamper edits the claims of the next ID token.
+	tamper func(map[string]interface{})
+}
+
+type grant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	claims      map[string]interface{}
+}
+
+// New starts an issuer for ClientID and ClientSecret and stops it when the
+// test ends.
+func New(t testing.TB) *Issuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &Issuer{key: key, grants: make(map[string]grant)}
+	i.Server = httptest.NewServer(i.routes())
+	t.Cleanup(i.Close)
+	return i
+}
+
+func (i *Issuer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("GET /authorize", i.authorize)
+	mux.HandleFunc("POST /token", i.token)
+	mux.HandleFunc("GET /jwks", i.jwks)
+	return mux
+}
+
+// SignIn sets the user that authorization requests are approved for. The
+// claims are added to the ID token; sub is required.
+func (i *Issuer) SignIn(claims map[string]interface{}) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.user = claims
+}
+
+// Tamper makes fn edit the claims of the next ID token before it is
+// signed, to test validation.
+func (i *Issuer) Tamper(fn func(claims map[string]interface{})) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.tamper = fn
+}
+
+// Authorize follows an authorization URL as a browser would and returns
+// the callback URL the issuer redirects to.
+func (i *Issuer) Authorize(t testing.TB, authURL string) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s", resp.Status)
+	}
+	return resp.Header.Get("Location")
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+	})
+}
+
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != ClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	i.mu.Lock()
+	user := i.user
+	i.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("state", q.Get("state"))
+	if user == nil {
+		back.Set("error", "access_denied")
+		back.Set("error_description", "no user signed in")
+	} else {
+		code := random()
+		i.mu.Lock()
+		i.grants[code] = grant{
+			redirectURI: redirect.String(),
+			challenge:   q.Get("code_challenge"),
+			nonce:       q.Get("nonce"),
+			claims:      user,
+		}
+		i.mu.Unlock()
+		back.Set("code", code)
+	}
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	// RFC 6749 form-encodes the credentials before Basic encoding.
+	id, secret, ok := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if !ok || id != ClientID || secret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	code := r.PostFormValue("code")
+	i.mu.Lock()
+	g, ok := i.grants[code]
+	delete(i.grants, code)
+	tamper := i.tamper
+	i.tamper = nil
+	i.mu.Unlock()
+
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != g.redirectURI {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   i.URL,
+		"aud":   ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": g.nonce,
+	}
+	for k, v := range g.claims {
+		claims[k] = v
+	}
+	if tamper != nil {
+		tamper(claims)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": random(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     i.Sign(claims),
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := i.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// Sign returns claims as an RS256 JWT signed with the issuer's key.
+func (i *Issuer) Sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func random() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const (
+	csrfCookie = "headcontrol_csrf"
+	// CSRFHeader carries the token on state-changing requests. HTMX sends
+	// it on every request through hx-headers on <body>.
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// CSRF guards every request that is not GET, HEAD, OPTIONS or TRACE. Each
+// browser gets a random session ID in a SameSite=Strict cookie, and pages
+// carry a token derived from it with HMAC-SHA256, so a token cannot be
+// forged without the secret even by someone able to set cookies. The
+// Origin (or Referer) must also name this server.
+type CSRF struct {
+	key  []byte
+	path string
+	// Reject answers failed checks. By default it replies 403 with a
+	// plain-text message.
+	Reject http.Handler
+}
+
+// NewCSRF derives tokens from secret. cookiePath is the base path the app
+// is served under.
+func NewCSRF(secret, cookiePath string) *CSRF {
+	if cookiePath == "" {
+		cookiePath = "/"
+	}
+	return &CSRF{key: []byte(secret), path: cookiePath}
+}
+
+// RandomSecret returns a secret for when none is configured. Sessions and
+// open pages do not survive a restart with it.
+func RandomSecret() string {
+	return newSessionID()
+}
+
+func (c *CSRF) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sid := ""
+		if ck, err := r.Cookie(csrfCookie); err == nil {
+			sid = ck.Value
+		}
+
+		if !safeMethod(r.Method) {
+			if msg := c.check(r, sid); msg != "" {
+				log.Printf("csrf: %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, msg)
+				c.reject(w, r)
+				return
+			}
+		} else if sid == "" {
+			sid = newSessionID()
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    sid,
+				Path:     c.path,
+				HttpOnly: true,
+				Secure:   Scheme(r) == "https",
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		ctx := context.WithValue(r.Context(), csrfTokenKey, c.token(sid))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// check returns why r fails the CSRF checks, or "" when it passes.
+func (c *CSRF) check(r *http.Request, sid string) string {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme != Scheme(r) || u.Host != r.Host {
+			return "cross-origin request from " + origin
+		}
+	}
+	if sid == "" {
+		return "no session cookie"
+	}
+	got := r.Header.Get(CSRFHeader)
+	if got == "" {
+		return "no token"
+	}
+	if !hmac.Equal([]byte(got), []byte(c.token(sid))) {
+		return "token mismatch"
+	}
+	return ""
+}
+
+func (c *CSRF) reject(w http.ResponseWriter, r *http.Request) {
+	if c.Reject != nil {
+		c.Reject.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, "Forbidden: the request could not be verified. Reload the page and try again.", http.StatusForbidden)
+}
+
+func (c *CSRF) token(sid string) string {
+	if sid == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte("csrf:" + sid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CSRFToken returns the token pages must send back in the X-CSRF-Token
+// header, or "" when the request did not pass through CSRF.Handler.
+func CSRFToken(r *http.Request) string {
+	t, _ := r.Context().Value(csrfTokenKey).(string)
+	return t
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func safeMethod(m string) bool {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
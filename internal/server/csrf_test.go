@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	c := NewCSRF("0123456789abcdef0123456789abcdef", "/")
+	var token string
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = CSRFToken(r)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].SameSite != http.SameSiteStrictMode || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %+v, want one HttpOnly SameSite=Strict cookie", cookies)
+	}
+	if token == "" {
+		t.Fatal("no token in the request context")
+	}
+	session := cookies[0]
+
+	other := httptest.NewRecorder()
+	h.ServeHTTP(other, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	otherToken := token
+
+	for _, tc := range []struct {
+		name   string
+		cookie bool
+		token  string
+		origin string
+		want   int
+	}{
+		{"valid", true, "", "", http.StatusOK},
+		{"same origin", true, "", "http://example.com", http.StatusOK},
+		{"no token", true, "-", "", http.StatusForbidden},
+		{"no cookie", false, "", "", http.StatusForbidden},
+		{"other session's token", true, otherToken, "", http.StatusForbidden},
+		{"cross origin", true, "", "https://evil.example", http.StatusForbidden},
+		{"null origin", true, "", "null", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/api/users/delete", nil)
+			if tc.cookie {
+				req.AddCookie(session)
+			}
+			switch tc.token {
+			case "":
+				req.Header.Set(CSRFHeader, c.token(session.Value))
+			case "-":
+			default:
+				req.Header.Set(CSRFHeader, tc.token)
+			}
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type ctxKey int
+
+const (
+	schemeKey ctxKey = iota
+	csrfTokenKey
+	cspNonceKey
+)
+
+// Proxies honours X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host,
+// but only on requests whose peer address is one of the trusted proxies.
+type Proxies struct {
+	trusted []netip.Prefix
+}
+
+// ParseProxies accepts IP addresses and CIDR ranges.
+func ParseProxies(entries []string) (*Proxies, error) {
+	p := &Proxies{}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			addr, err := netip.ParseAddr(e)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", e, err)
+			}
+			p.trusted = append(p.trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", e, err)
+		}
+		p.trusted = append(p.trusted, prefix.Masked())
+	}
+	return p, nil
+}
+
+func (p *Proxies) isTrusted(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxies) Handler(next http.Handler) http.Handler {
+	if len(p.trusted) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !p.isTrusted(host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		if client := p.clientIP(r.Header.Values("X-Forwarded-For")); client != "" {
+			r.RemoteAddr = net.JoinHostPort(client, port)
+		}
+		if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			r = r.WithContext(context.WithValue(r.Context(), schemeKey, proto))
+		}
+		if fwdHost := firstValue(r.Header.Get("X-Forwarded-Host")); fwdHost != "" {
+			r.Host = fwdHost
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP walks X-Forwarded-For from the right, skipping trusted proxies,
+// and returns the first address that was not added by one of them.
+func (p *Proxies) clientIP(values []string) string {
+	var hops []string
+	for _, v := range values {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hops = append(hops, h)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if _, err := netip.ParseAddr(hops[i]); err != nil {
+			return ""
+		}
+		if !p.isTrusted(hops[i]) || i == 0 {
+			return hops[i]
+		}
+	}
+	return ""
+}
+
+func firstValue(v string) string {
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// Scheme returns "https" or "http" for r, taking a trusted
+// X-Forwarded-Proto into account.
+func Scheme(r *http.Request) string {
+	if s, ok := r.Context().Value(schemeKey).(string); ok {
+		return s
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	idleTimeout       = 120 * time.Second
+
+	// WriteTimeout bounds a whole response, including the Headscale calls
+	// behind it; headscale.MaxTimeout is chosen to fit inside it.
+	WriteTimeout = 60 * time.Second
+
+	// ShutdownTimeout bounds how long in-flight requests may take to
+	// finish once a shutdown has been requested.
+	ShutdownTimeout = 20 * time.Second
+)
+
+func New(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// Run serves srv until ctx is done, then stops accepting connections and
+// waits up to ShutdownTimeout for in-flight requests to drain. TLS is used
+// when srv.TLSConfig is set.
+func Run(ctx context.Context, srv *http.Server) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errCh <- srv.ListenAndServeTLS("", "")
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("server %s: shutting down, draining requests", srv.Addr)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
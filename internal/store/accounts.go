@@ -0,0 +1,386 @@
+package store
+
+import (
+	"database/sql"
+	"headcontrol/internal/model"
+	"strings"
+	"time"
+)
+
+func (s *Store) migrateAccounts() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS accounts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS login_failures (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL,
+			last_failure INTEGER NOT NULL,
+			locked_until INTEGER NOT NULL DEFAULT 0
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	if err := s.addColumn("accounts", "oidc_subject", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	_, err = s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS accounts_oidc_subject ON accounts (oidc_subject) WHERE oidc_subject != ''")
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct{ name, def string }{
+		{"totp_secret", "TEXT NOT NULL DEFAULT ''"},
+		{"totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"session_gen", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := s.addColumn("accounts", c.name, c.def); err != nil {
+			return err
+		}
+	}
+	_, err = s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			account_id INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			used_at DATETIME
+		)
+	`)
+	return err
+}
+
+func (s *Store) CountAccounts() (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM accounts").Scan(&n)
+	return n, err
+}
+
+func (s *Store) CreateAccount(username, passwordHash, role string) (*model.Account, error) {
+	now := time.Now().Format(time.RFC3339)
+	res, err := s.db.Exec(
+		"INSERT INTO accounts (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)",
+		username, passwordHash, role, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &model.Account{ID: id, Username: username, PasswordHash: passwordHash, Role: role, CreatedAt: now}, nil
+}
+
+// SaveOIDCAccount creates or updates the account for an OpenID Connect
+// subject. The username and role follow the identity provider on every
+// sign-in.
+func (s *Store) SaveOIDCAccount(subject, username, role string) (*model.Account, error) {
+	a, err := scanAccount(s.db.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE oidc_subject = ?", subject))
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		now := time.Now().Format(time.RFC3339)
+		res, err := s.db.Exec(
+			"INSERT INTO accounts (username, password_hash, role, oidc_subject, created_at) VALUES (?, '', ?, ?, ?)",
+			username, role, subject, now,
+		)
+		if err != nil {
+			return nil, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		return &model.Account{ID: id, Username: username, Role: role, Subject: subject, CreatedAt: now}, nil
+	}
+	if _, err := s.db.Exec("UPDATE accounts SET username = ?, role = ? WHERE id = ?", username, role, a.ID); err != nil {
+		return nil, err
+	}
+	a.Username, a.Role = username, role
+	return a, nil
+}
+
+const accountColumns = "id, username, password_hash, role, oidc_subject, created_at, totp_secret, totp_enabled, totp_last_step, session_gen"
+
+func scanAccount(row interface{ Scan(...any) error }) (*model.Account, error) {
+	var a model.Account
+	err := row.Scan(&a.ID, &a.Username, &a.PasswordHash, &a.Role, &a.Subject, &a.CreatedAt,
+		&a.TOTPSecret, &a.TOTPEnabled, &a.TOTPLastStep, &a.SessionGen)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetAccount looks an account up by username, ignoring case. It returns
+// nil when there is none.
+func (s *Store) GetAccount(username string) (*model.Account, error) {
+	return scanAccount(s.db.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE username = ?", username))
+}
+
+func (s *Store) GetAccountByID(id int64) (*model.Account, error) {
+	return scanAccount(s.db.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = ?", id))
+}
+
+func (s *Store) ListAccounts() ([]model.Account, error) {
+	rows, err := s.db.Query("SELECT " + accountColumns + " FROM accounts ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []model.Account
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *a)
+	}
+	return out, rows.Err()
+}
+
+// RevokeSessions signs the account out everywhere by invalidating every
+// session cookie issued to it so far.
+func (s *Store) RevokeSessions(accountID int64) error {
+	_, err := s.db.Exec("UPDATE accounts SET session_gen = session_gen + 1 WHERE id = ?", accountID)
+	return err
+}
+
+// StartTOTP stores a new secret for an enrolment that is not confirmed
+// yet. Until EnableTOTP the account signs in without a second factor.
+func (s *Store) StartTOTP(accountID int64, secret string) error {
+	_, err := s.db.Exec("UPDATE accounts SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 WHERE id = ?", secret, accountID)
+	return err
+}
+
+// EnableTOTP confirms the enrolment with the step of the first code and
+// replaces the recovery codes.
+func (s *Store) EnableTOTP(accountID, step int64, recoveryHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE accounts SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, accountID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, accountID, recoveryHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ReplaceRecoveryCodes(accountID int64, hashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceRecoveryCodes(tx, accountID, hashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, accountID int64, hashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE account_id = ?", accountID); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (account_id, hash) VALUES (?, ?)", accountID, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) DisableTOTP(accountID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE accounts SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?", accountID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, accountID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records step as used. It returns false when that step or a
+// later one was used already, so a code can only be used once even by
+// concurrent requests.
+func (s *Store) UseTOTPStep(accountID, step int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE accounts SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, accountID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// UnusedRecoveryCodes returns the IDs and hashes of the recovery codes
+// the account has left.
+func (s *Store) UnusedRecoveryCodes(accountID int64) (map[int64]string, error) {
+	rows, err := s.db.Query("SELECT id, hash FROM recovery_codes WHERE account_id = ? AND used_at IS NULL", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id   int64
+			hash string
+		)
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		out[id] = hash
+	}
+	return out, rows.Err()
+}
+
+// UseRecoveryCode marks a recovery code used. It returns false when it was
+// used already.
+func (s *Store) UseRecoveryCode(id int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE recovery_codes SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now().Format(time.RFC3339), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// IsDuplicate reports whether err is a unique constraint violation.
+func IsDuplicate(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// GetLoginFailure returns the failure record for key, or nil when there is
+// none.
+func (s *Store) GetLoginFailure(key string) (*model.LoginFailure, error) {
+	var (
+		f            model.LoginFailure
+		last, locked int64
+	)
+	err := s.db.QueryRow("SELECT key, failures, last_failure, locked_until FROM login_failures WHERE key = ?", key).
+		Scan(&f.Key, &f.Failures, &last, &locked)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.LastFailure, f.LockedUntil = unixTime(last), unixTime(locked)
+	return &f, nil
+}
+
+// LockoutRule is how ChargeLoginFailure locks a key: from Threshold
+// failures on, for Base doubling with each further failure up to Max.
+// Failures older than Window are forgotten.
+type LockoutRule struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+	Window    time.Duration
+}
+
+// ChargeLoginFailure counts an attempt against key before its outcome is
+// known, unless key is locked out at now. The check and the count are one
+// statement, so concurrent attempts cannot all slip in under the
+// threshold. It returns false and the end of the lockout when the attempt
+// may not be made.
+func (s *Store) ChargeLoginFailure(key string, now time.Time, rule LockoutRule) (bool, time.Time, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO login_failures (key, failures, last_failure, locked_until)
+		VALUES (@key, 1, @now, CASE WHEN 1 >= @threshold THEN @now + @base ELSE 0 END)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN last_failure < @now - @window THEN 1 ELSE failures + 1 END,
+			last_failure = @now,
+			locked_until = CASE
+				WHEN (CASE WHEN last_failure < @now - @window THEN 1 ELSE failures + 1 END) >= @threshold
+				THEN @now + MIN(@base << MIN((CASE WHEN last_failure < @now - @window THEN 1 ELSE failures + 1 END) - @threshold, 30), @max)
+				ELSE 0 END
+		WHERE locked_until <= @now`,
+		sql.Named("key", key), sql.Named("now", now.Unix()), sql.Named("threshold", rule.Threshold),
+		sql.Named("base", int64(rule.Base.Seconds())), sql.Named("max", int64(rule.Max.Seconds())),
+		sql.Named("window", int64(rule.Window.Seconds())),
+	)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return err == nil, time.Time{}, err
+	}
+	f, err := s.GetLoginFailure(key)
+	if err != nil || f == nil {
+		return false, time.Time{}, err
+	}
+	return false, f.LockedUntil, nil
+}
+
+// RefundLoginFailure takes back an attempt charged to key that turned out
+// to be right, and lifts the lockout with it: the attempt was only allowed
+// while key was not locked, so a lockout now came from charging it or from
+// an attempt made at the same moment, and the next failure locks again.
+func (s *Store) RefundLoginFailure(key string) error {
+	_, err := s.db.Exec("UPDATE login_failures SET failures = failures - 1, locked_until = 0 WHERE key = ? AND failures > 0", key)
+	return err
+}
+
+func (s *Store) DeleteLoginFailure(key string) error {
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE key = ?", key)
+	return err
+}
+
+// ListLoginFailures returns every record with a failure since the given
+// time or a lockout that has not ended by then, most recent first.
+func (s *Store) ListLoginFailures(since time.Time) ([]model.LoginFailure, error) {
+	rows, err := s.db.Query(
+		"SELECT key, failures, last_failure, locked_until FROM login_failures WHERE last_failure >= ? OR locked_until > ? ORDER BY last_failure DESC",
+		since.Unix(), since.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []model.LoginFailure
+	for rows.Next() {
+		var (
+			f            model.LoginFailure
+			last, locked int64
+		)
+		if err := rows.Scan(&f.Key, &f.Failures, &last, &locked); err != nil {
+			return nil, err
+		}
+		f.LastFailure, f.LockedUntil = unixTime(last), unixTime(locked)
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func timeUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"headcontrol/internal/model"
+	"time"
+)
+
+func (s *Store) migrateActions() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS pending_actions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			target_id TEXT NOT NULL,
+			target_name TEXT NOT NULL,
+			snapshot TEXT NOT NULL,
+			requested_by TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			execute_at INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			error TEXT NOT NULL DEFAULT '',
+			finished_at INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS pending_actions_status ON pending_actions (status, execute_at);
+	`)
+	if err != nil {
+		return err
+	}
+	return s.addColumn("pending_actions", "steps", "TEXT NOT NULL DEFAULT ''")
+}
+
+// ResumeInterruptedActions puts actions left running by a server that
+// stopped without finishing them back in the queue. Only the server calls
+// it, before it starts running actions: the store is also opened by CLI
+// commands while a server may be executing them. Running an action again
+// is safe, as targets that are gone already count as deleted.
+func (s *Store) ResumeInterruptedActions() (int64, error) {
+	res, err := s.db.Exec("UPDATE pending_actions SET status = ? WHERE status = ?", model.ActionPending, model.ActionRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const actionColumns = "id, kind, target_id, target_name, snapshot, steps, requested_by, created_at, execute_at, status, error, finished_at"
+
+func scanAction(row interface{ Scan(...any) error }) (*model.PendingAction, error) {
+	var (
+		a                          model.PendingAction
+		snapshot, steps            string
+		created, execute, finished int64
+	)
+	err := row.Scan(&a.ID, &a.Kind, &a.TargetID, &a.TargetName, &snapshot, &steps, &a.RequestedBy,
+		&created, &execute, &a.Status, &a.Error, &finished)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(snapshot), &a.Snapshot); err != nil {
+		return nil, err
+	}
+	if steps != "" {
+		if err := json.Unmarshal([]byte(steps), &a.Steps); err != nil {
+			return nil, err
+		}
+	}
+	a.CreatedAt, a.ExecuteAt, a.FinishedAt = unixTime(created), unixTime(execute), unixTime(finished)
+	return &a, nil
+}
+
+func (s *Store) queryActions(query string, args ...any) ([]model.PendingAction, error) {
+	rows, err := s.db.Query("SELECT "+actionColumns+" FROM pending_actions "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []model.PendingAction
+	for rows.Next() {
+		a, err := scanAction(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *a)
+	}
+	return out, rows.Err()
+}
+
+// CreatePendingAction stores a as pending and sets its ID.
+func (s *Store) CreatePendingAction(a *model.PendingAction) error {
+	snapshot, err := json.Marshal(a.Snapshot)
+	if err != nil {
+		return err
+	}
+	steps, err := marshalSteps(a.Steps)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(
+		"INSERT INTO pending_actions (kind, target_id, target_name, snapshot, steps, requested_by, created_at, execute_at, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		a.Kind, a.TargetID, a.TargetName, string(snapshot), steps, a.RequestedBy, a.CreatedAt.Unix(), a.ExecuteAt.Unix(), model.ActionPending,
+	)
+	if err != nil {
+		return err
+	}
+	a.ID, err = res.LastInsertId()
+	a.Status = model.ActionPending
+	return err
+}
+
+func marshalSteps(steps []model.PlanStep) (string, error) {
+	if len(steps) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(steps)
+	return string(b), err
+}
+
+// UpdateActionSteps records the progress of a running action's plan.
+func (s *Store) UpdateActionSteps(id int64, steps []model.PlanStep) error {
+	b, err := marshalSteps(steps)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE pending_actions SET steps = ? WHERE id = ?", b, id)
+	return err
+}
+
+// GetPendingAction returns the action with id, or nil when there is none.
+func (s *Store) GetPendingAction(id int64) (*model.PendingAction, error) {
+	a, err := scanAction(s.db.QueryRow("SELECT "+actionColumns+" FROM pending_actions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+// PendingActions returns the actions still waiting for their undo window
+// to end, soonest first.
+func (s *Store) PendingActions() ([]model.PendingAction, error) {
+	return s.queryActions("WHERE status = ? ORDER BY execute_at, id", model.ActionPending)
+}
+
+// DuePendingActions returns the pending actions whose undo window ended by
+// now.
+func (s *Store) DuePendingActions(now time.Time) ([]model.PendingAction, error) {
+	return s.queryActions("WHERE status = ? AND execute_at <= ? ORDER BY execute_at, id", model.ActionPending, now.Unix())
+}
+
+// RecentActions returns the latest actions in any state, newest first.
+func (s *Store) RecentActions(limit int) ([]model.PendingAction, error) {
+	return s.queryActions("ORDER BY id DESC LIMIT ?", limit)
+}
+
+// UndoPendingAction cancels a pending action. It reports false when the
+// action is no longer pending, for example because it already ran.
+func (s *Store) UndoPendingAction(id int64) (bool, error) {
+	return s.moveAction(id, model.ActionPending, model.ActionUndone, "")
+}
+
+// ClaimPendingAction marks a pending action as running so it cannot be
+// undone any more. It reports false when it was undone in the meantime.
+func (s *Store) ClaimPendingAction(id int64) (bool, error) {
+	return s.moveAction(id, model.ActionPending, model.ActionRunning, "")
+}
+
+// RequeuePendingAction returns a running action to the queue, for when the
+// server stops while running it.
+func (s *Store) RequeuePendingAction(id int64) error {
+	_, err := s.moveAction(id, model.ActionRunning, model.ActionPending, "")
+	return err
+}
+
+// FinishPendingAction records the outcome of a running action: status
+// (ActionDone or ActionKept) when it succeeded, ActionFailed otherwise.
+func (s *Store) FinishPendingAction(id int64, status string, runErr error) error {
+	msg := ""
+	if runErr != nil {
+		status, msg = model.ActionFailed, runErr.Error()
+	}
+	ok, err := s.moveAction(id, model.ActionRunning, status, msg)
+	if err == nil && !ok {
+		err = fmt.Errorf("action %d is no longer running", id)
+	}
+	return err
+}
+
+func (s *Store) moveAction(id int64, from, to, msg string) (bool, error) {
+	finished := int64(0)
+	if to != model.ActionRunning && to != model.ActionPending {
+		finished = time.Now().Unix()
+	}
+	res, err := s.db.Exec(
+		"UPDATE pending_actions SET status = ?, error = ?, finished_at = ? WHERE id = ? AND status = ?",
+		to, msg, finished, id, from,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"headcontrol/internal/model"
+	"strings"
+)
+
+func (s *Store) migrateAudit() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			at INTEGER NOT NULL,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			node_id TEXT NOT NULL DEFAULT '',
+			target TEXT NOT NULL DEFAULT '',
+			detail TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS audit_events_user ON audit_events (user_id, at);
+		CREATE INDEX IF NOT EXISTS audit_events_node ON audit_events (node_id, at);
+	`)
+	return err
+}
+
+// RecordAuditEvent stores e and sets its ID.
+func (s *Store) RecordAuditEvent(e *model.AuditEvent) error {
+	res, err := s.db.Exec(
+		"INSERT INTO audit_events (at, actor, action, user_id, node_id, target, detail) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		e.At.Unix(), e.Actor, e.Action, e.UserID, e.NodeID, e.Target, e.Detail,
+	)
+	if err != nil {
+		return err
+	}
+	e.ID, err = res.LastInsertId()
+	return err
+}
+
+// UserAuditEvents returns the latest events about a user or any of the
+// given nodes, which also covers what happened to a node before the user
+// was given it. Newest first.
+func (s *Store) UserAuditEvents(userID string, nodeIDs []string, limit int) ([]model.AuditEvent, error) {
+	query := "SELECT id, at, actor, action, user_id, node_id, target, detail FROM audit_events WHERE user_id = ?"
+	args := []any{userID}
+	if len(nodeIDs) > 0 {
+		query += " OR node_id IN (?" + strings.Repeat(", ?", len(nodeIDs)-1) + ")"
+		for _, id := range nodeIDs {
+			args = append(args, id)
+		}
+	}
+	rows, err := s.db.Query(query+" ORDER BY at DESC, id DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []model.AuditEvent
+	for rows.Next() {
+		var (
+			e  model.AuditEvent
+			at int64
+		)
+		if err := rows.Scan(&e.ID, &at, &e.Actor, &e.Action, &e.UserID, &e.NodeID, &e.Target, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.At = unixTime(at)
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
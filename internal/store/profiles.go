@@ -0,0 +1,106 @@
+package store
+
+import (
+	"database/sql"
+	"headcontrol/internal/model"
+	"time"
+)
+
+func (s *Store) migrateProfiles() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_profiles (
+			user_id TEXT PRIMARY KEY,
+			display_name TEXT NOT NULL DEFAULT '',
+			email TEXT NOT NULL DEFAULT '',
+			picture_url TEXT NOT NULL DEFAULT '',
+			avatar BLOB,
+			avatar_type TEXT NOT NULL DEFAULT '',
+			updated_at INTEGER NOT NULL
+		)
+	`)
+	return err
+}
+
+const profileColumns = "user_id, display_name, email, picture_url, avatar_type, updated_at"
+
+func scanProfile(row interface{ Scan(...any) error }) (*model.UserProfile, error) {
+	var (
+		p       model.UserProfile
+		updated int64
+	)
+	err := row.Scan(&p.UserID, &p.DisplayName, &p.Email, &p.PictureURL, &p.AvatarType, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.UpdatedAt = unixTime(updated)
+	return &p, nil
+}
+
+// UserProfile returns the edited profile of a Headscale user, or nil when
+// it was never edited.
+func (s *Store) UserProfile(userID string) (*model.UserProfile, error) {
+	return scanProfile(s.db.QueryRow("SELECT "+profileColumns+" FROM user_profiles WHERE user_id = ?", userID))
+}
+
+// UserProfiles returns every edited profile by user ID.
+func (s *Store) UserProfiles() (map[string]*model.UserProfile, error) {
+	rows, err := s.db.Query("SELECT " + profileColumns + " FROM user_profiles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]*model.UserProfile)
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		out[p.UserID] = p
+	}
+	return out, rows.Err()
+}
+
+// SaveUserProfile stores the text fields of p and sets UpdatedAt. An
+// uploaded picture is kept.
+func (s *Store) SaveUserProfile(p *model.UserProfile) error {
+	p.UpdatedAt = time.Now()
+	_, err := s.db.Exec(`
+		INSERT INTO user_profiles (user_id, display_name, email, picture_url, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET display_name = excluded.display_name, email = excluded.email,
+			picture_url = excluded.picture_url, updated_at = excluded.updated_at`,
+		p.UserID, p.DisplayName, p.Email, p.PictureURL, p.UpdatedAt.Unix(),
+	)
+	return err
+}
+
+// SetAvatar replaces the uploaded picture of a user whose profile was
+// saved. An empty contentType removes it.
+func (s *Store) SetAvatar(userID, contentType string, data []byte) error {
+	if contentType == "" {
+		data = nil
+	}
+	_, err := s.db.Exec("UPDATE user_profiles SET avatar = ?, avatar_type = ?, updated_at = ? WHERE user_id = ?",
+		data, contentType, time.Now().Unix(), userID)
+	return err
+}
+
+// Avatar returns the uploaded picture of a user with its content type and
+// upload time. data is nil when there is none.
+func (s *Store) Avatar(userID string) (data []byte, contentType string, updated time.Time, err error) {
+	var at int64
+	err = s.db.QueryRow("SELECT avatar, avatar_type, updated_at FROM user_profiles WHERE user_id = ? AND avatar_type != ''", userID).
+		Scan(&data, &contentType, &at)
+	if err == sql.ErrNoRows {
+		return nil, "", time.Time{}, nil
+	}
+	return data, contentType, unixTime(at), err
+}
+
+// DeleteUserProfile forgets the profile of a user deleted from Headscale.
+func (s *Store) DeleteUserProfile(userID string) error {
+	_, err := s.db.Exec("DELETE FROM user_profiles WHERE user_id = ?", userID)
+	return err
+}
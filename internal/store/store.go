@@ -3,6 +3,7 @@ package store
 import (
 	"database/sql"
 	"headcontrol/internal/model"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,7 +14,13 @@ type Store struct {
 }
 
 func New(dbPath string) (*Store, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	dsn := dbPath
+	if !strings.Contains(dsn, "?") {
+		// WAL keeps the database consistent if the process is killed
+		// mid-write; the busy timeout covers concurrent writers.
+		dsn += "?_journal_mode=WAL&_busy_timeout=5000"
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -38,14 +45,69 @@ func (s *Store) migrate() error {
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
+	if err != nil {
+		return err
+	}
+
+	if err := s.addColumn("settings", "read_timeout", "INTEGER NOT NULL DEFAULT 15"); err != nil {
+		return err
+	}
+	if err := s.addColumn("settings", "write_timeout", "INTEGER NOT NULL DEFAULT 15"); err != nil {
+		return err
+	}
+	if err := s.addColumn("settings", "transport", "TEXT NOT NULL DEFAULT 'rest'"); err != nil {
+		return err
+	}
+	if err := s.addColumn("settings", "grpc_address", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.addColumn("settings", "grpc_tls", "TEXT NOT NULL DEFAULT 'verify'"); err != nil {
+		return err
+	}
+	if err := s.addColumn("settings", "require_totp", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := s.migrateAccounts(); err != nil {
+		return err
+	}
+	if err := s.migrateActions(); err != nil {
+		return err
+	}
+	if err := s.migrateAudit(); err != nil {
+		return err
+	}
+	return s.migrateProfiles()
+}
+
+// addColumn adds a column to an existing table unless it is already there.
+func (s *Store) addColumn(table, column, def string) error {
+	rows, err := s.db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = s.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + def)
 	return err
 }
 
 func (s *Store) GetSettings() (*model.Settings, error) {
 	var st model.Settings
 	err := s.db.QueryRow(
-		"SELECT id, base_url, api_key, created_at, updated_at FROM settings ORDER BY id DESC LIMIT 1",
-	).Scan(&st.ID, &st.BaseURL, &st.APIKey, &st.CreatedAt, &st.UpdatedAt)
+		"SELECT id, base_url, api_key, created_at, updated_at, read_timeout, write_timeout, transport, grpc_address, grpc_tls, require_totp FROM settings ORDER BY id DESC LIMIT 1",
+	).Scan(&st.ID, &st.BaseURL, &st.APIKey, &st.CreatedAt, &st.UpdatedAt, &st.ReadTimeout, &st.WriteTimeout,
+		&st.Transport, &st.GRPCAddress, &st.GRPCTLS, &st.RequireTOTP)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -78,6 +140,48 @@ func (s *Store) SaveSettings(baseURL, apiKey string) error {
 	return err
 }
 
+// SaveConnection stores everything about the Headscale connection in one
+// transaction, so a failure cannot leave it half updated.
+func (s *Store) SaveConnection(cfg *model.Settings) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format(time.RFC3339)
+	res, err := tx.Exec(
+		`UPDATE settings SET base_url = ?, api_key = ?, read_timeout = ?, write_timeout = ?,
+			transport = ?, grpc_address = ?, grpc_tls = ?, updated_at = ?
+		WHERE id = (SELECT MAX(id) FROM settings)`,
+		cfg.BaseURL, cfg.APIKey, cfg.ReadTimeout, cfg.WriteTimeout, cfg.Transport, cfg.GRPCAddress, cfg.GRPCTLS, now,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		_, err = tx.Exec(
+			`INSERT INTO settings (base_url, api_key, read_timeout, write_timeout, transport, grpc_address, grpc_tls, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			cfg.BaseURL, cfg.APIKey, cfg.ReadTimeout, cfg.WriteTimeout, cfg.Transport, cfg.GRPCAddress, cfg.GRPCTLS, now, now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SaveTOTPPolicy(require bool) error {
+	_, err := s.db.Exec(
+		"UPDATE settings SET require_totp = ?, updated_at = ? WHERE id = (SELECT MAX(id) FROM settings)",
+		require, time.Now().Format(time.RFC3339),
+	)
+	return err
+}
+
 func (s *Store) HasSettings() bool {
 	st, err := s.GetSettings()
 	return err == nil && st != nil
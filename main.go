@@ -1,59 +1,198 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"headcontrol/internal/assets"
+	"headcontrol/internal/auth"
+	"headcontrol/internal/avatar"
+	"headcontrol/internal/cli"
+	"headcontrol/internal/config"
 	"headcontrol/internal/handler"
+	"headcontrol/internal/lifecycle"
+	"headcontrol/internal/model"
+	"headcontrol/internal/server"
 	"headcontrol/internal/store"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	port := flag.String("port", "8080", "Server port")
-	dbPath := flag.String("db", "headcontrol.db", "SQLite database path")
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
+	} else if len(args) > 0 && cli.IsCommand(args[0]) {
+		os.Exit(cli.Run(args, os.Stdout, os.Stderr))
+	}
+	serve(args)
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to a TOML config file (default $HEADCONTROL_CONFIG)")
+	listen := flags.String("listen", "", "Listen address, e.g. 127.0.0.1:8080")
+	port := flags.String("port", "", "Server port (shorthand for -listen :PORT)")
+	dbPath := flags.String("db", "", "SQLite database path")
+	dev := flags.Bool("dev", false, "Load templates and static files from disk for hot reload")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "port":
+			cfg.Listen = ":" + *port
+		case "db":
+			cfg.DB = *dbPath
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("config: %v", err)
+	}
 
-	s, err := store.New(*dbPath)
+	s, err := store.New(cfg.DB)
 	if err != nil {
 		log.Fatalf("database: %v", err)
 	}
-	defer s.Close()
 
-	h, err := handler.New(s, "templates")
+	if cfg.Headscale.URL != "" && !s.HasSettings() {
+		if err := s.SaveSettings(cfg.Headscale.URL, cfg.Headscale.APIKey); err != nil {
+			log.Fatalf("bootstrap settings: %v", err)
+		}
+		log.Printf("seeded Headscale connection from config: %s", cfg.Headscale.URL)
+	}
+
+	root := fs.FS(embedded)
+	if *dev {
+		root = os.DirFS(".")
+		log.Printf("dev mode: serving templates and static files from disk")
+	}
+	templates, _ := fs.Sub(root, "templates")
+	staticFS, _ := fs.Sub(root, "static")
+
+	static, err := assets.New(staticFS, cfg.BasePath+"/static", *dev)
+	if err != nil {
+		log.Fatalf("static: %v", err)
+	}
+
+	secret := cfg.SessionSecret
+	if secret == "" {
+		secret = server.RandomSecret()
+		log.Printf("no session_secret set: logins and open pages will not survive a restart")
+	}
+
+	var oidc *auth.OIDC
+	if cfg.OIDC.Enabled() {
+		groups := make(map[string]string)
+		for role, names := range map[string][]string{
+			model.RoleViewer:   cfg.OIDC.ViewerGroups,
+			model.RoleOperator: cfg.OIDC.OperatorGroups,
+			model.RoleAdmin:    cfg.OIDC.AdminGroups,
+		} {
+			for _, g := range names {
+				groups[g] = model.HigherRole(groups[g], role)
+			}
+		}
+		oidc = auth.NewOIDC(auth.OIDCOptions{
+			Issuer:        cfg.OIDC.Issuer,
+			ClientID:      cfg.OIDC.ClientID,
+			ClientSecret:  cfg.OIDC.ClientSecret,
+			Scopes:        cfg.OIDC.Scopes,
+			Name:          cfg.OIDC.Name,
+			UsernameClaim: cfg.OIDC.UsernameClaim,
+			GroupsClaim:   cfg.OIDC.GroupsClaim,
+			Groups:        groups,
+			DefaultRole:   cfg.OIDC.DefaultRole,
+			Secret:        secret,
+			CookiePath:    cfg.BasePath + "/",
+		})
+		log.Printf("single sign-on through %s", cfg.OIDC.Issuer)
+	}
+
+	h, err := handler.New(s, handler.Options{
+		Templates:        templates,
+		Static:           static,
+		Dev:              *dev,
+		BasePath:         cfg.BasePath,
+		DashboardRefresh: cfg.Poll.Dashboard.Duration,
+		NodesRefresh:     cfg.Poll.Nodes.Duration,
+		CacheTTL:         cfg.Cache.TTL.Duration,
+		SessionSecret:    secret,
+
+		OIDC:                 oidc,
+		OIDCRedirectURL:      cfg.OIDC.RedirectURL,
+		DisablePasswordLogin: cfg.OIDC.DisablePasswordLogin,
+
+		UndoWindow:     cfg.UndoWindow.Duration,
+		AvatarStrategy: cfg.Avatar.Strategy,
+	})
 	if err != nil {
 		log.Fatalf("templates: %v", err)
 	}
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux := h.Routes()
 
-	http.HandleFunc("/setup", h.SetupPage)
-	http.HandleFunc("/api/test-connection", h.TestConnection)
-	http.HandleFunc("/api/save-settings", h.SaveSettings)
+	proxies, err := server.ParseProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	csrf := server.NewCSRF(secret, cfg.BasePath+"/")
+	csrf.Reject = http.HandlerFunc(h.CSRFRejected)
+	app := proxies.Handler(server.SecurityHeaders(avatar.Sources(cfg.Avatar.Strategy), csrf.Handler(mux)))
 
-	http.HandleFunc("/", h.RequireSetup(h.DashboardPage))
-	http.HandleFunc("/users", h.RequireSetup(h.UsersPage))
-	http.HandleFunc("/nodes", h.RequireSetup(h.NodesPage))
-	http.HandleFunc("/settings", h.RequireSetup(h.SettingsPage))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	workers := lifecycle.New(ctx)
 
-	http.HandleFunc("/dashboard/summary", h.RequireSetup(h.DashboardSummary))
-	http.HandleFunc("/users/table", h.RequireSetup(h.UsersTable))
-	http.HandleFunc("/nodes/table", h.RequireSetup(h.NodesTable))
-	http.HandleFunc("/nodes/detail", h.RequireSetup(h.NodeDetail))
+	srv := server.New(cfg.Listen, app)
+	scheme := "http"
+	if cfg.TLS.Enabled() {
+		certs, err := server.NewCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+		srv.TLSConfig = certs.TLSConfig()
+		if cfg.TLS.HSTSMaxAge.Duration > 0 {
+			srv.Handler = server.HSTS(cfg.TLS.HSTSMaxAge.Duration, app)
+		}
+		workers.Every("tls-reload", server.CertReloadInterval, certs.Check)
 
-	http.HandleFunc("/api/users/create", h.RequireSetup(h.CreateUser))
-	http.HandleFunc("/api/users/rename", h.RequireSetup(h.RenameUser))
-	http.HandleFunc("/api/users/delete", h.RequireSetup(h.DeleteUser))
+		if cfg.TLS.Redirect != "" {
+			redirect := server.New(cfg.TLS.Redirect, server.RedirectHTTPS(cfg.Listen))
+			workers.Go("http-redirect", func(ctx context.Context) error {
+				return server.Run(ctx, redirect)
+			})
+		}
+		scheme = "https"
+	}
 
-	http.HandleFunc("/api/nodes/rename", h.RequireSetup(h.RenameNode))
-	http.HandleFunc("/api/nodes/expire", h.RequireSetup(h.ExpireNode))
-	http.HandleFunc("/api/nodes/delete", h.RequireSetup(h.DeleteNode))
-	http.HandleFunc("/api/nodes/tags", h.RequireSetup(h.SetNodeTags))
-	http.HandleFunc("/api/nodes/routes", h.RequireSetup(h.SetNodeRoutes))
+	if n, err := s.ResumeInterruptedActions(); err != nil {
+		log.Fatalf("database: %v", err)
+	} else if n > 0 {
+		log.Printf("resuming %d interrupted deletions", n)
+	}
+	workers.Every("pending-actions", handler.PendingActionInterval, h.RunPendingActions)
 
-	http.HandleFunc("/api/update-settings", h.RequireSetup(h.UpdateSettings))
+	log.Printf("HeadControl listening on %s://%s%s/", scheme, cfg.Listen, cfg.BasePath)
+	workers.Go("http", func(ctx context.Context) error {
+		return server.Run(ctx, srv)
+	})
 
-	log.Printf("HeadControl starting on http://localhost:%s", *port)
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
+	err = workers.Wait()
+	h.Close()
+	if cerr := s.Close(); cerr != nil {
+		log.Printf("database: close: %v", cerr)
+	}
+	if err != nil {
 		log.Fatalf("server: %v", err)
 	}
+	log.Printf("HeadControl stopped")
 }
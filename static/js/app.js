@@ -1,4 +1,10 @@
 const HC = {};
+
+HC.url = function (path) {
+    const base = document.body ? document.body.getAttribute('data-base-path') || '' : '';
+    return base + path;
+};
+
 HC.Sidebar = {
     toggle() {
         const sidebar = document.getElementById('sidebar');
@@ -79,10 +85,7 @@ HC.Modal = {
     open(id) {
         const modal = document.getElementById(id);
         if (!modal) return;
-        modal.style.display = 'flex';
-        if (typeof lucide !== 'undefined') {
-            lucide.createIcons();
-        }
+        modal.classList.add('open');
         setTimeout(() => {
             const input = modal.querySelector('input:not([type="hidden"])');
             if (input) input.focus();
@@ -92,7 +95,7 @@ HC.Modal = {
     close(id) {
         const modal = document.getElementById(id);
         if (!modal) return;
-        modal.style.display = 'none';
+        modal.classList.remove('open');
         const form = modal.querySelector('form');
         if (form) form.reset();
     },
@@ -106,23 +109,32 @@ HC.Modal = {
         this.open('rename-user-modal');
     },
 
-    openDeleteUser(id, name) {
-        const idEl = document.getElementById('delete-user-id');
-        const nameEl = document.getElementById('delete-user-name');
-        if (idEl) idEl.value = id;
-        if (nameEl) nameEl.textContent = name;
+    // The delete plan depends on the nodes the user owns right now, so the
+    // server renders the form each time the modal opens.
+    openDeleteUser(id) {
+        const content = document.getElementById('delete-user-content');
+        if (content) {
+            content.innerHTML = '<div class="modal-body"><div class="loading-placeholder"><span class="spinner"></span></div></div>';
+        }
         this.open('delete-user-modal');
+
+        if (typeof htmx !== 'undefined') {
+            htmx.ajax('GET', HC.url('/users/delete-plan?id=' + encodeURIComponent(id)), {
+                target: '#delete-user-content',
+                swap: 'innerHTML'
+            });
+        }
     },
 
     openNodeDetail(id) {
         const content = document.getElementById('node-detail-content');
         if (content) {
-            content.innerHTML = '<div style="text-align:center; padding:24px;"><span class="spinner"></span></div>';
+            content.innerHTML = '<div class="loading-placeholder"><span class="spinner"></span></div>';
         }
         this.open('node-detail-modal');
 
         if (typeof htmx !== 'undefined') {
-            htmx.ajax('GET', '/nodes/detail?id=' + id, {
+            htmx.ajax('GET', HC.url('/nodes/detail?id=' + encodeURIComponent(id)), {
                 target: '#node-detail-content',
                 swap: 'innerHTML'
             });
@@ -166,50 +178,150 @@ HC.Toast = {
             mutations.forEach(mutation => {
                 mutation.addedNodes.forEach(node => {
                     if (node.classList && node.classList.contains('toast')) {
+                        // Undo toasts stay for the whole undo window.
+                        const timeout = parseInt(node.dataset.timeout, 10) || 4000;
                         setTimeout(() => {
                             node.style.opacity = '0';
                             node.style.transform = 'translateX(100%)';
                             setTimeout(() => node.remove(), 300);
-                        }, 4000);
+                        }, timeout);
                     }
                 });
             });
         });
 
         observer.observe(container, { childList: true });
+    },
+
+    // show adds a toast for a message that did not come from the server
+    // as rendered HTML.
+    show(message, kind) {
+        const container = document.getElementById('toast-container');
+        if (!container) return;
+        const toast = document.createElement('div');
+        toast.className = 'toast toast-' + (kind || 'error');
+        toast.textContent = message;
+        container.appendChild(toast);
     }
 };
 
 
 HC.refreshUsers = function () {
     if (typeof htmx !== 'undefined') {
-        htmx.ajax('GET', '/users/table', { target: '.content', swap: 'innerHTML' });
+        htmx.ajax('GET', HC.url('/users/table'), { target: '.content', swap: 'innerHTML' });
     }
 };
 
 HC.refreshNodes = function () {
     if (typeof htmx !== 'undefined') {
-        htmx.ajax('GET', '/nodes/table', { target: '.content', swap: 'innerHTML' });
+        htmx.ajax('GET', HC.url('/nodes/table'), { target: '.content', swap: 'innerHTML' });
+    }
+};
+
+// refreshPage reloads the content of the current page, for pages such as
+// a user's that are not one of the tables.
+HC.refreshPage = function () {
+    if (typeof htmx !== 'undefined') {
+        htmx.ajax('GET', location.pathname, { target: '.content', swap: 'innerHTML' });
+    }
+};
+
+// copy puts text on the clipboard and marks the button for a moment. The
+// Clipboard API needs HTTPS or localhost; elsewhere a hidden textarea and
+// execCommand do the job.
+HC.copy = function (el, text) {
+    const done = () => {
+        el.classList.add('copied');
+        el.setAttribute('title', 'Copied');
+        setTimeout(() => {
+            el.classList.remove('copied');
+            el.setAttribute('title', 'Copy');
+        }, 1500);
+    };
+    if (navigator.clipboard && window.isSecureContext) {
+        navigator.clipboard.writeText(text).then(done);
+        return;
+    }
+    const area = document.createElement('textarea');
+    area.value = text;
+    area.className = 'copy-buffer';
+    document.body.appendChild(area);
+    area.select();
+    if (document.execCommand('copy')) done();
+    area.remove();
+};
+
+// showTab shows the panel a tab names and hides its siblings.
+HC.showTab = function (el) {
+    const panel = document.getElementById(el.dataset.tab);
+    if (!panel) return;
+    el.parentElement.querySelectorAll('[data-action="tab"]').forEach(tab => {
+        const active = tab === el;
+        tab.classList.toggle('active', active);
+        const other = document.getElementById(tab.dataset.tab);
+        if (other) other.hidden = !active;
+    });
+};
+
+// Elements say what a click does with data-action rather than inline
+// handlers, which the Content-Security-Policy does not allow.
+HC.actions = {
+    'sidebar-toggle': () => HC.Sidebar.toggle(),
+    'sidebar-close': () => HC.Sidebar.close(),
+    'theme-menu': () => HC.Theme.toggleDropdown(),
+    'theme': el => HC.Theme.set(el.dataset.setTheme),
+    'modal-open': el => HC.Modal.open(el.dataset.modal),
+    'modal-close': el => HC.Modal.close(el.closest('.modal-overlay').id),
+    'modal-close-refresh': el => {
+        HC.Modal.close(el.closest('.modal-overlay').id);
+        if (el.dataset.refresh !== 'users') return;
+        // A deleted user's own page is gone; go back to the list.
+        if (location.pathname !== HC.url('/users')) history.pushState(null, '', HC.url('/users'));
+        HC.refreshUsers();
+    },
+    'rename-user': el => HC.Modal.openRenameUser(el.dataset.id, el.dataset.name),
+    'delete-user': el => HC.Modal.openDeleteUser(el.dataset.id),
+    'node-detail': el => HC.Modal.openNodeDetail(el.dataset.id),
+    'rename-node': el => HC.Modal.openRenameNode(el.dataset.id, el.dataset.name),
+    'expire-node': el => HC.Modal.openExpireNode(el.dataset.id, el.dataset.name),
+    'delete-node': el => HC.Modal.openDeleteNode(el.dataset.id, el.dataset.name),
+    'tab': el => HC.showTab(el),
+    'copy': el => {
+        const source = el.dataset.copyFrom ? document.querySelector(el.dataset.copyFrom) : null;
+        HC.copy(el, source ? source.textContent : el.dataset.copy);
     }
 };
 
 document.addEventListener('click', function (e) {
+    const el = e.target.closest('[data-action]');
+    if (el && HC.actions[el.dataset.action]) {
+        HC.actions[el.dataset.action](el);
+        return;
+    }
     if (e.target.classList.contains('modal-overlay')) {
-        e.target.style.display = 'none';
-        const form = e.target.querySelector('form');
-        if (form) form.reset();
+        HC.Modal.close(e.target.id);
     }
 });
 
+// A form with data-refresh closes its modal or toast and reloads the named
+// table once its request succeeds.
+document.addEventListener('htmx:afterRequest', function (e) {
+    const form = e.detail.elt;
+    if (!e.detail.successful || !form.matches('form[data-refresh]')) return;
+    const modal = form.closest('.modal-overlay');
+    if (modal) HC.Modal.close(modal.id);
+    const toast = form.closest('.toast');
+    if (toast) toast.remove();
+    if (form.dataset.refresh === 'users') HC.refreshUsers();
+    if (form.dataset.refresh === 'nodes') HC.refreshNodes();
+    if (form.dataset.refresh === 'page') HC.refreshPage();
+});
+
 
 document.addEventListener('keydown', function (e) {
     if (e.key === 'Escape') {
-        document.querySelectorAll('.modal-overlay').forEach(modal => {
-            if (modal.style.display !== 'none') {
-                modal.style.display = 'none';
-                const form = modal.querySelector('form');
-                if (form) form.reset();
-            }
+        document.querySelectorAll('.modal-overlay.open').forEach(modal => {
+            HC.Modal.close(modal.id);
         });
         HC.Theme.closeDropdown();
     }
@@ -226,9 +338,10 @@ document.addEventListener('click', function (e) {
 HC.Nav = {
     update() {
         const path = window.location.pathname;
+        const home = HC.url('/');
         document.querySelectorAll('.nav-link').forEach(link => {
             const href = link.getAttribute('href');
-            const active = path === href || (href !== '/' && path.startsWith(href));
+            const active = path === href || (href !== home && path.startsWith(href));
             link.classList.toggle('active', active);
         });
     }
@@ -243,3 +356,23 @@ document.addEventListener('DOMContentLoaded', function () {
 document.addEventListener('htmx:pushedIntoHistory', function () {
     HC.Nav.update();
 });
+
+// Error responses from HeadControl carry a rendered banner or toast; swap
+// them in like any other. Anything else, such as a plain-text error or a
+// reverse proxy's error page, would break the layout, so it becomes a toast.
+document.addEventListener('htmx:beforeSwap', function (e) {
+    const xhr = e.detail.xhr;
+    if (xhr.status < 400) return;
+    const type = xhr.getResponseHeader('Content-Type') || '';
+    if (type.indexOf('text/html') === 0 && xhr.responseText) {
+        e.detail.shouldSwap = true;
+        e.detail.isError = false;
+        return;
+    }
+    e.detail.shouldSwap = false;
+    let text = type.indexOf('text/plain') === 0 ? xhr.responseText.trim() : '';
+    if (!text || text.length > 200) {
+        text = 'Request failed (HTTP ' + xhr.status + ').';
+    }
+    HC.Toast.show(text, 'error');
+});